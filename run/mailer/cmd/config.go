@@ -10,9 +10,16 @@ import (
 	"github.com/BurntSushi/toml"
 	itoml "github.com/influxdata/influxdb/toml"
 	"github.com/nirnanaaa/cloudive-mailer/meta"
+	"github.com/nirnanaaa/cloudive-mailer/services/blobs"
 	"github.com/nirnanaaa/cloudive-mailer/services/httpd"
 	"github.com/nirnanaaa/cloudive-mailer/services/kafka"
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
 	"github.com/nirnanaaa/cloudive-mailer/services/smtp"
+	"github.com/nirnanaaa/cloudive-mailer/services/standalone"
+	"github.com/nirnanaaa/cloudive-mailer/services/status"
+	"github.com/nirnanaaa/cloudive-mailer/services/templates"
+	"github.com/nirnanaaa/cloudive-mailer/services/webhooks"
+	"github.com/nirnanaaa/cloudive-mailer/services/worker"
 )
 
 // Config represents the configuration format for the cloudive binary.
@@ -21,6 +28,15 @@ type Config struct {
 	Meta  *meta.Config  `toml:"meta"`
 	HTTPD *httpd.Config `toml:"httpd"`
 	SMTP  smtp.Config   `toml:"smtp"`
+	Queue *queue.Config `toml:"queue"`
+
+	Templates *templates.Config `toml:"templates"`
+	Status    *status.Config    `toml:"status"`
+	Worker    *worker.Config    `toml:"worker"`
+	Webhooks  *webhooks.Config  `toml:"webhooks"`
+	Blobs     *blobs.Config     `toml:"blobs"`
+
+	Standalone *standalone.Config `toml:"standalone"`
 }
 
 // NewConfig returns an instance of Config with reasonable defaults.
@@ -30,6 +46,13 @@ func NewConfig() *Config {
 	c.Meta = meta.NewConfig()
 	c.HTTPD = httpd.NewConfig()
 	c.SMTP = smtp.NewConfig()
+	c.Queue = queue.NewConfig()
+	c.Templates = templates.NewConfig()
+	c.Status = status.NewConfig()
+	c.Worker = worker.NewConfig()
+	c.Webhooks = webhooks.NewConfig()
+	c.Blobs = blobs.NewConfig()
+	c.Standalone = standalone.NewConfig()
 	return c
 }
 
@@ -71,7 +94,25 @@ func (c *Config) FromToml(input string) error {
 
 // Validate returns an error if the config is invalid.
 func (c *Config) Validate() error {
-	return nil
+	if err := c.HTTPD.Validate(); err != nil {
+		return err
+	}
+	if err := c.SMTP.Validate(); err != nil {
+		return err
+	}
+	if err := c.Kafka.Validate(); err != nil {
+		return err
+	}
+	if err := c.Queue.Validate(); err != nil {
+		return err
+	}
+	if err := c.Worker.Validate(); err != nil {
+		return err
+	}
+	if err := c.Webhooks.Validate(); err != nil {
+		return err
+	}
+	return c.Standalone.Validate()
 }
 
 // ApplyEnvOverrides apply the environment configuration on top of the config.
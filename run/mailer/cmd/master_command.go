@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"github.com/nirnanaaa/cloudive-mailer/services/httpd"
-	"github.com/nirnanaaa/cloudive-mailer/services/kafka"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 	prefixed "github.com/x-cray/logrus-prefixed-formatter"
@@ -97,14 +96,32 @@ func (cmd *Command) Run(args ...string) error {
 	}
 	logger.SetLevel(level)
 	flag.Parse()
-	kafkaService := kafka.NewService(config.Kafka)
-	kafkaService.SetLogOutput(logger, "[kafka]")
+	queueService, err := newQueueBackend(config.Queue.Backend, config, logger)
+	if err != nil {
+		return err
+	}
 	httpdService := httpd.NewService(*config.HTTPD)
 	httpdService.SetLogOutput(logger)
-	httpdService.Handler.Kafka = kafkaService
-	// kafkaService.SetDefaultMessageProcessor()
+	httpdService.Handler.Queue = queueService
+	httpdService.Handler.Templates = newTemplateStore(config)
+	statusStore := newStatusStore(config, logger)
+	httpdService.Handler.Status = statusStore
+	recordStatus(queueService, httpdService.Handler.Status)
+	blobStore := newBlobStore(config, logger)
+	if blobStore != nil {
+		httpdService.Handler.Blobs = blobStore
+	}
+	// services are started in this order and stopped in reverse, so httpd
+	// only accepts mails while the queue and the stores are open.
+	if blobStore != nil {
+		cmd.Services = append(cmd.Services, blobStore)
+	}
+	// the status store removes expired states
+	if statusService, ok := statusStore.(Service); ok {
+		cmd.Services = append(cmd.Services, statusService)
+	}
+	cmd.Services = append(cmd.Services, queueService)
 	cmd.Services = append(cmd.Services, httpdService)
-	cmd.Services = append(cmd.Services, kafkaService)
 	return nil
 }
 
@@ -123,8 +140,8 @@ func (cmd *Command) Open() error {
 func (cmd *Command) Close() error {
 	// Close services to allow any inflight requests to complete
 	// and prevent new requests from being accepted.
-	for _, service := range cmd.Services {
-		service.Stop()
+	for i := len(cmd.Services) - 1; i >= 0; i-- {
+		cmd.Services[i].Stop()
 	}
 	defer close(cmd.Closed)
 	close(cmd.closing)
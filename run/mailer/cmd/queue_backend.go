@@ -0,0 +1,94 @@
+package run
+
+import (
+	"fmt"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/blobs"
+	"github.com/nirnanaaa/cloudive-mailer/services/kafka"
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
+	"github.com/nirnanaaa/cloudive-mailer/services/status"
+	"github.com/nirnanaaa/cloudive-mailer/services/templates"
+	"github.com/nirnanaaa/cloudive-mailer/services/webhooks"
+	"github.com/sirupsen/logrus"
+)
+
+// newQueueBackend returns the queue backend with the given name, configured
+// from the [queue] and [kafka] sections.
+func newQueueBackend(backend string, config *Config, logger *logrus.Logger) (queue.Backend, error) {
+	switch backend {
+	case queue.BackendKafka:
+		s := kafka.NewService(config.Kafka)
+		s.SetLogOutput(logger, "[kafka]")
+		return s, nil
+	case queue.BackendMemory:
+		s := queue.NewMemoryQueue(config.Queue)
+		s.SetLogOutput(logger)
+		return s, nil
+	case queue.BackendDisk:
+		s := queue.NewDiskQueue(config.Queue)
+		s.SetLogOutput(logger)
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown queue backend %q", backend)
+}
+
+// newTemplateStore returns the template store or nil if templates are disabled.
+func newTemplateStore(config *Config) templates.Store {
+	if !config.Templates.Enabled {
+		return nil
+	}
+	return templates.NewDiskStore(config.Templates)
+}
+
+// newStatusStore returns the status store or nil if status tracking is disabled.
+func newStatusStore(config *Config, logger *logrus.Logger) status.Store {
+	if !config.Status.Enabled {
+		return nil
+	}
+	s := status.NewDiskStore(config.Status)
+	s.SetLogOutput(logger)
+	return s
+}
+
+// newStatusReporter returns how workers report state changes: through the
+// status queue when using kafka, otherwise straight into the store, which
+// the disk queue shares on the same host. The store locks its files, so the
+// master's store and this one don't overwrite each other's updates; expired
+// states are removed by the master.
+func newStatusReporter(config *Config, backend queue.Backend, logger *logrus.Logger) status.Reporter {
+	if !config.Status.Enabled {
+		return nil
+	}
+	if k, ok := backend.(*kafka.Service); ok {
+		return &status.QueueReporter{Publish: k.PublishStatus}
+	}
+	return newStatusStore(config, logger)
+}
+
+// recordStatus records the state changes reported through the kafka status
+// queue into store.
+func recordStatus(backend queue.Backend, store status.Store) {
+	if k, ok := backend.(*kafka.Service); ok && store != nil {
+		k.ConsumeStatus(status.Recorder(store))
+	}
+}
+
+// newWebhooks returns the webhook service or nil if webhooks are disabled.
+func newWebhooks(config *Config, logger *logrus.Logger) *webhooks.Service {
+	if !config.Webhooks.Enabled {
+		return nil
+	}
+	s := webhooks.NewService(config.Webhooks)
+	s.SetLogOutput(logger)
+	return s
+}
+
+// newBlobStore returns the store of uploads or nil if uploads are disabled.
+func newBlobStore(config *Config, logger *logrus.Logger) *blobs.DiskStore {
+	if !config.Blobs.Enabled {
+		return nil
+	}
+	s := blobs.NewDiskStore(config.Blobs)
+	s.SetLogOutput(logger)
+	return s
+}
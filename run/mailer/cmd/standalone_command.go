@@ -0,0 +1,209 @@
+package run
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/httpd"
+	"github.com/nirnanaaa/cloudive-mailer/services/smtp"
+	"github.com/nirnanaaa/cloudive-mailer/services/worker"
+	"github.com/sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
+	prefixed "github.com/x-cray/logrus-prefixed-formatter"
+)
+
+// StandaloneCommand represents the command executed by "cloudive-mailer standalone".
+type StandaloneCommand struct {
+	Version   string
+	Branch    string
+	Commit    string
+	BuildTime string
+
+	closing chan struct{}
+	err     chan error
+	Closed  chan struct{}
+
+	Stdin    io.Reader
+	Stdout   io.Writer
+	Stderr   io.Writer
+	Services []Service
+
+	Logger *logrus.Logger
+	Getenv func(string) string
+}
+
+// StandaloneNewCommand return a new instance of StandaloneCommand.
+func StandaloneNewCommand() *StandaloneCommand {
+	logger := log.New()
+	logger.Formatter = new(prefixed.TextFormatter)
+	return &StandaloneCommand{
+		closing: make(chan struct{}),
+		err:     make(chan error),
+		Closed:  make(chan struct{}),
+		Stdin:   os.Stdin,
+		Stdout:  os.Stdout,
+		Stderr:  os.Stderr,
+		Logger:  logger,
+	}
+}
+
+// StandaloneRun parses the config from args and wires the gateway and the
+// delivery into a single process.
+func (cmd *StandaloneCommand) StandaloneRun(args ...string) error {
+	options, err := cmd.ParseFlags(args...)
+	if err != nil {
+		return err
+	}
+	logger := cmd.Logger
+	fmt.Print(logo)
+
+	// Set parallelism.
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	coreLog := logger.WithField("prefix", "core")
+	// Mark start-up in log.
+	coreLog.Infof("Standalone mailer starting, version %s, branch %s, commit %s",
+		cmd.Version, cmd.Branch, cmd.Commit)
+	coreLog.Infof("Go version %s, GOMAXPROCS set to %d", runtime.Version(), runtime.GOMAXPROCS(0))
+	runtime.SetBlockProfileRate(int(1 * time.Second))
+	config, err := cmd.ParseConfig(options.GetConfigPath())
+	if err != nil {
+		return fmt.Errorf("parse config: %s", err)
+	}
+	// Apply any environment variables on top of the parsed config
+	if err := config.ApplyEnvOverrides(cmd.Getenv); err != nil {
+		return fmt.Errorf("apply env config: %v", err)
+	}
+
+	// Validate the configuration.
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("%s. To generate a valid configuration file run `cloudive-mailer config > cloudive-mailer.generated.conf`", err)
+	}
+	level, err := log.ParseLevel(config.Meta.LogLevel)
+	if err != nil {
+		return err
+	}
+	logger.SetLevel(level)
+	flag.Parse()
+	if !config.HTTPD.Enabled {
+		coreLog.Warn("HTTP service is disabled, no mails will be accepted in standalone mode")
+	}
+	smtpService := smtp.NewService(config.SMTP)
+	smtpService.SetLogOutput(logger)
+	queueService, err := newQueueBackend(config.Standalone.Backend, config, logger)
+	if err != nil {
+		return err
+	}
+	workerService := worker.NewService(config.Worker, smtpService, queueService)
+	workerService.SetLogOutput(logger)
+	workerService.Templates = newTemplateStore(config)
+	queueService.Consume(workerService)
+	httpdService := httpd.NewService(*config.HTTPD)
+	httpdService.SetLogOutput(logger)
+	httpdService.Handler.Queue = queueService
+	httpdService.Handler.Templates = workerService.Templates
+	// gateway and workers share the same process, so state changes are
+	// recorded right away.
+	statusStore := newStatusStore(config, logger)
+	httpdService.Handler.Status = statusStore
+	workerService.Status = httpdService.Handler.Status
+	webhookService := newWebhooks(config, logger)
+	workerService.Webhooks = webhookService
+	blobStore := newBlobStore(config, logger)
+	if blobStore != nil {
+		httpdService.Handler.Blobs = blobStore
+		smtpService.Blobs = blobStore
+	}
+
+	// services are started in this order and stopped in reverse: mails are
+	// only consumed once smtp is ready, and httpd is closed first, so the
+	// workers finish their current deliveries while no more mails are
+	// accepted. Webhooks are stopped once the queue consumers reported their
+	// last events.
+	if blobStore != nil {
+		cmd.Services = append(cmd.Services, blobStore)
+	}
+	if statusService, ok := statusStore.(Service); ok {
+		cmd.Services = append(cmd.Services, statusService)
+	}
+	cmd.Services = append(cmd.Services, smtpService)
+	if webhookService != nil {
+		cmd.Services = append(cmd.Services, webhookService)
+	}
+	cmd.Services = append(cmd.Services, workerService)
+	cmd.Services = append(cmd.Services, queueService)
+	cmd.Services = append(cmd.Services, httpdService)
+	return nil
+}
+
+// StandaloneOpen opens all services
+func (cmd *StandaloneCommand) StandaloneOpen() error {
+	for _, service := range cmd.Services {
+		if err := service.Start(); err != nil {
+			log.Error(err.Error())
+			return fmt.Errorf("open service: %s", err)
+		}
+	}
+	return nil
+}
+
+// StandaloneClose shuts down the server.
+func (cmd *StandaloneCommand) StandaloneClose() error {
+	// Close services to allow any inflight requests to complete
+	// and prevent new requests from being accepted.
+	for i := len(cmd.Services) - 1; i >= 0; i-- {
+		cmd.Services[i].Stop()
+	}
+	defer close(cmd.Closed)
+	close(cmd.closing)
+	return nil
+}
+
+var standaloneUsage = `Runs the cloudive-mailer gateway and delivery in a single process.
+Usage: cloudive-mailer standalone [flags]
+    -config <path>
+            Set the path to the configuration file.
+            This defaults to the environment variable CLOUDIVE_CONFIG_PATH,
+            ~/.cloudive/mailer.conf, or /etc/cloudive/mailer.conf if a file
+            is present at any of these locations.
+            Disable the automatic loading of a configuration file using
+            the null device (such as /dev/null).
+`
+
+// ParseFlags parses the command line flags from args and returns an options set.
+func (cmd *StandaloneCommand) ParseFlags(args ...string) (Options, error) {
+	var options Options
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.StringVar(&options.ConfigPath, "config", "", "")
+	fs.StringVar(&options.Action, "s", "", "")
+	_ = fs.String("hostname", "", "")
+	fs.Usage = func() {
+		fmt.Fprintln(cmd.Stderr, standaloneUsage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return Options{}, err
+	}
+	return options, nil
+}
+
+// ParseConfig parses the config at path.
+// Returns a demo configuration if path is blank.
+func (cmd *StandaloneCommand) ParseConfig(path string) (*Config, error) {
+	// Use demo configuration if no config path is specified.
+	if path == "" {
+		cmd.Logger.WithField("prefix", "core").Println("no configuration provided, using default settings")
+		return NewDemoConfig()
+	}
+
+	cmd.Logger.WithField("prefix", "core").Printf("Using configuration at: %s\n", path)
+
+	config := NewConfig()
+	if err := config.FromTomlFile(path); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
@@ -9,8 +9,8 @@ import (
 	"time"
 
 	"github.com/nirnanaaa/cloudive-mailer/services/httpd"
-	"github.com/nirnanaaa/cloudive-mailer/services/kafka"
 	"github.com/nirnanaaa/cloudive-mailer/services/smtp"
+	"github.com/nirnanaaa/cloudive-mailer/services/worker"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 	prefixed "github.com/x-cray/logrus-prefixed-formatter"
@@ -95,16 +95,40 @@ func (cmd *WorkerCommand) WorkerRun(args ...string) error {
 	logger.SetLevel(level)
 	flag.Parse()
 	smtpService := smtp.NewService(config.SMTP)
-	kafkaService := kafka.NewService(config.Kafka)
-	kafkaService.SetLogOutput(logger, "[kafka]")
-	kafkaService.SetDefaultMessageProcessor(smtpService)
+	blobStore := newBlobStore(config, logger)
+	if blobStore != nil {
+		smtpService.Blobs = blobStore
+	}
+	queueService, err := newQueueBackend(config.Queue.Backend, config, logger)
+	if err != nil {
+		return err
+	}
+	workerService := worker.NewService(config.Worker, smtpService, queueService)
+	workerService.SetLogOutput(logger)
+	workerService.Templates = newTemplateStore(config)
+	workerService.Status = newStatusReporter(config, queueService, logger)
+	webhookService := newWebhooks(config, logger)
+	workerService.Webhooks = webhookService
+	queueService.Consume(workerService)
 	httpdService := httpd.NewService(*config.HTTPD)
 	httpdService.SetLogOutput(logger)
 	smtpService.SetLogOutput(logger)
 
-	cmd.Services = append(cmd.Services, httpdService)
-	cmd.Services = append(cmd.Services, kafkaService)
+	// services are started in this order and stopped in reverse: mails are
+	// only consumed once smtp is ready, and httpd is closed first, so the
+	// workers finish their current deliveries while no more mails are
+	// accepted. Webhooks are stopped once the queue consumers reported their
+	// last events.
+	if blobStore != nil {
+		cmd.Services = append(cmd.Services, blobStore)
+	}
 	cmd.Services = append(cmd.Services, smtpService)
+	if webhookService != nil {
+		cmd.Services = append(cmd.Services, webhookService)
+	}
+	cmd.Services = append(cmd.Services, workerService)
+	cmd.Services = append(cmd.Services, queueService)
+	cmd.Services = append(cmd.Services, httpdService)
 	return nil
 }
 
@@ -123,8 +147,8 @@ func (cmd *WorkerCommand) WorkerOpen() error {
 func (cmd *WorkerCommand) WorkerClose() error {
 	// Close services to allow any inflight requests to complete
 	// and prevent new requests from being accepted.
-	for _, service := range cmd.Services {
-		service.Stop()
+	for i := len(cmd.Services) - 1; i >= 0; i-- {
+		cmd.Services[i].Stop()
 	}
 	defer close(cmd.Closed)
 	close(cmd.closing)
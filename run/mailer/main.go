@@ -82,7 +82,9 @@ func (m *Main) Run(args ...string) error {
 		if err := cmd.Run(args...); err != nil {
 			return fmt.Errorf("run: %s", err)
 		}
-		cmd.Open()
+		if err := cmd.Open(); err != nil {
+			return fmt.Errorf("open: %s", err)
+		}
 		signalCh := make(chan os.Signal, 1)
 		signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
 		m.Logger.Println("Listening for signals")
@@ -121,7 +123,9 @@ func (m *Main) Run(args ...string) error {
 		if err := cmd.WorkerRun(args...); err != nil {
 			return fmt.Errorf("run: %s", err)
 		}
-		cmd.WorkerOpen()
+		if err := cmd.WorkerOpen(); err != nil {
+			return fmt.Errorf("open: %s", err)
+		}
 		signalCh := make(chan os.Signal, 1)
 		signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
 		m.Logger.Println("Listening for signals")
@@ -133,6 +137,42 @@ func (m *Main) Run(args ...string) error {
 			}()
 		}
 
+		// Block again until another signal is received, a shutdown timeout elapses,
+		// or the Command is gracefully closed
+		m.Logger.Println("Waiting for clean shutdown...")
+		select {
+		case <-signalCh:
+			m.Logger.Println("second signal received, initializing hard shutdown")
+		case <-time.After(time.Second * 30):
+			m.Logger.Println("time limit reached, initializing hard shutdown")
+		case <-cmd.Closed:
+			m.Logger.Println("server shutdown completed")
+		}
+	case "standalone":
+		cmd := run.StandaloneNewCommand()
+
+		// Tell the server the build details.
+		cmd.Version = version
+		cmd.Commit = commit
+		cmd.Branch = branch
+
+		if err := cmd.StandaloneRun(args...); err != nil {
+			return fmt.Errorf("run: %s", err)
+		}
+		if err := cmd.StandaloneOpen(); err != nil {
+			return fmt.Errorf("open: %s", err)
+		}
+		signalCh := make(chan os.Signal, 1)
+		signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
+		m.Logger.Println("Listening for signals")
+		select {
+		case <-signalCh:
+			m.Logger.Println("Signal received, initializing clean shutdown...")
+			go func() {
+				cmd.StandaloneClose()
+			}()
+		}
+
 		// Block again until another signal is received, a shutdown timeout elapses,
 		// or the Command is gracefully closed
 		m.Logger.Println("Waiting for clean shutdown...")
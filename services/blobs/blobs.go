@@ -0,0 +1,36 @@
+package blobs
+
+import (
+	"errors"
+	"io"
+	"regexp"
+)
+
+var (
+	// ErrNotFound is returned for unknown blobs.
+	ErrNotFound = errors.New("blob not found")
+
+	// ErrInvalidID is returned for IDs which can't belong to a blob.
+	ErrInvalidID = errors.New("invalid blob id")
+)
+
+var validID = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// ValidateID returns ErrInvalidID if id can't belong to a blob.
+func ValidateID(id string) error {
+	if !validID.MatchString(id) {
+		return ErrInvalidID
+	}
+	return nil
+}
+
+// Store stores uploaded files until the worker attaches them to a mail.
+type Store interface {
+	// Put stores the content of r and returns the ID of the new blob and
+	// its size.
+	Put(r io.Reader) (string, int64, error)
+	// Open returns the content of a blob.
+	Open(id string) (io.ReadCloser, error)
+	// Delete removes a blob.
+	Delete(id string) error
+}
@@ -0,0 +1,41 @@
+package blobs
+
+import (
+	"time"
+
+	itoml "github.com/influxdata/influxdb/toml"
+)
+
+const (
+	// DefaultEnabled enables or disables uploads
+	DefaultEnabled = false
+
+	// DefaultPath defines where uploads are stored
+	DefaultPath = "/var/lib/cloudive/blobs"
+
+	// DefaultRetention defines how long uploads are kept
+	DefaultRetention = 7 * 24 * time.Hour
+
+	// DefaultSweepInterval defines how often expired uploads are removed
+	DefaultSweepInterval = time.Hour
+)
+
+// Config represents a configuration for the blob store of uploads.
+type Config struct {
+	Enabled bool   `toml:"enabled"`
+	Path    string `toml:"path"`
+	// Retention defines how long uploads are kept, so they are still
+	// around for retries and dead letters which are re-queued.
+	Retention     itoml.Duration `toml:"retention"`
+	SweepInterval itoml.Duration `toml:"sweep-interval"`
+}
+
+// NewConfig returns a new Config with default settings.
+func NewConfig() *Config {
+	return &Config{
+		Enabled:       DefaultEnabled,
+		Path:          DefaultPath,
+		Retention:     itoml.Duration(DefaultRetention),
+		SweepInterval: itoml.Duration(DefaultSweepInterval),
+	}
+}
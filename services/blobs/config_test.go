@@ -0,0 +1,33 @@
+package blobs_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nirnanaaa/cloudive-mailer/services/blobs"
+)
+
+func TestConfig_Parse(t *testing.T) {
+	// Parse configuration.
+	c := blobs.NewConfig()
+	if _, err := toml.Decode(`
+		enabled = true
+		path = "/tmp/blobs"
+		retention = "48h"
+		sweep-interval = "10m"
+`, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	// Validate configuration.
+	if !c.Enabled {
+		t.Fatalf("unexpected Enabled, want true got false")
+	} else if c.Path != "/tmp/blobs" {
+		t.Fatalf("unexpected path: %s", c.Path)
+	} else if time.Duration(c.Retention) != 48*time.Hour {
+		t.Fatalf("unexpected retention: %s", time.Duration(c.Retention))
+	} else if time.Duration(c.SweepInterval) != 10*time.Minute {
+		t.Fatalf("unexpected sweep interval: %s", time.Duration(c.SweepInterval))
+	}
+}
@@ -0,0 +1,147 @@
+package blobs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// DiskStore stores every blob as a file in <path>/<id>. Blobs older than
+// the retention are removed periodically while the store is started. The
+// gateway and the workers need to share the directory.
+type DiskStore struct {
+	Logger *logrus.Entry
+	Config *Config
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewDiskStore returns a new instance of DiskStore.
+func NewDiskStore(c *Config) *DiskStore {
+	return &DiskStore{
+		Config:  c,
+		Logger:  logrus.New().WithField("prefix", "blobs"),
+		closing: make(chan struct{}),
+	}
+}
+
+// Put writes r into a new blob. The file only shows up once it is
+// completely written.
+func (s *DiskStore) Put(r io.Reader) (string, int64, error) {
+	if err := os.MkdirAll(s.Config.Path, 0700); err != nil {
+		return "", 0, err
+	}
+	f, err := ioutil.TempFile(s.Config.Path, ".tmp-")
+	if err != nil {
+		return "", 0, err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+	id := uuid.NewV4().String()
+	if err := os.Rename(f.Name(), s.file(id)); err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+	return id, n, nil
+}
+
+// Open returns the content of a blob.
+func (s *DiskStore) Open(id string) (io.ReadCloser, error) {
+	if err := ValidateID(id); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(s.file(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// Delete removes a blob.
+func (s *DiskStore) Delete(id string) error {
+	if err := ValidateID(id); err != nil {
+		return err
+	}
+	if err := os.Remove(s.file(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *DiskStore) file(id string) string {
+	return filepath.Join(s.Config.Path, id)
+}
+
+// Start starts removing expired blobs.
+func (s *DiskStore) Start() error {
+	if err := os.MkdirAll(s.Config.Path, 0700); err != nil {
+		return err
+	}
+	s.wg.Add(1)
+	go s.sweepLoop()
+	return nil
+}
+
+// Stop stops removing expired blobs.
+func (s *DiskStore) Stop() error {
+	close(s.closing)
+	s.wg.Wait()
+	return nil
+}
+
+func (s *DiskStore) sweepLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(time.Duration(s.Config.SweepInterval))
+	defer ticker.Stop()
+	for {
+		if err := s.Sweep(time.Now()); err != nil {
+			s.Logger.WithError(err).Error("Removing expired blobs failed")
+		}
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep removes all blobs which were stored longer than the retention ago,
+// including temporary files of interrupted uploads.
+func (s *DiskStore) Sweep(now time.Time) error {
+	files, err := ioutil.ReadDir(s.Config.Path)
+	if err != nil {
+		return err
+	}
+	expired := now.Add(-time.Duration(s.Config.Retention))
+	for _, fi := range files {
+		if fi.ModTime().After(expired) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.Config.Path, fi.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetLogOutput sets the writer to which all logs are written. It must not be
+// called after Open is called.
+func (s *DiskStore) SetLogOutput(log *logrus.Logger) {
+	s.Logger = log.WithField("prefix", "blobs")
+}
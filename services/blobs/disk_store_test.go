@@ -0,0 +1,78 @@
+package blobs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/blobs"
+)
+
+func NewTestStore(t *testing.T) *blobs.DiskStore {
+	dir, err := ioutil.TempDir("", "cloudive-blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := blobs.NewConfig()
+	c.Path = dir
+	return blobs.NewDiskStore(c)
+}
+
+func TestDiskStore(t *testing.T) {
+	store := NewTestStore(t)
+	defer os.RemoveAll(store.Config.Path)
+
+	id, size, err := store.Put(strings.NewReader("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	} else if size != 11 {
+		t.Fatalf("unexpected size: %d", size)
+	} else if err := blobs.ValidateID(id); err != nil {
+		t.Fatalf("unexpected id: %s", id)
+	}
+	r, err := store.Open(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	} else if string(data) != "hello world" {
+		t.Fatalf("unexpected content: %q", data)
+	}
+
+	if err := store.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Open(id); err != blobs.ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := store.Open("../../etc/passwd"); err != blobs.ErrInvalidID {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestDiskStore_Sweep(t *testing.T) {
+	store := NewTestStore(t)
+	defer os.RemoveAll(store.Config.Path)
+
+	id, _, err := store.Put(strings.NewReader("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Sweep(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Open(id); err != nil {
+		t.Fatalf("blob removed before its retention: %v", err)
+	}
+	if err := store.Sweep(time.Now().Add(time.Duration(store.Config.Retention) + time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Open(id); err != blobs.ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
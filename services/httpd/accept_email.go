@@ -1,23 +1,249 @@
 package httpd
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
+	"io/ioutil"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/nirnanaaa/cloudive-mailer/services/kafka/event"
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
+	"github.com/nirnanaaa/cloudive-mailer/services/status"
+	uuid "github.com/satori/go.uuid"
 )
 
+// acceptedMail is the result of a queued mail.
+type acceptedMail struct {
+	ID string `json:"id"`
+}
+
+// mailResult is the outcome of a single mail of a request.
+type mailResult struct {
+	ID       string       `json:"id,omitempty"`
+	Status   int          `json:"status"`
+	Error    string       `json:"error,omitempty"`
+	Fields   []FieldError `json:"fields,omitempty"`
+	Replayed bool         `json:"replayed,omitempty"`
+
+	retryAfter time.Duration
+}
+
+// pendingMail is a mail which passed all checks and is ready to be queued.
+type pendingMail struct {
+	msg    *event.InboundEmailEvent
+	queued *queue.Message
+	// key is the scoped idempotency key the mail is registered with, and
+	// idempotent the message ID derived from it.
+	key        string
+	idempotent string
+	// quotas are the quota periods the mail has been counted in.
+	quotas []string
+	result *mailResult
+}
+
+// mailRequest is a single mail of a request.
+type mailRequest struct {
+	// body is the JSON of the mail.
+	body []byte
+	// key is the idempotency key of the mail.
+	key string
+	// uploads are attached to the mail once it has been validated.
+	uploads []event.Attachment
+	// fingerprint identifies the content of the uploads, so only requests
+	// with the same files are answered with the first response.
+	fingerprint []byte
+}
+
 func (h *Handler) acceptInboundEmail(w http.ResponseWriter, r *http.Request) {
-	decoder := json.NewDecoder(r.Body)
+	accepted := time.Now().UTC()
+	var req *mailRequest
+	if isMultipart(r) {
+		var code int
+		var errCode string
+		if req, code, errCode = h.readMultipart(w, r); errCode != "" {
+			h.httpError(w, errCode, code)
+			return
+		}
+	} else {
+		body, code, errCode := h.readBody(w, r)
+		if errCode != "" {
+			h.httpError(w, errCode, code)
+			return
+		}
+		req = &mailRequest{body: body}
+	}
+	req.key = r.Header.Get(HeaderIdempotencyKey)
+	m := h.prepareMail(r, identityFrom(r.Context()), req, accepted)
+	h.publishMails(accepted, m)
+	// uploads of rejected and repeated mails are never sent
+	if m.result.Status != http.StatusAccepted || m.result.Replayed {
+		h.deleteUploads(req.uploads)
+	}
+	h.writeMailResult(w, m.result)
+}
+
+// readBody reads the JSON body of r up to the maximum request size. On
+// failure, the status code and the error code are returned.
+func (h *Handler) readBody(w http.ResponseWriter, r *http.Request) ([]byte, int, string) {
+	if h.Config.MaxRequestSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, h.Config.MaxRequestSize)
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if tooLarge(err) {
+		return nil, http.StatusRequestEntityTooLarge, "err.global.payload_too_large"
+	} else if err != nil {
+		return nil, http.StatusBadRequest, "err.global.invalid_payload"
+	}
+	return body, 0, ""
+}
 
+// writeMailResult answers a request for a single mail.
+func (h *Handler) writeMailResult(w http.ResponseWriter, res *mailResult) {
+	if res.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(res.retryAfter.Seconds())))))
+	}
+	switch {
+	case len(res.Fields) > 0:
+		h.validationError(w, res.Fields)
+	case res.Error != "":
+		h.httpError(w, res.Error, res.Status)
+	default:
+		if res.Replayed {
+			w.Header().Set(HeaderIdempotentReplayed, "true")
+		}
+		h.writeResults(w, res.Status, acceptedMail{ID: res.ID})
+	}
+}
+
+// prepareMail decodes, validates, authorizes and rate limits the mail of
+// req and turns it into a queue message. Mails sent with an idempotency
+// key get an ID derived from it. Repeated mails are answered with the
+// result of the first one while the key is remembered.
+func (h *Handler) prepareMail(r *http.Request, caller *Identity, req *mailRequest, now time.Time) *pendingMail {
+	body, key := req.body, req.key
+	m := &pendingMail{result: &mailResult{}}
+	reject := func(status int, code string) *pendingMail {
+		m.result.Status, m.result.Error = status, code
+		return m
+	}
 	var msg event.InboundEmailEvent
-	if err := decoder.Decode(&msg); err != nil {
-		h.httpError(w, "err.global.invalid_payload", http.StatusBadRequest)
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return reject(http.StatusBadRequest, "err.global.invalid_payload")
+	}
+	if errs := h.validateMail(body, &msg); len(errs) > 0 {
+		m.result.Fields = errs
+		return reject(http.StatusUnprocessableEntity, "err.global.validation_failed")
+	}
+	msg.Attachments = append(msg.Attachments, req.uploads...)
+	if caller != nil {
+		if code := authorize(caller, &msg); code != "" {
+			return reject(http.StatusForbidden, code)
+		}
+		msg.Tenant = caller.Name
+	}
+	if key != "" {
+		content := append(append([]byte{}, body...), req.fingerprint...)
+		if len(key) > MaxIdempotencyKeyLength {
+			return reject(http.StatusBadRequest, "err.global.invalid_idempotency_key")
+		}
+		m.idempotent = idempotentID(caller, key, content)
+		if h.requests != nil {
+			m.key = scopedKey(caller, key)
+			if first, found := h.requests.begin(m.key, m.idempotent, content, now); found {
+				switch {
+				case first.hash != sha256.Sum256(content):
+					return reject(http.StatusConflict, "err.global.idempotency_key_reused")
+				case !first.done:
+					return reject(http.StatusConflict, "err.global.idempotency_key_in_use")
+				}
+				m.result = &mailResult{ID: first.id, Status: http.StatusAccepted, Replayed: true}
+				return m
+			}
+		}
+	}
+	code, wait, quotas := h.limit(r, caller, &msg)
+	if code != "" {
+		h.finishIdempotent(m.key, false)
+		m.result.retryAfter = wait
+		return reject(http.StatusTooManyRequests, code)
+	}
+	queued, err := h.queueMessage(&msg, caller, m.idempotent)
+	if err != nil {
+		h.finishIdempotent(m.key, false)
+		h.refund(quotas)
+		return reject(http.StatusBadRequest, "err.global.invalid_payload")
+	}
+	m.quotas = quotas
+	m.msg, m.queued = &msg, queued
+	return m
+}
+
+// publishMails queues all prepared mails at once and records their results.
+// Once it returns, the queued mails are stored by the queue backend.
+func (h *Handler) publishMails(accepted time.Time, mails ...*pendingMail) {
+	var pending []*pendingMail
+	var msgs []*queue.Message
+	for _, m := range mails {
+		if m.queued != nil {
+			pending = append(pending, m)
+			msgs = append(msgs, m.queued)
+		}
+	}
+	if len(msgs) == 0 {
 		return
 	}
-	h.Kafka.QueueMail(&msg)
-	w.WriteHeader(http.StatusNoContent)
+	errs := queue.PublishBatch(h.Queue, msgs)
+	for i, m := range pending {
+		h.finishIdempotent(m.key, errs[i] == nil)
+		if errs[i] != nil {
+			h.Logger.WithError(errs[i]).Errorf("Queueing email with Trace ID %s failed", m.msg.TraceID)
+			h.refund(m.quotas)
+			m.result.Status, m.result.Error = http.StatusServiceUnavailable, "err.global.queue_unavailable"
+			continue
+		}
+		// the worker might already report its first attempt, so queued
+		// mustn't be recorded later than the time the mail was accepted.
+		h.reportStatus(&status.Event{ID: m.queued.Key, State: status.StateAccepted, At: accepted, TraceID: m.msg.TraceID})
+		h.reportStatus(&status.Event{ID: m.queued.Key, State: status.StateQueued, At: accepted})
+		m.result.ID, m.result.Status = m.queued.Key, http.StatusAccepted
+	}
+}
+
+// finishIdempotent records the outcome of the first request for key.
+func (h *Handler) finishIdempotent(key string, ok bool) {
+	if h.requests != nil && key != "" {
+		h.requests.finish(key, ok)
+	}
+}
+
+// queueMessage encodes a mail into a queue message. The name of the caller
+// who sent the mail travels along with it. Without an id, a random one is
+// used.
+func (h *Handler) queueMessage(msg *event.InboundEmailEvent, caller *Identity, id string) (*queue.Message, error) {
+	h.Logger.Debugf("Queueing email with Trace ID %s", msg.TraceID)
+	encoded, err := event.EncodeOutgoingEvent(msg)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		id = uuid.NewV4().String()
+	}
+	queued := &queue.Message{
+		Key:   id,
+		Value: encoded,
+	}
+	// mails to the same domain are delivered by the same worker
+	if domain := msg.RecipientDomain(); domain != "" {
+		queued.SetHeader(queue.HeaderPartitionKey, domain)
+	}
+	if caller != nil {
+		queued.SetHeader(queue.HeaderAPIKey, caller.Name)
+	}
+	return queued, nil
 }
 
 func (h *Handler) httpError(w http.ResponseWriter, error string, code int) {
@@ -0,0 +1,223 @@
+package httpd
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nirnanaaa/cloudive-mailer/services/kafka/event"
+)
+
+// HeaderAPIKey is the request header carrying a static API key.
+const HeaderAPIKey = "X-API-Key"
+
+// publicRoutes are served without authentication, so health checks and
+// metric scrapers don't need a key.
+var publicRoutes = map[string]bool{
+	"health-check": true,
+	"ping-head":    true,
+	"metrics":      true,
+}
+
+// APIKey grants access to the API. A key is accepted unless it is disabled
+// with enabled = false. Senders restricts the sender addresses a key may
+// send mails as, an entry is either a complete address or a domain. A key
+// without senders may send as anyone.
+type APIKey struct {
+	Name    string   `toml:"name"`
+	Key     string   `toml:"key"`
+	Senders []string `toml:"senders"`
+	Enabled *bool    `toml:"enabled"`
+}
+
+// active returns false if the key has been disabled.
+func (k *APIKey) active() bool {
+	return k.Enabled == nil || *k.Enabled
+}
+
+// identity returns the restrictions of requests authenticated with the key.
+func (k *APIKey) identity() *Identity {
+	return &Identity{Name: k.Name, Method: UserAuthentication, Senders: k.Senders}
+}
+
+// Identity is an authenticated caller and the restrictions it is subject
+// to. Empty restrictions allow everything.
+type Identity struct {
+	Name   string
+	Method AuthenticationMethod
+	// Senders are addresses or domains the caller may send mails as.
+	Senders []string
+	// RecipientDomains are the domains the caller may send mails to.
+	RecipientDomains []string
+	// Templates are the ids of the templates the caller may use.
+	Templates []string
+}
+
+// AllowsSender returns true if the caller may send mails from address.
+func (i *Identity) AllowsSender(address string) bool {
+	return len(i.Senders) == 0 || matchAddress(i.Senders, address)
+}
+
+// AllowsRecipient returns true if the caller may send mails to address.
+func (i *Identity) AllowsRecipient(address string) bool {
+	return len(i.RecipientDomains) == 0 || matchAddress(i.RecipientDomains, address)
+}
+
+// AllowsTemplate returns true if the caller may use the template id.
+func (i *Identity) AllowsTemplate(id string) bool {
+	if len(i.Templates) == 0 {
+		return true
+	}
+	for _, t := range i.Templates {
+		if t == id {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAddress returns true if address is one of the addresses in list or
+// belongs to one of its domains.
+func matchAddress(list []string, address string) bool {
+	address = strings.ToLower(strings.TrimSpace(address))
+	domain := address[strings.LastIndex(address, "@")+1:]
+	for _, s := range list {
+		s = strings.ToLower(s)
+		if strings.Contains(s, "@") {
+			if s == address {
+				return true
+			}
+		} else if s == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadKeyFile reads the [[key]] entries of a TOML key file.
+func LoadKeyFile(path string) ([]APIKey, error) {
+	var f struct {
+		Keys []APIKey `toml:"key"`
+	}
+	if _, err := toml.DecodeFile(path, &f); err != nil {
+		return nil, err
+	}
+	return f.Keys, nil
+}
+
+// LoadKeys replaces the keys of the handler by the configured keys and the
+// keys of the configured key file and loads the JWKS file.
+func (h *Handler) LoadKeys() error {
+	keys := append([]APIKey{}, h.Config.Keys...)
+	if h.Config.KeyFile != "" {
+		fileKeys, err := LoadKeyFile(h.Config.KeyFile)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, fileKeys...)
+	}
+	if err := validateKeys(keys); err != nil {
+		return err
+	}
+	h.Keys = keys
+	if h.jwt != nil {
+		return h.jwt.Load()
+	}
+	return nil
+}
+
+type contextKey int
+
+const identityContextKey contextKey = iota
+
+// identityFrom returns the caller a request was authenticated as, nil if
+// authentication is disabled.
+func identityFrom(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityContextKey).(*Identity)
+	return id
+}
+
+// credentials returns the secret passed with a request and how it was passed.
+func credentials(r *http.Request) (AuthenticationMethod, string, bool) {
+	if key := r.Header.Get(HeaderAPIKey); key != "" {
+		return UserAuthentication, key, true
+	}
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return BearerAuthentication, strings.TrimSpace(auth[7:]), true
+	}
+	return UserAuthentication, "", false
+}
+
+// lookupKey returns the key matching secret. All keys are compared in
+// constant time, so the response time doesn't leak how much of a secret
+// matched.
+func (h *Handler) lookupKey(secret string) *APIKey {
+	var found *APIKey
+	for i := range h.Keys {
+		if subtle.ConstantTimeCompare([]byte(h.Keys[i].Key), []byte(secret)) == 1 {
+			found = &h.Keys[i]
+		}
+	}
+	return found
+}
+
+// authenticate rejects requests without a valid and enabled key or token
+// and passes the caller on to fn through the request context.
+func (h *Handler) authenticate(fn func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.Config.AuthEnabled {
+			fn(w, r)
+			return
+		}
+		method, secret, ok := credentials(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="cloudive-mailer"`)
+			h.httpError(w, "err.global.unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if method == BearerAuthentication && h.jwt != nil && isJWT(secret) {
+			id, err := h.jwt.Validate(secret, time.Now())
+			if err != nil {
+				h.Logger.WithError(err).Debugf("Rejecting token from %s", r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="cloudive-mailer", error="invalid_token"`)
+				h.httpError(w, "err.global.invalid_token", http.StatusUnauthorized)
+				return
+			}
+			fn(w, r.WithContext(context.WithValue(r.Context(), identityContextKey, id)))
+			return
+		}
+		key := h.lookupKey(secret)
+		if key == nil {
+			h.Logger.WithField("method", method).Debugf("Rejecting unknown key from %s", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="cloudive-mailer", error="invalid_token"`)
+			h.httpError(w, "err.global.invalid_credentials", http.StatusUnauthorized)
+			return
+		}
+		if !key.active() {
+			h.httpError(w, "err.global.key_disabled", http.StatusForbidden)
+			return
+		}
+		fn(w, r.WithContext(context.WithValue(r.Context(), identityContextKey, key.identity())))
+	}
+}
+
+// authorize returns the error code of the first restriction of id the mail
+// violates, an empty string if it may be sent.
+func authorize(id *Identity, msg *event.InboundEmailEvent) string {
+	if !id.AllowsSender(msg.Sender.Email) {
+		return "err.global.sender_not_allowed"
+	}
+	for _, rcpt := range msg.EnvelopeRecipients() {
+		if !id.AllowsRecipient(rcpt) {
+			return "err.global.recipient_not_allowed"
+		}
+	}
+	if msg.TemplateID != "" && !id.AllowsTemplate(msg.TemplateID) {
+		return "err.global.template_not_allowed"
+	}
+	return ""
+}
@@ -0,0 +1,135 @@
+package httpd_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/httpd"
+	"github.com/nirnanaaa/cloudive-mailer/services/kafka/event"
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
+)
+
+func authenticatedHandler(q queue.Publisher) *httpd.Handler {
+	c := httpd.NewConfig()
+	c.AuthEnabled = true
+	disabled := false
+	c.Keys = []httpd.APIKey{
+		{Name: "shop", Key: "shop-secret", Senders: []string{"shop.example.com", "billing@example.com"}},
+		{Name: "old", Key: "old-secret", Enabled: &disabled},
+	}
+	h := httpd.NewHandler(*c)
+	h.Queue = q
+	return h
+}
+
+func serveWithHeader(h *httpd.Handler, body, header, value string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := MustNewRequest("POST", "/mail", strings.NewReader(body))
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestHandler_Authentication(t *testing.T) {
+	q := queue.NewMemoryQueue(queue.NewConfig())
+	h := authenticatedHandler(q)
+	body := `{"sender":{"email":"news@shop.example.com"},"recipient":{"email":"someguy@somedomain.com"},"subject":"test"}`
+
+	for _, tt := range []struct {
+		header, value string
+		code          int
+		err           string
+	}{
+		{"", "", http.StatusUnauthorized, "err.global.unauthorized"},
+		{"X-API-Key", "wrong", http.StatusUnauthorized, "err.global.invalid_credentials"},
+		{"Authorization", "Bearer old-secret", http.StatusForbidden, "err.global.key_disabled"},
+		{"X-API-Key", "shop-secret", http.StatusAccepted, ""},
+		{"Authorization", "Bearer shop-secret", http.StatusAccepted, ""},
+	} {
+		w := serveWithHeader(h, body, tt.header, tt.value)
+		if w.Code != tt.code {
+			t.Fatalf("%s %q: unexpected status: %d", tt.header, tt.value, w.Code)
+		} else if !strings.Contains(w.Body.String(), tt.err) {
+			t.Fatalf("%s %q: unexpected body: %s", tt.header, tt.value, w.Body.String())
+		}
+	}
+	if w := serve(h, "GET", "/healthz", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("health check requires authentication: %d", w.Code)
+	}
+	if q.Len() != 2 {
+		t.Fatalf("unexpected queue length: %d", q.Len())
+	}
+}
+
+func TestHandler_AuthenticationSenders(t *testing.T) {
+	q := queue.NewMemoryQueue(queue.NewConfig())
+	h := authenticatedHandler(q)
+	for sender, code := range map[string]int{
+		"news@shop.example.com": http.StatusAccepted,
+		"billing@example.com":   http.StatusAccepted,
+		"admin@example.com":     http.StatusForbidden,
+		"":                      http.StatusUnprocessableEntity,
+	} {
+		body := `{"sender":{"email":"` + sender + `"},"recipient":{"email":"someguy@somedomain.com"},"subject":"test","tenant":"other"}`
+		if w := serveWithHeader(h, body, "X-API-Key", "shop-secret"); w.Code != code {
+			t.Fatalf("%q: unexpected status: %d: %s", sender, w.Code, w.Body.String())
+		}
+	}
+	if q.Len() != 2 {
+		t.Fatalf("unexpected queue length: %d", q.Len())
+	}
+	names := make(chan string, 2)
+	q.Consume(queue.HandlerFunc(func(msg *queue.Message) error {
+		evt, err := event.DecodeIncomingEvent(msg.Value)
+		if err != nil {
+			return err
+		}
+		// the tenant is always the authenticated caller
+		names <- msg.Header(queue.HeaderAPIKey) + "/" + evt.Tenant
+		return nil
+	}))
+	if err := q.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Stop()
+	for i := 0; i < 2; i++ {
+		if name := <-names; name != "shop/shop" {
+			t.Fatalf("unexpected key header: %q", name)
+		}
+	}
+}
+
+func TestHandler_LoadKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudive-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.toml")
+	if err := ioutil.WriteFile(path, []byte(`
+[[key]]
+name = "file"
+key = "file-secret"
+enabled = true
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := httpd.NewConfig()
+	c.AuthEnabled = true
+	c.KeyFile = path
+	h := httpd.NewHandler(*c)
+	h.Queue = queue.NewMemoryQueue(queue.NewConfig())
+	if err := h.LoadKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if w := serveWithHeader(h, `{"sender":{"email":"someguy@somedomain.com"},"recipient":{"email":"someguy@somedomain.com"},"subject":"test"}`, "X-API-Key", "file-secret"); w.Code != http.StatusAccepted {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+}
@@ -0,0 +1,155 @@
+package httpd
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/kafka/event"
+)
+
+// mailBatch is either a list of complete mails or a single mail, which is
+// sent to every recipient of a list with the recipient's data.
+type mailBatch struct {
+	Mails      []json.RawMessage `json:"mails"`
+	Template   json.RawMessage   `json:"template"`
+	Recipients []batchRecipient  `json:"recipients"`
+}
+
+// batchRecipient is a recipient of a templated batch. Data is merged into
+// the data of the template, TraceID replaces its trace ID.
+type batchRecipient struct {
+	Recipient event.Contact          `json:"recipient"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	TraceID   string                 `json:"trace_id,omitempty"`
+}
+
+// acceptBatch queues a batch of mails. Every mail is checked on its own
+// and the result of every mail is returned in the order of the batch, so
+// invalid mails don't reject the whole batch. The valid mails are queued
+// at once.
+func (h *Handler) acceptBatch(w http.ResponseWriter, r *http.Request) {
+	accepted := time.Now().UTC()
+	body, code, errCode := h.readBody(w, r)
+	if errCode != "" {
+		h.httpError(w, errCode, code)
+		return
+	}
+	var batch mailBatch
+	if err := json.Unmarshal(body, &batch); err != nil {
+		h.httpError(w, "err.global.invalid_payload", http.StatusBadRequest)
+		return
+	}
+	if errs := h.validateBatch(body, &batch); len(errs) > 0 {
+		h.validationError(w, errs)
+		return
+	}
+	mails, err := batch.expand()
+	if err != nil {
+		h.httpError(w, "err.global.invalid_payload", http.StatusBadRequest)
+		return
+	}
+
+	caller := identityFrom(r.Context())
+	key := r.Header.Get(HeaderIdempotencyKey)
+	pending := make([]*pendingMail, len(mails))
+	for i, mail := range mails {
+		// every mail of the batch gets its own idempotency key
+		itemKey := ""
+		if key != "" {
+			itemKey = key + "#" + strconv.Itoa(i)
+		}
+		pending[i] = h.prepareMail(r, caller, &mailRequest{body: mail, key: itemKey}, accepted)
+	}
+	h.publishMails(accepted, pending...)
+
+	code = http.StatusAccepted
+	results := make([]interface{}, len(pending))
+	for i, m := range pending {
+		if m.result.Status != http.StatusAccepted {
+			code = http.StatusMultiStatus
+		}
+		results[i] = m.result
+	}
+	h.writeResults(w, code, results...)
+}
+
+// validateBatch returns the errors of the batch itself, the mails are
+// validated one by one.
+func (h *Handler) validateBatch(body []byte, batch *mailBatch) []FieldError {
+	errs := unknownFields(body, reflect.TypeOf(*batch), "")
+	add := func(field, code string) {
+		errs = append(errs, FieldError{Field: field, Error: code})
+	}
+	if len(batch.Template) > 0 {
+		errs = append(errs, unknownFields(batch.Template, reflect.TypeOf(event.InboundEmailEvent{}), "template")...)
+		if len(batch.Mails) > 0 {
+			add("mails", ErrFieldInvalidValue)
+		}
+		if len(batch.Recipients) == 0 {
+			add("recipients", ErrFieldRequired)
+		}
+		// the mail of every recipient would be copied to these recipients, so
+		// they would get it once per recipient of the batch
+		var template event.InboundEmailEvent
+		if err := json.Unmarshal(batch.Template, &template); err == nil {
+			if len(template.To) > 0 {
+				add("template.to", ErrFieldInvalidValue)
+			}
+			if len(template.Cc) > 0 {
+				add("template.cc", ErrFieldInvalidValue)
+			}
+			if len(template.Bcc) > 0 {
+				add("template.bcc", ErrFieldInvalidValue)
+			}
+		}
+	} else if len(batch.Mails) == 0 {
+		add("mails", ErrFieldRequired)
+	}
+	if max := h.Config.MaxBatchSize; max > 0 {
+		if len(batch.Mails) > max {
+			add("mails", ErrFieldTooLarge)
+		}
+		if len(batch.Recipients) > max {
+			add("recipients", ErrFieldTooLarge)
+		}
+	}
+	return errs
+}
+
+// expand returns the JSON of every mail of the batch.
+func (b *mailBatch) expand() ([][]byte, error) {
+	if len(b.Template) == 0 {
+		mails := make([][]byte, len(b.Mails))
+		for i := range b.Mails {
+			mails[i] = b.Mails[i]
+		}
+		return mails, nil
+	}
+	mails := make([][]byte, len(b.Recipients))
+	for i, rcpt := range b.Recipients {
+		// the template is decoded for every recipient, so they don't share data
+		var msg event.InboundEmailEvent
+		if err := json.Unmarshal(b.Template, &msg); err != nil {
+			return nil, err
+		}
+		msg.Recipient = rcpt.Recipient
+		if rcpt.TraceID != "" {
+			msg.TraceID = rcpt.TraceID
+		}
+		if len(rcpt.Data) > 0 && msg.Data == nil {
+			msg.Data = make(map[string]interface{}, len(rcpt.Data))
+		}
+		for k, v := range rcpt.Data {
+			msg.Data[k] = v
+		}
+		mail, err := json.Marshal(&msg)
+		if err != nil {
+			return nil, err
+		}
+		mails[i] = mail
+	}
+	return mails, nil
+}
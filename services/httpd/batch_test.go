@@ -0,0 +1,129 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/httpd"
+	"github.com/nirnanaaa/cloudive-mailer/services/kafka/event"
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
+)
+
+type batchResponse struct {
+	Results []struct {
+		ID     string             `json:"id"`
+		Status int                `json:"status"`
+		Error  string             `json:"error"`
+		Fields []httpd.FieldError `json:"fields"`
+	} `json:"results"`
+	Error string `json:"error"`
+}
+
+func TestHandler_MailBatch(t *testing.T) {
+	q := queue.NewMemoryQueue(queue.NewConfig())
+	h := httpd.NewHandler(*httpd.NewConfig())
+	h.Queue = q
+
+	w := serve(h, "POST", "/mail/batch", `{"mails":[
+		{"sender":{"email":"someguy@somedomain.com"},"recipient":{"email":"one@example.com"},"subject":"one"},
+		{"sender":{"email":"someguy@somedomain.com"},"recipient":{"email":"invalid"},"subject":"two"},
+		{"sender":{"email":"someguy@somedomain.com"},"recipient":{"email":"three@example.com"},"subject":"three"}
+	]}`)
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("unexpected status: %d: %s", w.Code, w.Body.String())
+	}
+	var resp batchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != 3 {
+		t.Fatalf("unexpected results: %s", w.Body.String())
+	}
+	if r := resp.Results[0]; r.Status != http.StatusAccepted || r.ID == "" {
+		t.Fatalf("unexpected first result: %+v", r)
+	}
+	if r := resp.Results[1]; r.Status != http.StatusUnprocessableEntity || r.Error != "err.global.validation_failed" ||
+		len(r.Fields) != 1 || r.Fields[0].Field != "recipient.email" {
+		t.Fatalf("unexpected second result: %+v", r)
+	}
+	if r := resp.Results[2]; r.Status != http.StatusAccepted || r.ID == "" || r.ID == resp.Results[0].ID {
+		t.Fatalf("unexpected third result: %+v", r)
+	}
+	if q.Len() != 2 {
+		t.Fatalf("unexpected queue length: %d", q.Len())
+	}
+}
+
+func TestHandler_MailBatchTemplate(t *testing.T) {
+	q := queue.NewMemoryQueue(queue.NewConfig())
+	h := httpd.NewHandler(*httpd.NewConfig())
+	h.Queue = q
+
+	w := serve(h, "POST", "/mail/batch", `{
+		"template":{"sender":{"email":"news@example.com"},"template_id":"newsletter","data":{"issue":7,"name":"reader"}},
+		"recipients":[
+			{"recipient":{"email":"one@example.com"},"data":{"name":"One"}},
+			{"recipient":{"email":"two@example.com"},"trace_id":"two"}
+		]
+	}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("unexpected status: %d: %s", w.Code, w.Body.String())
+	}
+	if q.Len() != 2 {
+		t.Fatalf("unexpected queue length: %d", q.Len())
+	}
+	names := make(chan interface{}, 2)
+	q.Consume(queue.HandlerFunc(func(msg *queue.Message) error {
+		evt, err := event.DecodeIncomingEvent(msg.Value)
+		if err != nil {
+			return err
+		}
+		if evt.TemplateID != "newsletter" || evt.Data["issue"] != float64(7) {
+			t.Errorf("unexpected mail: %+v", evt)
+		}
+		names <- evt.Recipient.Email + ":" + evt.Data["name"].(string)
+		return nil
+	}))
+	if err := q.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Stop()
+	got := map[interface{}]bool{<-names: true, <-names: true}
+	if !got["one@example.com:One"] || !got["two@example.com:reader"] {
+		t.Fatalf("unexpected recipients: %v", got)
+	}
+}
+
+func TestHandler_MailBatchInvalid(t *testing.T) {
+	c := httpd.NewConfig()
+	c.MaxBatchSize = 1
+	h := httpd.NewHandler(*c)
+	h.Queue = queue.NewMemoryQueue(queue.NewConfig())
+	for name, body := range map[string]string{
+		"empty":          `{}`,
+		"unknown fields": `{"mails":[{}],"priority":1}`,
+		"too large":      `{"mails":[{},{}]}`,
+		"both":           `{"mails":[{}],"template":{},"recipients":[{}]}`,
+		"template field": `{"template":{"subjekt":"x"},"recipients":[{}]}`,
+		"template cc":    `{"template":{"cc":[{"email":"boss@example.com"}]},"recipients":[{}]}`,
+	} {
+		if w := serve(h, "POST", "/mail/batch", body); w.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("%s: unexpected status: %d: %s", name, w.Code, w.Body.String())
+		}
+	}
+
+	// copies would be sent once per recipient of the batch
+	w := serve(h, "POST", "/mail/batch", `{"template":{"to":[{"email":"a@example.com"}],"bcc":[{"email":"b@example.com"}]},"recipients":[{}]}`)
+	if !strings.Contains(w.Body.String(), `"template.to"`) || !strings.Contains(w.Body.String(), `"template.bcc"`) {
+		t.Fatalf("unexpected response: %s", w.Body.String())
+	}
+
+	c.MaxRequestSize = 64
+	h = httpd.NewHandler(*c)
+	h.Queue = queue.NewMemoryQueue(queue.NewConfig())
+	if w := serve(h, "POST", "/mail/batch", `{"mails":[{"subject":"`+strings.Repeat("x", 64)+`"}]}`); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+}
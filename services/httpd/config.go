@@ -1,23 +1,229 @@
 package httpd
 
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	itoml "github.com/influxdata/influxdb/toml"
+)
+
 const (
 	// DefaultBindAddress defines a bind address for the http service
 	DefaultBindAddress = "127.0.0.1:9009"
 
 	// DefaultEnabled enables or disables the HTTP service
 	DefaultEnabled = false
+
+	// DefaultAuthEnabled enables or disables the authentication of requests
+	DefaultAuthEnabled = false
+
+	// DefaultJWKSReloadInterval defines how often the JWKS file is checked
+	// for changes.
+	DefaultJWKSReloadInterval = time.Minute
+
+	// DefaultMaxSubjectLength defines the maximum number of characters of
+	// a subject, the maximum line length of RFC 5322
+	DefaultMaxSubjectLength = 998
+
+	// DefaultMaxBodySize defines the maximum size of the bodies of a mail
+	DefaultMaxBodySize = 10 * 1024 * 1024
+
+	// DefaultMaxRequestSize defines the maximum size of a JSON request,
+	// leaving room for escaped bodies of DefaultMaxBodySize
+	DefaultMaxRequestSize = 32 * 1024 * 1024
+
+	// DefaultMaxUploadSize defines the maximum size of a multipart request
+	// with uploads
+	DefaultMaxUploadSize = 25 * 1024 * 1024
+
+	// DefaultMaxBatchSize defines the maximum number of mails of a batch
+	DefaultMaxBatchSize = 1000
+
+	// DefaultIdempotencyWindow defines how long idempotency keys are
+	// remembered
+	DefaultIdempotencyWindow = 24 * time.Hour
+
+	// DefaultLimitBackend defines where rate limit counters are kept
+	DefaultLimitBackend = "memory"
+
+	// DefaultRedisAddress defines the address of the shared Redis backend
+	DefaultRedisAddress = "127.0.0.1:6379"
+
+	// DefaultRedisKeyPrefix is prepended to all keys stored in Redis
+	DefaultRedisKeyPrefix = "cloudive-mailer:"
+
+	// DefaultJWTLeeway defines the clock skew tolerated when checking the
+	// expiry of tokens.
+	DefaultJWTLeeway = 30 * time.Second
 )
 
 // Config represents a configuration for a Kafka service.
 type Config struct {
 	Enabled     bool   `toml:"enabled"`
 	BindAddress string `toml:"bind-address"`
+
+	// AuthEnabled requires every request except health checks and metrics
+	// to authenticate with one of the API keys.
+	AuthEnabled bool `toml:"auth-enabled"`
+	// KeyFile is a TOML file with additional [[key]] entries, so keys can
+	// be kept out of the main configuration.
+	KeyFile string   `toml:"key-file"`
+	Keys    []APIKey `toml:"key"`
+
+	// MaxSubjectLength and MaxBodySize limit the subject and the bodies of
+	// accepted mails. Zero disables the limit.
+	MaxSubjectLength int   `toml:"max-subject-length"`
+	MaxBodySize      int64 `toml:"max-body-size"`
+	// MaxRequestSize limits the size of JSON requests, which are read
+	// before the mails are validated. Zero disables the limit.
+	MaxRequestSize int64 `toml:"max-request-size"`
+	// AttachmentSchemes are the URL schemes attachments may be downloaded with.
+	AttachmentSchemes []string `toml:"attachment-schemes"`
+	// MaxUploadSize limits the size of multipart requests with uploaded
+	// attachments. Zero disables the limit.
+	MaxUploadSize int64 `toml:"max-upload-size"`
+	// MaxBatchSize limits the number of mails of POST /mail/batch.
+	MaxBatchSize int `toml:"max-batch-size"`
+
+	// IdempotencyWindow defines how long a repeated Idempotency-Key returns
+	// the response of the first request. Zero disables idempotency keys.
+	IdempotencyWindow itoml.Duration `toml:"idempotency-window"`
+
+	JWT    JWTConfig    `toml:"jwt"`
+	Limits LimitsConfig `toml:"limits"`
+}
+
+// JWTConfig configures the validation of JWT bearer tokens. HS256 tokens
+// are verified with Secret, RS256 and ES256 tokens with the public keys of
+// the JWKS file, which is reloaded once it changes.
+type JWTConfig struct {
+	Enabled            bool           `toml:"enabled"`
+	Secret             string         `toml:"secret"`
+	JWKSFile           string         `toml:"jwks-file"`
+	JWKSReloadInterval itoml.Duration `toml:"jwks-reload-interval"`
+	// Issuer and Audience are required to match the iss and aud claims
+	// when they are set.
+	Issuer   string         `toml:"issuer"`
+	Audience string         `toml:"audience"`
+	Leeway   itoml.Duration `toml:"leeway"`
+}
+
+// LimitsConfig configures the rate limits and quotas of mails accepted by
+// the gateway. Counters are kept in memory or in Redis, so they can be
+// shared by all masters.
+type LimitsConfig struct {
+	Enabled        bool        `toml:"enabled"`
+	Backend        string      `toml:"backend"`
+	RedisAddress   string      `toml:"redis-address"`
+	RedisPassword  string      `toml:"redis-password"`
+	RedisDB        int         `toml:"redis-db"`
+	RedisKeyPrefix string      `toml:"redis-key-prefix"`
+	Rules          []LimitRule `toml:"rule"`
+}
+
+// LimitRule limits the mails of every API key, source IP or sender domain
+// to a token bucket of Rate mails per second with bursts of up to Burst
+// mails, and to Daily and Monthly quotas. Zero values don't limit anything.
+// With Match the rule only applies to the listed keys, IPs or domains.
+type LimitRule struct {
+	By      string   `toml:"by"`
+	Match   []string `toml:"match"`
+	Rate    float64  `toml:"rate"`
+	Burst   int      `toml:"burst"`
+	Daily   int64    `toml:"daily"`
+	Monthly int64    `toml:"monthly"`
+}
+
+// Validate returns an error if the rule is invalid.
+func (r *LimitRule) Validate() error {
+	switch r.By {
+	case LimitByAPIKey, LimitByIP, LimitBySenderDomain:
+	default:
+		return fmt.Errorf("httpd: unknown rate limit key %q", r.By)
+	}
+	if r.Rate < 0 || r.Burst < 0 || r.Daily < 0 || r.Monthly < 0 {
+		return fmt.Errorf("httpd: negative %s rate limit", r.By)
+	}
+	if r.Rate == 0 && r.Daily == 0 && r.Monthly == 0 {
+		return fmt.Errorf("httpd: %s rate limit without rate or quota", r.By)
+	}
+	return nil
 }
 
 // NewConfig returns a new Config with default settings.
 func NewConfig() *Config {
 	return &Config{
-		Enabled:     DefaultEnabled,
-		BindAddress: DefaultBindAddress,
+		Enabled:           DefaultEnabled,
+		BindAddress:       DefaultBindAddress,
+		AuthEnabled:       DefaultAuthEnabled,
+		MaxSubjectLength:  DefaultMaxSubjectLength,
+		MaxBodySize:       DefaultMaxBodySize,
+		MaxRequestSize:    DefaultMaxRequestSize,
+		AttachmentSchemes: []string{"https", "http"},
+		MaxUploadSize:     DefaultMaxUploadSize,
+		MaxBatchSize:      DefaultMaxBatchSize,
+		IdempotencyWindow: itoml.Duration(DefaultIdempotencyWindow),
+		JWT: JWTConfig{
+			JWKSReloadInterval: itoml.Duration(DefaultJWKSReloadInterval),
+			Leeway:             itoml.Duration(DefaultJWTLeeway),
+		},
+		Limits: LimitsConfig{
+			Backend:        DefaultLimitBackend,
+			RedisAddress:   DefaultRedisAddress,
+			RedisKeyPrefix: DefaultRedisKeyPrefix,
+		},
+	}
+}
+
+// Validate returns an error if the config is invalid.
+func (c *Config) Validate() error {
+	if err := c.Limits.Validate(); err != nil {
+		return err
+	}
+	if !c.AuthEnabled {
+		return nil
+	}
+	if len(c.Keys) == 0 && c.KeyFile == "" && !c.JWT.Enabled {
+		return errors.New("httpd: auth-enabled requires a key, a key-file or jwt")
+	}
+	if c.JWT.Enabled && c.JWT.Secret == "" && c.JWT.JWKSFile == "" {
+		return errors.New("httpd: jwt requires a secret or a jwks-file")
+	}
+	return validateKeys(c.Keys)
+}
+
+// validateKeys ensures every key has a unique name and a secret.
+func validateKeys(keys []APIKey) error {
+	names := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if k.Name == "" {
+			return errors.New("httpd: key without a name")
+		} else if k.Key == "" {
+			return fmt.Errorf("httpd: key %q has no secret", k.Name)
+		} else if names[k.Name] {
+			return fmt.Errorf("httpd: duplicate key %q", k.Name)
+		}
+		names[k.Name] = true
+	}
+	return nil
+}
+
+// Validate returns an error if the limits are invalid.
+func (c *LimitsConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Backend != "memory" && c.Backend != "redis" {
+		return fmt.Errorf("httpd: unknown limits backend %q", c.Backend)
+	}
+	if c.Backend == "redis" && c.RedisAddress == "" {
+		return errors.New("httpd: redis limits backend requires a redis-address")
+	}
+	for i := range c.Rules {
+		if err := c.Rules[i].Validate(); err != nil {
+			return err
+		}
 	}
+	return nil
 }
@@ -2,6 +2,7 @@ package httpd_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/nirnanaaa/cloudive-mailer/services/httpd"
@@ -13,6 +14,10 @@ func TestConfig_Parse(t *testing.T) {
 	if _, err := toml.Decode(`
 		bind-address = "0.0.0.0:9009"
 		enabled = true
+		max-subject-length = 255
+		max-body-size = 1024
+		max-upload-size = 4096
+		attachment-schemes = ["https"]
 `, &c); err != nil {
 		t.Fatal(err)
 	}
@@ -23,5 +28,109 @@ func TestConfig_Parse(t *testing.T) {
 	} else if !c.Enabled {
 		t.Fatalf("unexpected Enabled, want true got false")
 
+	} else if c.MaxSubjectLength != 255 || c.MaxBodySize != 1024 || c.MaxUploadSize != 4096 {
+		t.Fatalf("unexpected limits: %d %d %d", c.MaxSubjectLength, c.MaxBodySize, c.MaxUploadSize)
+	} else if len(c.AttachmentSchemes) != 1 || c.AttachmentSchemes[0] != "https" {
+		t.Fatalf("unexpected AttachmentSchemes: %v", c.AttachmentSchemes)
+	}
+}
+
+func TestConfig_ParseKeys(t *testing.T) {
+	c := httpd.NewConfig()
+	if _, err := toml.Decode(`
+		auth-enabled = true
+
+		[[key]]
+		name = "shop"
+		key = "secret"
+		senders = ["shop.example.com", "billing@example.com"]
+		enabled = true
+`, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.AuthEnabled {
+		t.Fatalf("unexpected AuthEnabled, want true got false")
+	} else if len(c.Keys) != 1 || c.Keys[0].Name != "shop" || len(c.Keys[0].Senders) != 2 || c.Keys[0].Enabled == nil || !*c.Keys[0].Enabled {
+		t.Fatalf("unexpected Keys: %+v", c.Keys)
+	} else if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Keys = append(c.Keys, httpd.APIKey{Name: "shop", Key: "other"})
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected an error for duplicate key names")
+	}
+	c.Keys = nil
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected an error without keys")
+	}
+}
+
+func TestConfig_ParseJWT(t *testing.T) {
+	c := httpd.NewConfig()
+	if _, err := toml.Decode(`
+		auth-enabled = true
+
+		[jwt]
+		enabled = true
+		jwks-file = "/etc/cloudive/jwks.json"
+		jwks-reload-interval = "5m"
+		issuer = "https://id.example.com"
+		audience = "mailer"
+`, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.JWT.Enabled || c.JWT.JWKSFile != "/etc/cloudive/jwks.json" {
+		t.Fatalf("unexpected JWT: %+v", c.JWT)
+	} else if time.Duration(c.JWT.JWKSReloadInterval) != 5*time.Minute {
+		t.Fatalf("unexpected JWKSReloadInterval: %s", time.Duration(c.JWT.JWKSReloadInterval))
+	} else if time.Duration(c.JWT.Leeway) != httpd.DefaultJWTLeeway {
+		t.Fatalf("unexpected Leeway: %s", time.Duration(c.JWT.Leeway))
+	} else if c.JWT.Issuer != "https://id.example.com" || c.JWT.Audience != "mailer" {
+		t.Fatalf("unexpected JWT: %+v", c.JWT)
+	} else if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c.JWT.JWKSFile = ""
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected an error without secret and jwks-file")
+	}
+}
+
+func TestConfig_ParseLimits(t *testing.T) {
+	c := httpd.NewConfig()
+	if _, err := toml.Decode(`
+		[limits]
+		enabled = true
+		backend = "redis"
+		redis-address = "redis:6379"
+
+		[[limits.rule]]
+		by = "api-key"
+		match = ["shop"]
+		rate = 10.0
+		burst = 20
+		daily = 10000
+		monthly = 200000
+`, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.Limits.Enabled || c.Limits.Backend != "redis" || c.Limits.RedisAddress != "redis:6379" {
+		t.Fatalf("unexpected Limits: %+v", c.Limits)
+	} else if c.Limits.RedisKeyPrefix != httpd.DefaultRedisKeyPrefix {
+		t.Fatalf("unexpected RedisKeyPrefix: %s", c.Limits.RedisKeyPrefix)
+	} else if len(c.Limits.Rules) != 1 {
+		t.Fatalf("unexpected Rules: %+v", c.Limits.Rules)
+	} else if r := c.Limits.Rules[0]; r.By != httpd.LimitByAPIKey || r.Rate != 10 || r.Burst != 20 || r.Daily != 10000 || r.Monthly != 200000 {
+		t.Fatalf("unexpected Rule: %+v", r)
+	} else if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c.Limits.Rules[0].By = "user"
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected an error for an unknown key")
 	}
 }
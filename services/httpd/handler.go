@@ -4,9 +4,13 @@ import (
 	"net/http"
 	"net/http/pprof"
 	"strings"
+	"time"
 
 	"github.com/bmizerany/pat"
-	"github.com/nirnanaaa/cloudive-mailer/services/kafka"
+	"github.com/nirnanaaa/cloudive-mailer/services/blobs"
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
+	"github.com/nirnanaaa/cloudive-mailer/services/status"
+	"github.com/nirnanaaa/cloudive-mailer/services/templates"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	// import static fs files
@@ -18,9 +22,6 @@ const (
 	//
 	// This has no relation to the number of bytes that are returned.
 	DefaultChunkSize = 10000
-
-	// MaxFileSize specifies a maxium upload file size
-	MaxFileSize = 1 * 1000 * 1000 * 1000 * 1000
 )
 
 // AuthenticationMethod defines the type of authentication used.
@@ -32,6 +33,13 @@ const (
 	BearerAuthentication
 )
 
+func (m AuthenticationMethod) String() string {
+	if m == BearerAuthentication {
+		return "bearer"
+	}
+	return "api-key"
+}
+
 // TODO: Check HTTP response codes: 400, 401, 403, 409.
 
 // Route specifies how to handle a HTTP verb for a given endpoint.
@@ -47,10 +55,17 @@ type Handler struct {
 	mux     *pat.PatternServeMux
 	Version string
 
-	Kafka  *kafka.Service
-	Config *Config
-	Logger *logrus.Entry
-	Close  chan struct{}
+	Queue     queue.Publisher
+	Templates templates.Store
+	Status    status.Store
+	Blobs     blobs.Store
+	Keys      []APIKey
+	Limiter   Limiter
+	jwt       *JWTValidator
+	requests  *idempotencyStore
+	Config    *Config
+	Logger    *logrus.Entry
+	Close     chan struct{}
 }
 
 // NewHandler returns a new instance of handler with routes.
@@ -58,7 +73,18 @@ func NewHandler(c Config) *Handler {
 	h := &Handler{
 		mux:    pat.New(),
 		Config: &c,
+		Keys:   c.Keys,
 		Close:  make(chan struct{}),
+		Logger: logrus.New().WithField("prefix", "httpd"),
+	}
+	if c.JWT.Enabled {
+		h.jwt = NewJWTValidator(&c.JWT)
+	}
+	if c.Limits.Enabled {
+		h.Limiter = NewLimiter(&c.Limits)
+	}
+	if c.IdempotencyWindow > 0 {
+		h.requests = newIdempotencyStore(time.Duration(c.IdempotencyWindow))
 	}
 	h.AddRoutes([]Route{
 		Route{
@@ -77,15 +103,26 @@ func NewHandler(c Config) *Handler {
 			"mail",
 			"POST", "/mail", h.acceptInboundEmail,
 		},
+		Route{
+			"mail-batch",
+			"POST", "/mail/batch", h.acceptBatch,
+		},
 	}...)
+	h.AddRoutes(h.templateRoutes()...)
+	h.AddRoutes(h.statusRoutes()...)
 
 	return h
 }
 
-// AddRoutes sets the provided routes on the handler.
+// AddRoutes sets the provided routes on the handler. All routes except
+// health checks and metrics require authentication when it is enabled.
 func (h *Handler) AddRoutes(routes ...Route) {
 	for _, r := range routes {
-		h.mux.Add(r.Method, r.Pattern, http.HandlerFunc(r.HandlerFunc))
+		fn := r.HandlerFunc
+		if !publicRoutes[r.Name] {
+			fn = h.authenticate(fn)
+		}
+		h.mux.Add(r.Method, r.Pattern, http.HandlerFunc(fn))
 	}
 
 }
@@ -106,8 +143,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			pprof.Index(w, r)
 		}
 	} else {
-		w.Header().Add("Content-Type", "application/json")
-		h.mux.ServeHTTP(w, r)
+		h.mux.ServeHTTP(NewResponseWriter(w, r), r)
 	}
 
 	// atomic.AddInt64(&h.stats.RequestDuration, time.Since(start).Nanoseconds())
@@ -123,6 +159,14 @@ func (h *Handler) serveOptions(w http.ResponseWriter, r *http.Request) {
 	h.writeHeader(w, http.StatusNoContent)
 }
 
+// writeResults writes results as JSON response with the given status code.
+func (h *Handler) writeResults(w http.ResponseWriter, code int, results ...interface{}) {
+	if rw, ok := w.(ResponseWriter); ok {
+		h.writeHeader(w, code)
+		rw.WriteResponse(Response{Results: results})
+	}
+}
+
 // writeHeader writes the provided status code in the response, and
 // updates relevant http error statistics.
 func (h *Handler) writeHeader(w http.ResponseWriter, code int) {
@@ -1,10 +1,14 @@
 package httpd_test
 
 import (
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
 )
 
 func GetHttpHandler(rr *httptest.ResponseRecorder, req *http.Request) error {
@@ -36,3 +40,44 @@ func MustNewRequest(method, urlStr string, body io.Reader) *http.Request {
 	}
 	return r
 }
+
+// Ensure mails are published into the queue.
+func TestHandler_Mail(t *testing.T) {
+	c := queue.NewConfig()
+	c.MemorySize = 1
+	q := queue.NewMemoryQueue(c)
+	httpx := CreateService(false)
+	httpx.Handler.Queue = q
+
+	body := `{"sender":{"email":"someguy@somedomain.com"},"recipient":{"email":"someguy@somedomain.com"},"subject":"test"}`
+	w := httptest.NewRecorder()
+	httpx.Handler.ServeHTTP(w, MustNewRequest("POST", "/mail", strings.NewReader(body)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("unexpected status: %d", w.Code)
+	} else if q.Len() != 1 {
+		t.Fatalf("unexpected queue length: %d", q.Len())
+	}
+	var resp struct {
+		Results []struct {
+			ID string `json:"id"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	} else if len(resp.Results) != 1 || resp.Results[0].ID == "" {
+		t.Fatalf("unexpected response: %s", w.Body.String())
+	}
+
+	// the queue is full now
+	w = httptest.NewRecorder()
+	httpx.Handler.ServeHTTP(w, MustNewRequest("POST", "/mail", strings.NewReader(body)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	httpx.Handler.ServeHTTP(w, MustNewRequest("POST", "/mail", strings.NewReader("{")))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+}
@@ -0,0 +1,114 @@
+package httpd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// HeaderIdempotencyKey is the request header carrying an idempotency key.
+	HeaderIdempotencyKey = "Idempotency-Key"
+
+	// HeaderIdempotentReplayed marks responses repeated for an idempotency key.
+	HeaderIdempotentReplayed = "Idempotent-Replayed"
+
+	// MaxIdempotencyKeyLength is the maximum length of idempotency keys.
+	MaxIdempotencyKeyLength = 255
+)
+
+// idempotencyNamespace is the namespace of the message IDs derived from
+// idempotency keys.
+var idempotencyNamespace = uuid.FromStringOrNil("5b8c9d3e-0a4f-4c61-9e57-2f1d6b7a8c90")
+
+// scopedKey returns the idempotency key of a mail within the keys of caller.
+func scopedKey(caller *Identity, key string) string {
+	scope := ""
+	if caller != nil {
+		scope = caller.Name
+	}
+	return scope + "\x00" + key
+}
+
+// idempotentID returns the message ID of a mail sent with an idempotency
+// key. It is the same on every master, so workers can drop duplicates
+// which were accepted by different masters. The content is part of the ID,
+// so a key reused for another mail, after the window or on another master,
+// never drops that mail.
+func idempotentID(caller *Identity, key string, content []byte) string {
+	hash := sha256.Sum256(content)
+	return uuid.NewV5(idempotencyNamespace, scopedKey(caller, key)+"\x00"+hex.EncodeToString(hash[:])).String()
+}
+
+// idempotentRequest is the first request sent with an idempotency key.
+type idempotentRequest struct {
+	hash    [sha256.Size]byte
+	id      string
+	done    bool
+	expires time.Time
+}
+
+// idempotencyStore remembers the requests sent with idempotency keys for a
+// window of time.
+type idempotencyStore struct {
+	window time.Duration
+
+	mu       sync.Mutex
+	requests map[string]*idempotentRequest
+	swept    time.Time
+}
+
+func newIdempotencyStore(window time.Duration) *idempotencyStore {
+	return &idempotencyStore{
+		window:   window,
+		requests: make(map[string]*idempotentRequest),
+	}
+}
+
+// begin registers the request with body and message id for key, unless
+// there already is a request for it, which is returned instead.
+func (s *idempotencyStore) begin(key, id string, body []byte, now time.Time) (*idempotentRequest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+	if req, ok := s.requests[key]; ok && now.Before(req.expires) {
+		copied := *req
+		return &copied, true
+	}
+	s.requests[key] = &idempotentRequest{
+		hash:    sha256.Sum256(body),
+		id:      id,
+		expires: now.Add(s.window),
+	}
+	return nil, false
+}
+
+// finish marks the request for key as done, so it is repeated from now on.
+// Failed requests are forgotten, so they can be sent again.
+func (s *idempotencyStore) finish(key string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !ok {
+		delete(s.requests, key)
+		return
+	}
+	if req, found := s.requests[key]; found {
+		req.done = true
+	}
+}
+
+// sweep drops expired requests once a minute.
+func (s *idempotencyStore) sweep(now time.Time) {
+	if now.Sub(s.swept) < time.Minute {
+		return
+	}
+	s.swept = now
+	for key, req := range s.requests {
+		if !now.Before(req.expires) {
+			delete(s.requests, key)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/httpd"
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
+)
+
+func TestHandler_IdempotencyKey(t *testing.T) {
+	q := queue.NewMemoryQueue(queue.NewConfig())
+	h := httpd.NewHandler(*httpd.NewConfig())
+	h.Queue = q
+	send := func(key, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := MustNewRequest("POST", "/mail", strings.NewReader(body))
+		req.Header.Set(httpd.HeaderIdempotencyKey, key)
+		h.ServeHTTP(w, req)
+		return w
+	}
+	id := func(w *httptest.ResponseRecorder) string {
+		var resp struct {
+			Results []struct {
+				ID string `json:"id"`
+			} `json:"results"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Results) != 1 {
+			t.Fatalf("unexpected response: %s", w.Body.String())
+		}
+		return resp.Results[0].ID
+	}
+	body := `{"sender":{"email":"someguy@somedomain.com"},"recipient":{"email":"someguy@somedomain.com"},"subject":"test"}`
+
+	first := send("order-1", body)
+	if first.Code != http.StatusAccepted {
+		t.Fatalf("unexpected status: %d", first.Code)
+	}
+	repeated := send("order-1", body)
+	if repeated.Code != http.StatusAccepted || id(repeated) != id(first) {
+		t.Fatalf("unexpected repeated response: %d: %s", repeated.Code, repeated.Body.String())
+	} else if repeated.Header().Get(httpd.HeaderIdempotentReplayed) != "true" {
+		t.Fatal("repeated response not marked")
+	} else if q.Len() != 1 {
+		t.Fatalf("unexpected queue length: %d", q.Len())
+	}
+
+	if w := send("order-1", `{"sender":{"email":"someguy@somedomain.com"},"recipient":{"email":"someguy@somedomain.com"},"subject":"other"}`); w.Code != http.StatusConflict {
+		t.Fatalf("unexpected status for a different body: %d", w.Code)
+	}
+	if w := send("order-2", body); w.Code != http.StatusAccepted || id(w) == id(first) {
+		t.Fatalf("unexpected response for a new key: %d: %s", w.Code, w.Body.String())
+	}
+	if w := send(strings.Repeat("k", httpd.MaxIdempotencyKeyLength+1), body); w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status for a long key: %d", w.Code)
+	}
+}
+
+// Ensure mails are queued again once a failed request is repeated.
+func TestHandler_IdempotencyKeyFailed(t *testing.T) {
+	c := queue.NewConfig()
+	c.MemorySize = 1
+	q := queue.NewMemoryQueue(c)
+	h := httpd.NewHandler(*httpd.NewConfig())
+	h.Queue = q
+	q.Publish(&queue.Message{Key: "filler"})
+	body := `{"sender":{"email":"someguy@somedomain.com"},"recipient":{"email":"someguy@somedomain.com"},"subject":"test"}`
+	send := func() int {
+		w := httptest.NewRecorder()
+		req := MustNewRequest("POST", "/mail", strings.NewReader(body))
+		req.Header.Set(httpd.HeaderIdempotencyKey, "order-1")
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := send(); code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status: %d", code)
+	}
+	q = queue.NewMemoryQueue(queue.NewConfig())
+	h.Queue = q
+	if code := send(); code != http.StatusAccepted || q.Len() != 1 {
+		t.Fatalf("unexpected status: %d, queue length %d", code, q.Len())
+	}
+}
+
+// Ensure a key reused for different mails never gives them the same ID, as
+// workers would drop all but the first one.
+func TestHandler_IdempotencyKeyDisabled(t *testing.T) {
+	c := httpd.NewConfig()
+	c.IdempotencyWindow = 0
+	q := queue.NewMemoryQueue(queue.NewConfig())
+	h := httpd.NewHandler(*c)
+	h.Queue = q
+	send := func(body string) string {
+		w := httptest.NewRecorder()
+		req := MustNewRequest("POST", "/mail", strings.NewReader(body))
+		req.Header.Set(httpd.HeaderIdempotencyKey, "order-1")
+		h.ServeHTTP(w, req)
+		var resp struct {
+			Results []struct {
+				ID string `json:"id"`
+			} `json:"results"`
+		}
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("unexpected status: %d", w.Code)
+		} else if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Results) != 1 {
+			t.Fatalf("unexpected response: %s", w.Body.String())
+		}
+		return resp.Results[0].ID
+	}
+	body := `{"sender":{"email":"someguy@somedomain.com"},"recipient":{"email":"someguy@somedomain.com"},"subject":"test"}`
+
+	first := send(body)
+	if other := send(strings.Replace(body, `"test"`, `"other"`, 1)); other == first {
+		t.Fatalf("different mails got the same ID %s", first)
+	}
+	// without the window, repeated mails are queued again, but keep their ID
+	if repeated := send(body); repeated != first {
+		t.Fatalf("unexpected ID of a repeated mail: %s, want %s", repeated, first)
+	} else if q.Len() != 3 {
+		t.Fatalf("unexpected queue length: %d", q.Len())
+	}
+}
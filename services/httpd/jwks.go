@@ -0,0 +1,173 @@
+package httpd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+// jwk is a public key of a JSON Web Key Set, as defined in RFC 7517.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// RSA keys
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC keys
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey decodes the RSA or P-256 public key of k.
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("point not on curve P-256")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// algorithm returns the signing algorithm matching the key type.
+func (k *jwk) algorithm() string {
+	if k.Alg != "" {
+		return k.Alg
+	}
+	if k.Kty == "EC" {
+		return "ES256"
+	}
+	return "RS256"
+}
+
+// keySet holds the public keys of a JWKS file. The file is checked for
+// changes at most once per interval, or right away when a token references
+// an unknown key, so rotated keys are picked up without a restart.
+type keySet struct {
+	path     string
+	interval time.Duration
+
+	mu      sync.Mutex
+	keys    map[string]*jwk
+	public  map[string]crypto.PublicKey
+	modTime time.Time
+	checked time.Time
+}
+
+func newKeySet(path string, interval time.Duration) *keySet {
+	return &keySet{path: path, interval: interval}
+}
+
+// load reads the file if it has been modified since it was read last.
+func (s *keySet) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reload(time.Now())
+}
+
+func (s *keySet) reload(now time.Time) error {
+	s.checked = now
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	if s.keys != nil && fi.ModTime().Equal(s.modTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("parse %s: %s", s.path, err)
+	}
+	keys := make(map[string]*jwk, len(set.Keys))
+	public := make(map[string]crypto.PublicKey, len(set.Keys))
+	for i := range set.Keys {
+		k := &set.Keys[i]
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			return fmt.Errorf("parse %s: key %q: %s", s.path, k.Kid, err)
+		}
+		keys[k.Kid] = k
+		public[k.Kid] = pub
+	}
+	s.keys, s.public, s.modTime = keys, public, fi.ModTime()
+	return nil
+}
+
+// key returns the public key with the given id for alg. A broken file
+// doesn't replace the keys read before, so tokens stay valid while a
+// rotation is in progress.
+func (s *keySet) key(kid, alg string, now time.Time) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	if _, ok := s.keys[kid]; !ok || now.Sub(s.checked) >= s.interval {
+		err = s.reload(now)
+	}
+	k, ok := s.keys[kid]
+	if !ok {
+		if err != nil {
+			return nil, fmt.Errorf("unknown key %q: %s", kid, err)
+		}
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	if k.algorithm() != alg {
+		return nil, fmt.Errorf("key %q is not used with %s", kid, alg)
+	}
+	return s.public[kid], nil
+}
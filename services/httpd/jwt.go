@@ -0,0 +1,216 @@
+package httpd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Errors returned when validating tokens.
+var (
+	ErrMalformedToken = errors.New("malformed token")
+	ErrTokenSignature = errors.New("invalid token signature")
+	ErrTokenExpired   = errors.New("token expired")
+)
+
+// jwtHeader is the JOSE header of a token.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// audience is either a single string or a list of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return err
+	}
+	*a = l
+	return nil
+}
+
+// Claims are the claims of a token which are used by the mailer. The
+// sender_domains, recipient_domains and templates claims restrict which
+// mails the caller may send, they don't restrict anything when they are
+// missing.
+type Claims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	ExpiresAt float64  `json:"exp"`
+	NotBefore float64  `json:"nbf"`
+
+	SenderDomains    []string `json:"sender_domains"`
+	RecipientDomains []string `json:"recipient_domains"`
+	Templates        []string `json:"templates"`
+}
+
+// JWTValidator validates JWT bearer tokens.
+type JWTValidator struct {
+	config *JWTConfig
+	keys   *keySet
+}
+
+// NewJWTValidator returns a new instance of JWTValidator. The JWKS file is
+// read on first use or by Load.
+func NewJWTValidator(c *JWTConfig) *JWTValidator {
+	v := &JWTValidator{config: c}
+	if c.JWKSFile != "" {
+		v.keys = newKeySet(c.JWKSFile, time.Duration(c.JWKSReloadInterval))
+	}
+	return v
+}
+
+// Load reads the JWKS file, so broken files are noticed on start.
+func (v *JWTValidator) Load() error {
+	if v.keys == nil {
+		return nil
+	}
+	return v.keys.load()
+}
+
+// isJWT returns true if a bearer token looks like a JWT instead of an API key.
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Validate verifies the signature and claims of token and returns the
+// caller it identifies.
+func (v *JWTValidator) Validate(token string, now time.Time) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	if err := v.verify(&header, parts[0]+"."+parts[1], sig, now); err != nil {
+		return nil, err
+	}
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := v.validateClaims(&claims, now); err != nil {
+		return nil, err
+	}
+	name := claims.Subject
+	if name == "" {
+		name = "jwt"
+	}
+	return &Identity{
+		Name:             name,
+		Method:           BearerAuthentication,
+		Senders:          claims.SenderDomains,
+		RecipientDomains: claims.RecipientDomains,
+		Templates:        claims.Templates,
+	}, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return ErrMalformedToken
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return ErrMalformedToken
+	}
+	return nil
+}
+
+// verify checks the signature of signed. The algorithm of the header must
+// match the kind of key, so public keys can't be abused as HMAC secrets.
+func (v *JWTValidator) verify(header *jwtHeader, signed string, sig []byte, now time.Time) error {
+	sum := sha256.Sum256([]byte(signed))
+	switch header.Alg {
+	case "HS256":
+		if v.config.Secret == "" {
+			return fmt.Errorf("unsupported algorithm %s", header.Alg)
+		}
+		mac := hmac.New(sha256.New, []byte(v.config.Secret))
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return ErrTokenSignature
+		}
+		return nil
+	case "RS256", "ES256":
+		if v.keys == nil {
+			return fmt.Errorf("unsupported algorithm %s", header.Alg)
+		}
+		key, err := v.keys.key(header.Kid, header.Alg, now)
+		if err != nil {
+			return err
+		}
+		switch pub := key.(type) {
+		case *rsa.PublicKey:
+			if header.Alg != "RS256" || rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) != nil {
+				return ErrTokenSignature
+			}
+		case *ecdsa.PublicKey:
+			if header.Alg != "ES256" || len(sig) != 64 {
+				return ErrTokenSignature
+			}
+			r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+			if !ecdsa.Verify(pub, sum[:], r, s) {
+				return ErrTokenSignature
+			}
+		default:
+			return ErrTokenSignature
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+}
+
+// validateClaims checks expiry, issuer and audience. Tokens without an
+// expiry are rejected.
+func (v *JWTValidator) validateClaims(c *Claims, now time.Time) error {
+	leeway := time.Duration(v.config.Leeway)
+	if c.ExpiresAt == 0 {
+		return errors.New("token without expiry")
+	}
+	if now.Add(-leeway).After(unixTime(c.ExpiresAt)) {
+		return ErrTokenExpired
+	}
+	if c.NotBefore != 0 && now.Add(leeway).Before(unixTime(c.NotBefore)) {
+		return errors.New("token not valid yet")
+	}
+	if v.config.Issuer != "" && c.Issuer != v.config.Issuer {
+		return fmt.Errorf("unexpected issuer %q", c.Issuer)
+	}
+	if v.config.Audience != "" {
+		for _, aud := range c.Audience {
+			if aud == v.config.Audience {
+				return nil
+			}
+		}
+		return fmt.Errorf("token not issued for %q", v.config.Audience)
+	}
+	return nil
+}
+
+func unixTime(sec float64) time.Time {
+	return time.Unix(int64(sec), 0)
+}
@@ -0,0 +1,175 @@
+package httpd_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/httpd"
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// signToken returns a token with claims signed by key, which is either a
+// HMAC secret, an RSA or an ECDSA private key.
+func signToken(t *testing.T, alg, kid string, claims map[string]interface{}, key interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := b64(header) + "." + b64(payload)
+	sum := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[32-len(rb):], rb)
+		copy(sig[64-len(sb):], sb)
+	}
+	return signed + "." + b64(sig)
+}
+
+func writeJWKS(t *testing.T, path string, keys ...map[string]string) {
+	data, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func rsaJWK(kid string, k *rsa.PrivateKey) map[string]string {
+	return map[string]string{"kty": "RSA", "kid": kid, "n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes())}
+}
+
+func ecJWK(kid string, k *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(k.X.Bytes()), "y": b64(k.Y.Bytes())}
+}
+
+func TestHandler_JWT(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudive-jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := filepath.Join(dir, "jwks.json")
+	writeJWKS(t, jwks, rsaJWK("rsa-1", rsaKey), ecJWK("ec-1", ecKey))
+
+	c := httpd.NewConfig()
+	c.AuthEnabled = true
+	c.JWT.Enabled = true
+	c.JWT.Secret = "shared"
+	c.JWT.JWKSFile = jwks
+	c.JWT.Issuer = "https://id.example.com"
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	h := httpd.NewHandler(*c)
+	h.Queue = queue.NewMemoryQueue(queue.NewConfig())
+	if err := h.LoadKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"iss": "https://id.example.com", "sub": "shop", "exp": exp}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+	body := `{"sender":{"email":"news@shop.example.com"},"recipient":{"email":"someguy@somedomain.com"},"subject":"test"}`
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	for name, tt := range map[string]struct {
+		token string
+		code  int
+		err   string
+	}{
+		"hs256":            {signToken(t, "HS256", "", claims(nil), []byte("shared")), http.StatusAccepted, ""},
+		"rs256":            {signToken(t, "RS256", "rsa-1", claims(nil), rsaKey), http.StatusAccepted, ""},
+		"es256":            {signToken(t, "ES256", "ec-1", claims(nil), ecKey), http.StatusAccepted, ""},
+		"wrong secret":     {signToken(t, "HS256", "", claims(nil), []byte("guess")), http.StatusUnauthorized, "err.global.invalid_token"},
+		"wrong key":        {signToken(t, "ES256", "ec-1", claims(nil), otherKey), http.StatusUnauthorized, "err.global.invalid_token"},
+		"mismatching alg":  {signToken(t, "ES256", "rsa-1", claims(nil), ecKey), http.StatusUnauthorized, "err.global.invalid_token"},
+		"unknown kid":      {signToken(t, "RS256", "rsa-9", claims(nil), rsaKey), http.StatusUnauthorized, "err.global.invalid_token"},
+		"none":             {signToken(t, "none", "", claims(nil), []byte("")), http.StatusUnauthorized, "err.global.invalid_token"},
+		"expired":          {signToken(t, "HS256", "", claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}), []byte("shared")), http.StatusUnauthorized, "err.global.invalid_token"},
+		"wrong issuer":     {signToken(t, "HS256", "", claims(map[string]interface{}{"iss": "evil"}), []byte("shared")), http.StatusUnauthorized, "err.global.invalid_token"},
+		"sender domain":    {signToken(t, "HS256", "", claims(map[string]interface{}{"sender_domains": []string{"example.org"}}), []byte("shared")), http.StatusForbidden, "err.global.sender_not_allowed"},
+		"recipient domain": {signToken(t, "HS256", "", claims(map[string]interface{}{"recipient_domains": []string{"example.org"}}), []byte("shared")), http.StatusForbidden, "err.global.recipient_not_allowed"},
+		"allowed domains":  {signToken(t, "HS256", "", claims(map[string]interface{}{"sender_domains": []string{"shop.example.com"}, "recipient_domains": []string{"somedomain.com"}}), []byte("shared")), http.StatusAccepted, ""},
+	} {
+		w := serveWithHeader(h, body, "Authorization", "Bearer "+tt.token)
+		if w.Code != tt.code {
+			t.Fatalf("%s: unexpected status: %d: %s", name, w.Code, w.Body.String())
+		} else if !strings.Contains(w.Body.String(), tt.err) {
+			t.Fatalf("%s: unexpected body: %s", name, w.Body.String())
+		}
+	}
+
+	templated := `{"template_id":"invoice","sender":{"email":"someguy@somedomain.com"},"recipient":{"email":"someguy@somedomain.com"},"subject":"test"}`
+	token := signToken(t, "HS256", "", claims(map[string]interface{}{"templates": []string{"welcome"}}), []byte("shared"))
+	if w := serveWithHeader(h, templated, "Authorization", "Bearer "+token); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "err.global.template_not_allowed") {
+		t.Fatalf("unexpected response: %d: %s", w.Code, w.Body.String())
+	}
+
+	// rotate the keys, tokens of the new key are accepted right away
+	rotated, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeJWKS(t, jwks, rsaJWK("rsa-2", rotated))
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(jwks, later, later); err != nil {
+		t.Fatal(err)
+	}
+	token = signToken(t, "RS256", "rsa-2", claims(nil), rotated)
+	if w := serveWithHeader(h, body, "Authorization", "Bearer "+token); w.Code != http.StatusAccepted {
+		t.Fatalf("unexpected status after rotation: %d: %s", w.Code, w.Body.String())
+	}
+	token = signToken(t, "RS256", "rsa-1", claims(nil), rsaKey)
+	if w := serveWithHeader(h, body, "Authorization", "Bearer "+token); w.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected status for removed key: %d", w.Code)
+	}
+}
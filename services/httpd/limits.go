@@ -0,0 +1,281 @@
+package httpd
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/kafka/event"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Keys rate limits are counted by.
+const (
+	LimitByAPIKey       = "api-key"
+	LimitByIP           = "ip"
+	LimitBySenderDomain = "sender-domain"
+)
+
+var (
+	throttledCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailer_httpd_throttled",
+		Help: "Number of mails rejected by rate limits and quotas",
+	}, []string{"by", "limit"})
+	limiterErrorCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailer_httpd_limiter_errors",
+		Help: "Number of mails accepted without checking rate limits, as the limiter failed",
+	})
+)
+
+// RegisterMetrics registers the metrics of the HTTP service.
+func RegisterMetrics() error {
+	for _, c := range []prometheus.Collector{throttledCount, limiterErrorCount} {
+		if err := prometheus.Register(c); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Limiter keeps the counters of rate limits and quotas.
+type Limiter interface {
+	// Take takes a token from the bucket key, which is refilled with rate
+	// tokens per second up to burst tokens. If the bucket is empty, it
+	// returns how long it takes until the next token is available.
+	Take(key string, rate float64, burst int, now time.Time) (time.Duration, error)
+	// Count counts a request in the quota period key, which ends at reset,
+	// and returns the number of requests in the period so far.
+	Count(key string, reset, now time.Time) (int64, error)
+	// Uncount takes back a request counted in the quota period key, as the
+	// mail hasn't been queued after all.
+	Uncount(key string) error
+}
+
+// NewLimiter returns the limiter of the configured backend.
+func NewLimiter(c *LimitsConfig) Limiter {
+	if c.Backend == "redis" {
+		return NewRedisLimiter(c)
+	}
+	return NewMemoryLimiter()
+}
+
+// MemoryLimiter keeps the counters inside the running process.
+type MemoryLimiter struct {
+	mu       sync.Mutex
+	buckets  map[string]*bucket
+	counters map[string]*counter
+	swept    time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// full is the time the bucket is completely refilled and can be dropped.
+	full time.Time
+}
+
+type counter struct {
+	n     int64
+	reset time.Time
+}
+
+// NewMemoryLimiter returns a new instance of MemoryLimiter.
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{
+		buckets:  make(map[string]*bucket),
+		counters: make(map[string]*counter),
+	}
+}
+
+// Take takes a token from the bucket key.
+func (l *MemoryLimiter) Take(key string, rate float64, burst int, now time.Time) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / rate * float64(time.Second)), nil
+	}
+	b.tokens--
+	b.full = now.Add(time.Duration((float64(burst) - b.tokens) / rate * float64(time.Second)))
+	return 0, nil
+}
+
+// Count counts a request in the quota period key.
+func (l *MemoryLimiter) Count(key string, reset, now time.Time) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	c, ok := l.counters[key]
+	if !ok {
+		c = &counter{reset: reset}
+		l.counters[key] = c
+	}
+	c.n++
+	return c.n, nil
+}
+
+// Uncount takes back a request counted in the quota period key.
+func (l *MemoryLimiter) Uncount(key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c, ok := l.counters[key]; ok && c.n > 0 {
+		c.n--
+	}
+	return nil
+}
+
+// sweep drops full buckets and counters of past periods once a minute.
+func (l *MemoryLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		if !now.Before(b.full) {
+			delete(l.buckets, key)
+		}
+	}
+	for key, c := range l.counters {
+		if !now.Before(c.reset) {
+			delete(l.counters, key)
+		}
+	}
+}
+
+// limitValue returns the API key, IP or sender domain a rule counts a mail
+// by, an empty string if the rule doesn't apply.
+func limitValue(by string, r *http.Request, caller *Identity, msg *event.InboundEmailEvent) string {
+	switch by {
+	case LimitByAPIKey:
+		if caller != nil {
+			return caller.Name
+		}
+	case LimitByIP:
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return host
+	case LimitBySenderDomain:
+		if at := strings.LastIndex(msg.Sender.Email, "@"); at >= 0 {
+			return strings.ToLower(msg.Sender.Email[at+1:])
+		}
+	}
+	return ""
+}
+
+// matches returns true if the rule applies to value.
+func (r *LimitRule) matches(value string) bool {
+	if len(r.Match) == 0 {
+		return true
+	}
+	for _, m := range r.Match {
+		if strings.EqualFold(m, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// check counts a mail against the rule and returns which limit is exceeded
+// and for how long, an empty string if none is. The quota periods the mail
+// has been counted in are added to counted.
+func (h *Handler) check(i int, rule *LimitRule, value string, now time.Time, counted *[]string) (string, time.Duration, error) {
+	key := fmt.Sprintf("%d:%s:%s", i, rule.By, value)
+	if rule.Rate > 0 {
+		burst := rule.Burst
+		if burst == 0 {
+			burst = int(math.Max(1, math.Ceil(rule.Rate)))
+		}
+		wait, err := h.Limiter.Take("rate:"+key, rule.Rate, burst, now)
+		if err != nil || wait > 0 {
+			return "rate", wait, err
+		}
+	}
+	now = now.UTC()
+	for _, q := range []struct {
+		limit  string
+		max    int64
+		period string
+		reset  time.Time
+	}{
+		{"daily", rule.Daily, now.Format("20060102"), time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)},
+		{"monthly", rule.Monthly, now.Format("200601"), time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		if q.max == 0 {
+			continue
+		}
+		period := q.limit + ":" + q.period + ":" + key
+		n, err := h.Limiter.Count(period, q.reset, now)
+		if err != nil {
+			return q.limit, 0, err
+		}
+		*counted = append(*counted, period)
+		if n > q.max {
+			return q.limit, q.reset.Sub(now), nil
+		}
+	}
+	return "", 0, nil
+}
+
+// limit counts a mail against all rate limits and quotas. It returns the
+// error code of the first exceeded limit and how long to wait until the
+// mail might be accepted, an empty code if none is exceeded. Rejected mails
+// don't use up any quota, accepted ones return the quota periods they have
+// been counted in, so they can be refunded if the mail isn't queued. Mails
+// are accepted if the limiter fails, so an unavailable Redis doesn't stop
+// all mails.
+func (h *Handler) limit(r *http.Request, caller *Identity, msg *event.InboundEmailEvent) (string, time.Duration, []string) {
+	if h.Limiter == nil {
+		return "", 0, nil
+	}
+	now := time.Now()
+	var counted []string
+	for i := range h.Config.Limits.Rules {
+		rule := &h.Config.Limits.Rules[i]
+		value := limitValue(rule.By, r, caller, msg)
+		if value == "" || !rule.matches(value) {
+			continue
+		}
+		limit, wait, err := h.check(i, rule, value, now, &counted)
+		if err != nil {
+			limiterErrorCount.Inc()
+			h.Logger.WithError(err).Warnf("Checking the %s limit of %s failed", limit, value)
+			continue
+		}
+		if limit == "" {
+			continue
+		}
+		throttledCount.WithLabelValues(rule.By, limit).Inc()
+		h.Logger.Debugf("Throttling %s %s, %s limit exceeded", rule.By, value, limit)
+		h.refund(counted)
+		if limit == "rate" {
+			return "err.global.rate_limited", wait, nil
+		}
+		return "err.global.quota_exceeded", wait, nil
+	}
+	return "", 0, counted
+}
+
+// refund takes a mail back from the quota periods it has been counted in.
+func (h *Handler) refund(counted []string) {
+	for _, period := range counted {
+		if err := h.Limiter.Uncount(period); err != nil {
+			limiterErrorCount.Inc()
+			h.Logger.WithError(err).Warnf("Refunding the quota %s failed", period)
+		}
+	}
+}
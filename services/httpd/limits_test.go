@@ -0,0 +1,139 @@
+package httpd_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/httpd"
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
+)
+
+func TestMemoryLimiter_Take(t *testing.T) {
+	l := httpd.NewMemoryLimiter()
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if wait, err := l.Take("key", 0.5, 2, now); err != nil || wait != 0 {
+			t.Fatalf("unexpected wait for token %d: %s %v", i, wait, err)
+		}
+	}
+	if wait, _ := l.Take("key", 0.5, 2, now); wait != 2*time.Second {
+		t.Fatalf("unexpected wait: %s", wait)
+	}
+	if wait, _ := l.Take("other", 0.5, 2, now); wait != 0 {
+		t.Fatalf("buckets are shared between keys: %s", wait)
+	}
+	if wait, _ := l.Take("key", 0.5, 2, now.Add(2*time.Second)); wait != 0 {
+		t.Fatalf("bucket wasn't refilled: %s", wait)
+	}
+}
+
+func TestMemoryLimiter_Count(t *testing.T) {
+	l := httpd.NewMemoryLimiter()
+	now := time.Now()
+	reset := now.Add(time.Hour)
+	for i := int64(1); i <= 3; i++ {
+		if n, err := l.Count("key", reset, now); err != nil || n != i {
+			t.Fatalf("unexpected count: %d %v", n, err)
+		}
+	}
+	if err := l.Uncount("key"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := l.Count("key", reset, now); n != 3 {
+		t.Fatalf("unexpected count after uncount: %d", n)
+	}
+}
+
+func TestHandler_Limits(t *testing.T) {
+	c := httpd.NewConfig()
+	c.Limits.Enabled = true
+	c.Limits.Rules = []httpd.LimitRule{
+		{By: httpd.LimitByIP, Rate: 1, Burst: 3},
+		{By: httpd.LimitBySenderDomain, Match: []string{"Shop.Example.com"}, Daily: 1},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	h := httpd.NewHandler(*c)
+	h.Queue = queue.NewMemoryQueue(queue.NewConfig())
+	send := func(sender string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := MustNewRequest("POST", "/mail", strings.NewReader(`{"sender":{"email":"`+sender+`"},"recipient":{"email":"someguy@somedomain.com"},"subject":"test"}`))
+		req.RemoteAddr = "192.0.2.1:4711"
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send("news@shop.example.com"); w.Code != http.StatusAccepted {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+	w := send("billing@shop.example.com")
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "err.global.quota_exceeded") {
+		t.Fatalf("unexpected response: %d: %s", w.Code, w.Body.String())
+	} else if w.Header().Get("Retry-After") == "" {
+		t.Fatal("missing Retry-After")
+	}
+	if w := send("news@example.org"); w.Code != http.StatusAccepted {
+		t.Fatalf("unexpected status for unmatched domain: %d", w.Code)
+	}
+	// the mail rejected by the quota took a token as well
+	w = send("news@example.org")
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "err.global.rate_limited") {
+		t.Fatalf("unexpected response: %d: %s", w.Code, w.Body.String())
+	} else if w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("unexpected Retry-After: %q", w.Header().Get("Retry-After"))
+	}
+}
+
+// publisherFunc is an adapter to allow the use of ordinary functions as a
+// queue.Publisher.
+type publisherFunc func(msg *queue.Message) error
+
+func (f publisherFunc) Publish(msg *queue.Message) error {
+	return f(msg)
+}
+
+// Ensure mails which aren't queued don't use up any quota.
+func TestHandler_LimitsRefund(t *testing.T) {
+	c := httpd.NewConfig()
+	c.Limits.Enabled = true
+	c.Limits.Rules = []httpd.LimitRule{
+		{By: httpd.LimitByIP, Daily: 2},
+		{By: httpd.LimitBySenderDomain, Match: []string{"news.example.com"}, Daily: 1},
+	}
+	h := httpd.NewHandler(*c)
+	send := func(sender string) int {
+		w := httptest.NewRecorder()
+		req := MustNewRequest("POST", "/mail", strings.NewReader(`{"sender":{"email":"`+sender+`"},"recipient":{"email":"someguy@somedomain.com"},"subject":"test"}`))
+		req.RemoteAddr = "192.0.2.1:4711"
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	h.Queue = publisherFunc(func(msg *queue.Message) error {
+		return errors.New("queue down")
+	})
+	if code := send("shop@example.com"); code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status: %d", code)
+	}
+	h.Queue = queue.NewMemoryQueue(queue.NewConfig())
+	for i, want := range []int{
+		http.StatusAccepted,
+		// counted by the quota of the IP, but rejected by the one of the domain
+		http.StatusTooManyRequests,
+		http.StatusAccepted,
+		http.StatusTooManyRequests,
+	} {
+		sender := "weekly@news.example.com"
+		if i >= 2 {
+			sender = "shop@example.com"
+		}
+		if code := send(sender); code != want {
+			t.Fatalf("mail %d: unexpected status: %d", i, code)
+		}
+	}
+}
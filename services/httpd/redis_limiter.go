@@ -0,0 +1,108 @@
+package httpd
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// takeScript refills and takes from a token bucket atomically. It returns
+// the seconds until the next token is available, 0 if a token was taken.
+var takeScript = redis.NewScript(1, `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local tokens = tonumber(state[1]) or burst
+local updated = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - updated) * rate)
+local wait = 0
+if tokens < 1 then
+	wait = (1 - tokens) / rate
+else
+	tokens = tokens - 1
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "updated", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return tostring(wait)
+`)
+
+// uncountScript decrements a quota counter unless it has already expired.
+var uncountScript = redis.NewScript(1, `
+local n = tonumber(redis.call("GET", KEYS[1]))
+if n and n > 0 then
+	return redis.call("DECR", KEYS[1])
+end
+return 0
+`)
+
+// RedisLimiter keeps the counters in Redis, so all masters share them.
+type RedisLimiter struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+// NewRedisLimiter returns a new instance of RedisLimiter. Connections are
+// opened on first use.
+func NewRedisLimiter(c *LimitsConfig) *RedisLimiter {
+	return &RedisLimiter{
+		prefix: c.RedisKeyPrefix,
+		pool: &redis.Pool{
+			MaxIdle:     8,
+			IdleTimeout: 5 * time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", c.RedisAddress,
+					redis.DialPassword(c.RedisPassword),
+					redis.DialDatabase(c.RedisDB),
+					redis.DialConnectTimeout(time.Second),
+					redis.DialReadTimeout(time.Second),
+					redis.DialWriteTimeout(time.Second),
+				)
+			},
+		},
+	}
+}
+
+// Take takes a token from the bucket key.
+func (l *RedisLimiter) Take(key string, rate float64, burst int, now time.Time) (time.Duration, error) {
+	conn := l.pool.Get()
+	defer conn.Close()
+	seconds := float64(now.UnixNano()) / float64(time.Second)
+	reply, err := redis.String(takeScript.Do(conn, l.prefix+key, rate, burst, strconv.FormatFloat(seconds, 'f', 3, 64)))
+	if err != nil {
+		return 0, err
+	}
+	wait, err := strconv.ParseFloat(reply, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(wait * float64(time.Second)), nil
+}
+
+// Count counts a request in the quota period key.
+func (l *RedisLimiter) Count(key string, reset, now time.Time) (int64, error) {
+	conn := l.pool.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("INCR", l.prefix+key)
+	conn.Send("EXPIREAT", l.prefix+key, reset.Unix())
+	values, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+	return redis.Int64(values[0], nil)
+}
+
+// Uncount takes back a request counted in the quota period key.
+func (l *RedisLimiter) Uncount(key string) error {
+	conn := l.pool.Get()
+	defer conn.Close()
+	_, err := uncountScript.Do(conn, l.prefix+key)
+	return err
+}
+
+// Close closes all idle connections.
+func (l *RedisLimiter) Close() error {
+	return l.pool.Close()
+}
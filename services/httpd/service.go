@@ -2,6 +2,7 @@ package httpd
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"strings"
@@ -39,6 +40,17 @@ func (s *Service) Start() error {
 		return nil
 	}
 	s.Logger.Infof("Starting HTTP service")
+	if err := RegisterMetrics(); err != nil {
+		return err
+	}
+	if err := s.Handler.LoadKeys(); err != nil {
+		return fmt.Errorf("load api keys: %s", err)
+	}
+	if s.Handler.Config.AuthEnabled {
+		s.Logger.Infof("Authenticating requests with %d api keys", len(s.Handler.Keys))
+	} else {
+		s.Logger.Warn("Authentication is disabled, anyone reaching the service may send mails")
+	}
 
 	listener, err := net.Listen("tcp", s.addr)
 	if err != nil {
@@ -65,13 +77,16 @@ func (s *Service) Start() error {
 	return nil
 }
 
-// Stop closes the underlying listener.
+// Stop closes the underlying listener and the connections of the limiter.
 func (s *Service) Stop() error {
 	if s.ln != nil {
 		if err := s.ln.Close(); err != nil {
 			return err
 		}
 	}
+	if c, ok := s.Handler.Limiter.(io.Closer); ok {
+		return c.Close()
+	}
 	return nil
 }
 
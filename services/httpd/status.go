@@ -0,0 +1,101 @@
+package httpd
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/status"
+)
+
+// DefaultStatusLimit defines how many messages are listed without a limit
+const DefaultStatusLimit = 100
+
+// statusRoutes returns the routes looking up the state of queued mails.
+func (h *Handler) statusRoutes() []Route {
+	return []Route{
+		Route{
+			"mail-list",
+			"GET", "/mail", h.withStatus(h.serveListStatus),
+		},
+		Route{
+			"mail-status",
+			"GET", "/mail/:id", h.withStatus(h.serveGetStatus),
+		},
+	}
+}
+
+// withStatus rejects status requests when no status store is configured.
+func (h *Handler) withStatus(fn func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.Status == nil {
+			h.httpError(w, "err.global.status_disabled", http.StatusNotFound)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func (h *Handler) serveGetStatus(w http.ResponseWriter, r *http.Request) {
+	s, err := h.Status.Get(r.URL.Query().Get(":id"))
+	if err != nil {
+		h.statusError(w, err)
+		return
+	}
+	h.writeResults(w, http.StatusOK, s)
+}
+
+// serveListStatus lists messages, optionally filtered by state, the time
+// of their last update and limited in number.
+func (h *Handler) serveListStatus(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := status.Filter{State: status.State(q.Get("state")), Limit: DefaultStatusLimit}
+	if v := q.Get("since"); v != "" {
+		since, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			h.httpError(w, "err.global.invalid_filter", http.StatusBadRequest)
+			return
+		}
+		f.Since = since
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			h.httpError(w, "err.global.invalid_filter", http.StatusBadRequest)
+			return
+		}
+		f.Limit = limit
+	}
+	list, err := h.Status.List(f)
+	if err != nil {
+		h.statusError(w, err)
+		return
+	}
+	results := make([]interface{}, 0, len(list))
+	for _, s := range list {
+		results = append(results, s)
+	}
+	h.writeResults(w, http.StatusOK, results...)
+}
+
+// reportStatus records a state change of a mail accepted by the handler.
+func (h *Handler) reportStatus(e *status.Event) {
+	if h.Status == nil {
+		return
+	}
+	if err := h.Status.Report(e); err != nil {
+		h.Logger.WithError(err).Warnf("Could not record state %s of message %s", e.State, e.ID)
+	}
+}
+
+func (h *Handler) statusError(w http.ResponseWriter, err error) {
+	switch err {
+	case status.ErrNotFound:
+		h.httpError(w, "err.global.mail_not_found", http.StatusNotFound)
+	case status.ErrInvalidID:
+		h.httpError(w, "err.global.invalid_mail_id", http.StatusBadRequest)
+	default:
+		h.Logger.WithError(err).Error("Status store failed")
+		h.httpError(w, "err.global.internal", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,71 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
+	"github.com/nirnanaaa/cloudive-mailer/services/status"
+)
+
+func TestHandler_MailStatusDisabled(t *testing.T) {
+	httpx := CreateService(false)
+	if w := serve(httpx.Handler, "GET", "/mail/abc", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+}
+
+func TestHandler_MailStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudive-status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	httpx := CreateService(false)
+	httpx.Handler.Queue = queue.NewMemoryQueue(queue.NewConfig())
+	httpx.Handler.Status = status.NewDiskStore(&status.Config{Path: dir})
+
+	w := serve(httpx.Handler, "POST", "/mail", `{"trace_id":"trace","sender":{"email":"someguy@somedomain.com"},"recipient":{"email":"someguy@somedomain.com"},"subject":"test"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+	var accepted struct {
+		Results []struct {
+			ID string `json:"id"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &accepted); err != nil {
+		t.Fatal(err)
+	}
+	id := accepted.Results[0].ID
+
+	w = serve(httpx.Handler, "GET", "/mail/"+id, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+	var resp struct {
+		Results []status.Status `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	} else if len(resp.Results) != 1 || resp.Results[0].State != status.StateQueued || len(resp.Results[0].Events) != 2 {
+		t.Fatalf("unexpected response: %s", w.Body.String())
+	}
+
+	if w := serve(httpx.Handler, "GET", "/mail?state=queued&limit=10", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), id) {
+		t.Fatalf("unexpected list: %d: %s", w.Code, w.Body.String())
+	}
+	if w := serve(httpx.Handler, "GET", "/mail?state=delivered", ""); w.Code != http.StatusOK || strings.Contains(w.Body.String(), id) {
+		t.Fatalf("unexpected filtered list: %d: %s", w.Code, w.Body.String())
+	}
+	if w := serve(httpx.Handler, "GET", "/mail?since=yesterday", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+	if w := serve(httpx.Handler, "GET", "/mail/missing", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+}
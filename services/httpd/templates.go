@@ -0,0 +1,171 @@
+package httpd
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/templates"
+)
+
+// previewRequest is the body of a template preview.
+type previewRequest struct {
+	Version int                    `json:"version"`
+	Data    map[string]interface{} `json:"data"`
+}
+
+// templateRoutes returns the routes managing stored templates.
+func (h *Handler) templateRoutes() []Route {
+	return []Route{
+		Route{
+			"templates-list",
+			"GET", "/templates", h.withTemplates(h.serveListTemplates),
+		},
+		Route{
+			"templates-create",
+			"POST", "/templates", h.withTemplates(h.serveCreateTemplate),
+		},
+		Route{
+			"templates-get",
+			"GET", "/templates/:id", h.withTemplates(h.serveGetTemplate),
+		},
+		Route{
+			"templates-delete",
+			"DELETE", "/templates/:id", h.withTemplates(h.serveDeleteTemplate),
+		},
+		Route{
+			"templates-versions",
+			"GET", "/templates/:id/versions", h.withTemplates(h.serveTemplateVersions),
+		},
+		Route{
+			"templates-version",
+			"GET", "/templates/:id/versions/:version", h.withTemplates(h.serveGetTemplate),
+		},
+		Route{
+			"templates-preview",
+			"POST", "/templates/:id/preview", h.withTemplates(h.servePreviewTemplate),
+		},
+	}
+}
+
+// withTemplates rejects template requests when no template store is configured.
+func (h *Handler) withTemplates(fn func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.Templates == nil {
+			h.httpError(w, "err.global.templates_disabled", http.StatusNotFound)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func (h *Handler) serveListTemplates(w http.ResponseWriter, r *http.Request) {
+	list, err := h.Templates.List()
+	if err != nil {
+		h.templateError(w, err)
+		return
+	}
+	results := make([]interface{}, 0, len(list))
+	for _, t := range list {
+		results = append(results, t)
+	}
+	h.writeResults(w, http.StatusOK, results...)
+}
+
+func (h *Handler) serveCreateTemplate(w http.ResponseWriter, r *http.Request) {
+	var t templates.Template
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		h.httpError(w, "err.global.invalid_payload", http.StatusBadRequest)
+		return
+	}
+	stored, err := h.Templates.Put(&t)
+	if err != nil {
+		h.templateError(w, err)
+		return
+	}
+	h.writeResults(w, http.StatusCreated, stored)
+}
+
+func (h *Handler) serveGetTemplate(w http.ResponseWriter, r *http.Request) {
+	version, ok := h.templateVersion(w, r)
+	if !ok {
+		return
+	}
+	t, err := h.Templates.Get(r.URL.Query().Get(":id"), version)
+	if err != nil {
+		h.templateError(w, err)
+		return
+	}
+	h.writeResults(w, http.StatusOK, t)
+}
+
+func (h *Handler) serveTemplateVersions(w http.ResponseWriter, r *http.Request) {
+	versions, err := h.Templates.Versions(r.URL.Query().Get(":id"))
+	if err != nil {
+		h.templateError(w, err)
+		return
+	}
+	results := make([]interface{}, 0, len(versions))
+	for _, t := range versions {
+		results = append(results, t)
+	}
+	h.writeResults(w, http.StatusOK, results...)
+}
+
+func (h *Handler) serveDeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	if err := h.Templates.Delete(r.URL.Query().Get(":id")); err != nil {
+		h.templateError(w, err)
+		return
+	}
+	h.writeHeader(w, http.StatusNoContent)
+}
+
+// servePreviewTemplate renders a template without sending it.
+func (h *Handler) servePreviewTemplate(w http.ResponseWriter, r *http.Request) {
+	var req previewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.httpError(w, "err.global.invalid_payload", http.StatusBadRequest)
+		return
+	}
+	t, err := h.Templates.Get(r.URL.Query().Get(":id"), req.Version)
+	if err != nil {
+		h.templateError(w, err)
+		return
+	}
+	rendered, err := t.Render(req.Data)
+	if err != nil {
+		h.httpError(w, "err.global.template_render_failed", http.StatusBadRequest)
+		return
+	}
+	h.writeResults(w, http.StatusOK, rendered)
+}
+
+// templateVersion parses the optional version of the request path.
+func (h *Handler) templateVersion(w http.ResponseWriter, r *http.Request) (int, bool) {
+	v := r.URL.Query().Get(":version")
+	if v == "" {
+		return 0, true
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil || version < 1 {
+		h.httpError(w, "err.global.invalid_template_version", http.StatusBadRequest)
+		return 0, false
+	}
+	return version, true
+}
+
+func (h *Handler) templateError(w http.ResponseWriter, err error) {
+	switch err {
+	case templates.ErrNotFound:
+		h.httpError(w, "err.global.template_not_found", http.StatusNotFound)
+	case templates.ErrInvalidID:
+		h.httpError(w, "err.global.invalid_template_id", http.StatusBadRequest)
+	default:
+		if _, ok := err.(templates.ParseError); ok {
+			h.httpError(w, "err.global.invalid_template", http.StatusBadRequest)
+			return
+		}
+		h.Logger.WithError(err).Error("Template store failed")
+		h.httpError(w, "err.global.internal", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,69 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/httpd"
+	"github.com/nirnanaaa/cloudive-mailer/services/templates"
+)
+
+func serve(h *httpd.Handler, method, url, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest(method, url, strings.NewReader(body)))
+	return w
+}
+
+func TestHandler_TemplatesDisabled(t *testing.T) {
+	httpx := CreateService(false)
+	if w := serve(httpx.Handler, "GET", "/templates", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+}
+
+func TestHandler_Templates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudive-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	httpx := CreateService(false)
+	httpx.Handler.Templates = templates.NewDiskStore(&templates.Config{Path: dir})
+
+	w := serve(httpx.Handler, "POST", "/templates", `{"id":"welcome","subject":"Hi {{.name}}","html":"<b>{{.name}}</b>"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("unexpected status: %d: %s", w.Code, w.Body.String())
+	}
+	if w := serve(httpx.Handler, "POST", "/templates", `{"id":"broken","html":"{{.name"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+	if w := serve(httpx.Handler, "GET", "/templates/welcome/versions/1", ""); w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+	if w := serve(httpx.Handler, "GET", "/templates/missing", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+
+	w = serve(httpx.Handler, "POST", "/templates/welcome/preview", `{"data":{"name":"Tom"}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Results []templates.Rendered `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != 1 || resp.Results[0].Subject != "Hi Tom" || resp.Results[0].HTML != "<b>Tom</b>" {
+		t.Fatalf("unexpected preview: %s", w.Body.String())
+	}
+
+	if w := serve(httpx.Handler, "DELETE", "/templates/welcome", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+}
@@ -0,0 +1,99 @@
+package httpd
+
+import (
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/kafka/event"
+)
+
+// MailPartName is the name of the form field with the JSON of the mail in
+// multipart requests.
+const MailPartName = "mail"
+
+// isMultipart returns true if the request is sent as multipart/form-data.
+func isMultipart(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// tooLarge returns true if err was returned for a body over the limit of
+// http.MaxBytesReader.
+func tooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "request body too large")
+}
+
+// readMultipart reads a mail sent as multipart/form-data with the JSON of
+// the mail in the form field "mail" and files in any other fields. The
+// files are stored in the blob store right away and attached once the mail
+// is valid. On failure, the status code and the error code are returned.
+func (h *Handler) readMultipart(w http.ResponseWriter, r *http.Request) (*mailRequest, int, string) {
+	if h.Blobs == nil {
+		return nil, http.StatusUnsupportedMediaType, "err.global.uploads_disabled"
+	}
+	if h.Config.MaxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, h.Config.MaxUploadSize)
+	}
+	req := &mailRequest{}
+	fail := func(code int, errCode string) (*mailRequest, int, string) {
+		h.deleteUploads(req.uploads)
+		return nil, code, errCode
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return fail(http.StatusBadRequest, "err.global.invalid_payload")
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if tooLarge(err) {
+			return fail(http.StatusRequestEntityTooLarge, "err.global.payload_too_large")
+		} else if err != nil {
+			return fail(http.StatusBadRequest, "err.global.invalid_payload")
+		}
+		if part.FileName() == "" {
+			if part.FormName() != MailPartName {
+				continue
+			}
+			if req.body, err = ioutil.ReadAll(part); tooLarge(err) {
+				return fail(http.StatusRequestEntityTooLarge, "err.global.payload_too_large")
+			} else if err != nil {
+				return fail(http.StatusBadRequest, "err.global.invalid_payload")
+			}
+			continue
+		}
+		hash := sha256.New()
+		id, _, err := h.Blobs.Put(io.TeeReader(part, hash))
+		if tooLarge(err) {
+			return fail(http.StatusRequestEntityTooLarge, "err.global.payload_too_large")
+		} else if err != nil {
+			h.Logger.WithError(err).Error("Storing an upload failed")
+			return fail(http.StatusInternalServerError, "err.global.upload_failed")
+		}
+		req.uploads = append(req.uploads, event.Attachment{
+			Name:        filepath.Base(part.FileName()),
+			Blob:        id,
+			ContentType: part.Header.Get("Content-Type"),
+		})
+		req.fingerprint = append(req.fingerprint, hash.Sum(nil)...)
+	}
+	if req.body == nil {
+		return fail(http.StatusBadRequest, "err.global.invalid_payload")
+	}
+	return req, 0, ""
+}
+
+// deleteUploads removes uploads which won't be sent.
+func (h *Handler) deleteUploads(uploads []event.Attachment) {
+	for _, a := range uploads {
+		if err := h.Blobs.Delete(a.Blob); err != nil {
+			h.Logger.WithError(err).Warnf("Removing upload %s failed", a.Blob)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package httpd_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"testing"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/blobs"
+	"github.com/nirnanaaa/cloudive-mailer/services/httpd"
+	"github.com/nirnanaaa/cloudive-mailer/services/kafka/event"
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
+)
+
+// serveUpload posts mail and files as multipart/form-data.
+func serveUpload(h *httpd.Handler, mail string, files map[string]string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField(httpd.MailPartName, mail)
+	for name, content := range files {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", `form-data; name="file"; filename="`+name+`"`)
+		header.Set("Content-Type", "text/plain")
+		part, _ := mw.CreatePart(header)
+		part.Write([]byte(content))
+	}
+	mw.Close()
+	req := MustNewRequest("POST", "/mail", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func newBlobStore(t *testing.T) *blobs.DiskStore {
+	dir, err := ioutil.TempDir("", "cloudive-blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := blobs.NewConfig()
+	c.Path = dir
+	return blobs.NewDiskStore(c)
+}
+
+const uploadMail = `{"sender":{"email":"someguy@somedomain.com"},"recipient":{"email":"one@example.com"},"subject":"report"}`
+
+func TestHandler_Upload(t *testing.T) {
+	store := newBlobStore(t)
+	defer os.RemoveAll(store.Config.Path)
+	q := queue.NewMemoryQueue(queue.NewConfig())
+	h := httpd.NewHandler(*httpd.NewConfig())
+	h.Queue = q
+	h.Blobs = store
+
+	w := serveUpload(h, uploadMail, map[string]string{"report.txt": "all good"})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("unexpected status: %d: %s", w.Code, w.Body.String())
+	}
+	attachments := make(chan []event.Attachment, 1)
+	q.Consume(queue.HandlerFunc(func(msg *queue.Message) error {
+		evt, err := event.DecodeIncomingEvent(msg.Value)
+		if err != nil {
+			return err
+		}
+		attachments <- evt.Attachments
+		return nil
+	}))
+	if err := q.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Stop()
+	got := <-attachments
+	if len(got) != 1 || got[0].Name != "report.txt" || got[0].ContentType != "text/plain" || got[0].URL != "" {
+		t.Fatalf("unexpected attachments: %+v", got)
+	}
+	r, err := store.Open(got[0].Blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if data, _ := ioutil.ReadAll(r); string(data) != "all good" {
+		t.Fatalf("unexpected content: %q", data)
+	}
+}
+
+func TestHandler_UploadRejected(t *testing.T) {
+	store := newBlobStore(t)
+	defer os.RemoveAll(store.Config.Path)
+	c := httpd.NewConfig()
+	c.MaxUploadSize = 1024
+	h := httpd.NewHandler(*c)
+	h.Queue = queue.NewMemoryQueue(queue.NewConfig())
+
+	// uploads need a blob store
+	if w := serveUpload(h, uploadMail, nil); w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("unexpected status: %d: %s", w.Code, w.Body.String())
+	}
+	h.Blobs = store
+
+	if w := serveUpload(h, uploadMail, map[string]string{"big.txt": string(make([]byte, 2048))}); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("unexpected status: %d: %s", w.Code, w.Body.String())
+	}
+	if w := serveUpload(h, `{"sender":{"email":"invalid"}}`, map[string]string{"report.txt": "all good"}); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("unexpected status: %d: %s", w.Code, w.Body.String())
+	}
+	// uploads of rejected mails are removed right away
+	if files, err := ioutil.ReadDir(store.Config.Path); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 0 {
+		t.Fatalf("unexpected files: %d", len(files))
+	}
+}
@@ -0,0 +1,215 @@
+package httpd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/kafka/event"
+)
+
+// Error codes of invalid fields.
+const (
+	ErrFieldRequired       = "err.field.required"
+	ErrFieldUnknown        = "err.field.unknown"
+	ErrFieldInvalidAddress = "err.field.invalid_address"
+	ErrFieldTooLong        = "err.field.too_long"
+	ErrFieldTooLarge       = "err.field.too_large"
+	ErrFieldInvalidURL     = "err.field.invalid_url"
+	ErrFieldInvalidValue   = "err.field.invalid_value"
+)
+
+// FieldError describes why a field of a request is invalid. Fields are
+// named by their JSON path, like to[1].email.
+type FieldError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+// validateMail returns the errors of all invalid fields of a mail. body is
+// the JSON msg was decoded from, it is checked for unknown fields.
+func (h *Handler) validateMail(body []byte, msg *event.InboundEmailEvent) []FieldError {
+	errs := unknownFields(body, reflect.TypeOf(*msg), "")
+	add := func(field, code string) {
+		errs = append(errs, FieldError{Field: field, Error: code})
+	}
+
+	validateContact := func(field string, c event.Contact, required bool) {
+		if c.Email == "" {
+			if required {
+				add(field+".email", ErrFieldRequired)
+			}
+			return
+		}
+		if !validAddress(c.Email) {
+			add(field+".email", ErrFieldInvalidAddress)
+		}
+	}
+	validateContact("sender", msg.Sender, true)
+	validateContact("recipient", msg.Recipient, false)
+	for _, list := range []struct {
+		name     string
+		contacts []event.Contact
+	}{{"to", msg.To}, {"cc", msg.Cc}, {"bcc", msg.Bcc}} {
+		for i, c := range list.contacts {
+			validateContact(fmt.Sprintf("%s[%d]", list.name, i), c, true)
+		}
+	}
+	if len(msg.EnvelopeRecipients()) == 0 {
+		add("recipient.email", ErrFieldRequired)
+	}
+
+	// templated mails get their subject and body from the template
+	if msg.TemplateID == "" && strings.TrimSpace(msg.Subject) == "" {
+		add("subject", ErrFieldRequired)
+	}
+	if max := h.Config.MaxSubjectLength; max > 0 && utf8.RuneCountInString(msg.Subject) > max {
+		add("subject", ErrFieldTooLong)
+	}
+	if max := h.Config.MaxBodySize; max > 0 && int64(len(msg.HTML)+len(msg.Text)+len(msg.Payload)) > max {
+		add("body", ErrFieldTooLarge)
+	}
+	if msg.TemplateVersion < 0 {
+		add("template_version", ErrFieldInvalidValue)
+	}
+	for i, a := range msg.Attachments {
+		field := fmt.Sprintf("attachments[%d]", i)
+		// blobs are only referenced by the gateway itself
+		if a.Blob != "" {
+			add(field+".blob", ErrFieldInvalidValue)
+		}
+		switch {
+		case a.URL == "":
+			add(field+".url", ErrFieldRequired)
+		case event.IsDataURI(a.URL):
+			if _, _, err := event.DecodeDataURI(a.URL); err != nil {
+				add(field+".url", ErrFieldInvalidURL)
+			} else if max := h.Config.MaxBodySize; max > 0 && int64(len(a.URL)) > max {
+				add(field+".url", ErrFieldTooLarge)
+			}
+		case !h.validAttachmentURL(a.URL):
+			add(field+".url", ErrFieldInvalidURL)
+		}
+		if a.ContentID != "" && (!a.Inline || !validContentID(a.ContentID)) {
+			add(field+".content_id", ErrFieldInvalidValue)
+		} else if a.Inline && a.CID() == "" {
+			add(field+".content_id", ErrFieldRequired)
+		}
+	}
+	return errs
+}
+
+// validAddress returns true if address is a bare RFC 5322 addr-spec.
+func validAddress(address string) bool {
+	parsed, err := mail.ParseAddress(address)
+	return err == nil && parsed.Address == address
+}
+
+// validContentID returns true if id can be used in a Content-ID header and
+// referenced by a cid: URL.
+func validContentID(id string) bool {
+	return !strings.ContainsAny(id, "<>\"\\ \t\r\n")
+}
+
+// validAttachmentURL returns true if attachments can be downloaded from u
+// with one of the allowed schemes.
+func (h *Handler) validAttachmentURL(u string) bool {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Host == "" {
+		return false
+	}
+	for _, scheme := range h.Config.AttachmentSchemes {
+		if strings.EqualFold(parsed.Scheme, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// unknownFields returns an error for every member of the JSON object in
+// data which doesn't belong to a field of t. Nested objects and arrays of
+// objects are checked as well.
+func unknownFields(data []byte, t reflect.Type, prefix string) []FieldError {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return unknownFields(data, t.Elem(), prefix)
+	case reflect.Slice:
+		var items []json.RawMessage
+		if t.Elem().Kind() == reflect.Uint8 || json.Unmarshal(data, &items) != nil {
+			return nil
+		}
+		var errs []FieldError
+		for i, item := range items {
+			errs = append(errs, unknownFields(item, t.Elem(), fmt.Sprintf("%s[%d]", prefix, i))...)
+		}
+		return errs
+	case reflect.Struct:
+	default:
+		return nil
+	}
+	var members map[string]json.RawMessage
+	if json.Unmarshal(data, &members) != nil {
+		return nil
+	}
+	names := make([]string, 0, len(members))
+	for name := range members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []FieldError
+	for _, name := range names {
+		value := members[name]
+		field := name
+		if prefix != "" {
+			field = prefix + "." + name
+		}
+		f, ok := jsonField(t, name)
+		if !ok {
+			errs = append(errs, FieldError{Field: field, Error: ErrFieldUnknown})
+			continue
+		}
+		errs = append(errs, unknownFields(value, f.Type, field)...)
+	}
+	return errs
+}
+
+// jsonField returns the field of t decoded from the member name, matching
+// names case-insensitively like encoding/json does.
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+		if tag == "" {
+			tag = f.Name
+		}
+		if strings.EqualFold(tag, name) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// validationError answers with 422 and the errors of all invalid fields.
+func (h *Handler) validationError(w http.ResponseWriter, errs []FieldError) {
+	results := make([]interface{}, len(errs))
+	for i := range errs {
+		results[i] = errs[i]
+	}
+	if rw, ok := w.(ResponseWriter); ok {
+		h.writeHeader(w, http.StatusUnprocessableEntity)
+		rw.WriteResponse(Response{Results: results, Err: errors.New("err.global.validation_failed")})
+	}
+}
@@ -0,0 +1,96 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/httpd"
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
+)
+
+func TestHandler_MailValidation(t *testing.T) {
+	c := httpd.NewConfig()
+	c.MaxSubjectLength = 10
+	h := httpd.NewHandler(*c)
+	q := queue.NewMemoryQueue(queue.NewConfig())
+	h.Queue = q
+
+	for name, tt := range map[string]struct {
+		body string
+		errs []httpd.FieldError
+	}{
+		"empty": {`{}`, []httpd.FieldError{
+			{Field: "sender.email", Error: httpd.ErrFieldRequired},
+			{Field: "recipient.email", Error: httpd.ErrFieldRequired},
+			{Field: "subject", Error: httpd.ErrFieldRequired},
+		}},
+		"addresses": {`{"sender":{"email":"Some Guy <someguy@somedomain.com>"},"recipient":{"email":"someguy"},"cc":[{"email":"colleague@somedomain.com"},{"name":"nobody"}],"subject":"test"}`, []httpd.FieldError{
+			{Field: "sender.email", Error: httpd.ErrFieldInvalidAddress},
+			{Field: "recipient.email", Error: httpd.ErrFieldInvalidAddress},
+			{Field: "cc[1].email", Error: httpd.ErrFieldRequired},
+		}},
+		"unknown fields": {`{"sender":{"email":"someguy@somedomain.com","adress":"x"},"recipient":{"email":"someguy@somedomain.com"},"subject":"test","reply_to":"x","attachments":[{"url":"https://example.com/a.pdf","size":1}]}`, []httpd.FieldError{
+			{Field: "attachments[0].size", Error: httpd.ErrFieldUnknown},
+			{Field: "reply_to", Error: httpd.ErrFieldUnknown},
+			{Field: "sender.adress", Error: httpd.ErrFieldUnknown},
+		}},
+		"limits": {`{"sender":{"email":"someguy@somedomain.com"},"recipient":{"email":"someguy@somedomain.com"},"subject":"a long subject","attachments":[{"url":"file:///etc/passwd"},{"name":"empty"}]}`, []httpd.FieldError{
+			{Field: "subject", Error: httpd.ErrFieldTooLong},
+			{Field: "attachments[0].url", Error: httpd.ErrFieldInvalidURL},
+			{Field: "attachments[1].url", Error: httpd.ErrFieldRequired},
+		}},
+		"inline": {`{"sender":{"email":"someguy@somedomain.com"},"recipient":{"email":"someguy@somedomain.com"},"subject":"test","attachments":[{"url":"data:image/png;base64,!!","inline":true,"content_id":"logo"},{"url":"https://example.com/a.png","content_id":"a"},{"url":"data:,x","inline":true}]}`, []httpd.FieldError{
+			{Field: "attachments[0].url", Error: httpd.ErrFieldInvalidURL},
+			{Field: "attachments[1].content_id", Error: httpd.ErrFieldInvalidValue},
+			{Field: "attachments[2].content_id", Error: httpd.ErrFieldRequired},
+		}},
+	} {
+		w := serve(h, "POST", "/mail", tt.body)
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("%s: unexpected status: %d", name, w.Code)
+		}
+		var resp struct {
+			Results []httpd.FieldError `json:"results"`
+			Error   string             `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		} else if resp.Error != "err.global.validation_failed" {
+			t.Fatalf("%s: unexpected error: %s", name, resp.Error)
+		} else if !reflect.DeepEqual(resp.Results, tt.errs) {
+			t.Fatalf("%s: unexpected field errors: %+v", name, resp.Results)
+		}
+	}
+
+	// templates provide the subject
+	body := `{"sender":{"email":"someguy@somedomain.com"},"to":[{"name":"Some Guy","email":"someguy@somedomain.com"}],"template_id":"welcome","data":{"any":{"thing":1}}}`
+	if w := serve(h, "POST", "/mail", body); w.Code != http.StatusAccepted {
+		t.Fatalf("unexpected status: %d: %s", w.Code, w.Body.String())
+	}
+	if w := serve(h, "POST", "/mail", strings.Replace(body, `"to"`, `"TO"`, 1)); w.Code != http.StatusAccepted {
+		t.Fatalf("field names must match case-insensitively: %d: %s", w.Code, w.Body.String())
+	}
+	if q.Len() != 2 {
+		t.Fatalf("unexpected queue length: %d", q.Len())
+	}
+}
+
+func TestHandler_RequestTooLarge(t *testing.T) {
+	c := httpd.NewConfig()
+	c.MaxRequestSize = 1024
+	h := httpd.NewHandler(*c)
+	q := queue.NewMemoryQueue(queue.NewConfig())
+	h.Queue = q
+
+	body := `{"sender":{"email":"someguy@somedomain.com"},"recipient":{"email":"someguy@somedomain.com"},"subject":"test","text":"` + strings.Repeat("x", 1024) + `"}`
+	if w := serve(h, "POST", "/mail", body); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("unexpected status: %d", w.Code)
+	} else if !strings.Contains(w.Body.String(), "err.global.payload_too_large") {
+		t.Fatalf("unexpected response: %s", w.Body.String())
+	} else if q.Len() != 0 {
+		t.Fatalf("unexpected queue length: %d", q.Len())
+	}
+}
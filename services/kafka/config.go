@@ -1,5 +1,13 @@
 package kafka
 
+import (
+	"fmt"
+	"time"
+
+	itoml "github.com/influxdata/influxdb/toml"
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
+)
+
 const (
 	// DefaultBroker defines the default broker for kafka
 	DefaultBroker = "localhost:9092"
@@ -12,6 +20,16 @@ const (
 
 	// DefaultGroupName defines a group name for processing
 	DefaultGroupName = "mail-processor-name"
+
+	// DefaultDeadLetterQueue defines where undeliverable messages are moved to
+	DefaultDeadLetterQueue = "mail-dead-letter"
+
+	// DefaultStatusQueue defines where workers report message state changes to
+	DefaultStatusQueue = "mail-status"
+
+	// DefaultSessionTimeout defines after which time a silent worker is
+	// removed from the consumer group
+	DefaultSessionTimeout = 30 * time.Second
 )
 
 // Config represents a configuration for a Kafka service.
@@ -20,6 +38,25 @@ type Config struct {
 	InboundQueueName  string   `toml:"inbound-queue"`
 	OutboundQueueName string   `toml:"outbound-queue"`
 	GroupName         string   `toml:"group"`
+	DeadLetterQueue   string   `toml:"dead-letter-queue"`
+	StatusQueue       string   `toml:"status-queue"`
+	// StatusGroup is the name the status queue is consumed with. Every
+	// master keeps its own status store and needs all state changes, so
+	// it must not be shared. It defaults to <group>-status-<hostname>.
+	StatusGroup string `toml:"status-group"`
+
+	// WaitForAck makes Publish wait until the broker acknowledged the
+	// message, so mails are never lost after they were accepted.
+	WaitForAck bool `toml:"wait-for-ack"`
+
+	// SessionTimeout defines after which time the partitions of a worker
+	// that stopped sending heartbeats are handed over to the other workers.
+	SessionTimeout itoml.Duration `toml:"session-timeout"`
+
+	// RetryDelays defines one retry topic per delay, named after the
+	// inbound queue, like mail-worker-queue-retry-10m.
+	RetryDelays []itoml.Duration `toml:"retry-delays"`
+	RetryJitter float64          `toml:"retry-jitter"`
 }
 
 // NewConfig returns a new Config with default settings.
@@ -29,5 +66,21 @@ func NewConfig() *Config {
 		InboundQueueName:  DefaultInboundQueue,
 		OutboundQueueName: DefaultOutboundQueue,
 		GroupName:         DefaultGroupName,
+		DeadLetterQueue:   DefaultDeadLetterQueue,
+		StatusQueue:       DefaultStatusQueue,
+		SessionTimeout:    itoml.Duration(DefaultSessionTimeout),
+		RetryDelays:       queue.DefaultRetryDelayDurations(),
+		RetryJitter:       queue.DefaultRetryJitter,
+	}
+}
+
+// Validate returns an error if the config is invalid.
+func (c *Config) Validate() error {
+	if len(c.Brokers) == 0 {
+		return fmt.Errorf("at least one kafka broker is required")
+	}
+	if time.Duration(c.SessionTimeout) < time.Second {
+		return fmt.Errorf("kafka session-timeout must be at least 1s")
 	}
+	return queue.NewRetrySchedule(c.RetryDelays, c.RetryJitter).Validate()
 }
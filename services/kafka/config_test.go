@@ -2,6 +2,7 @@ package kafka_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/nirnanaaa/cloudive-mailer/services/kafka"
@@ -15,6 +16,13 @@ func TestConfig_Parse(t *testing.T) {
 		inbound-queue = "s3notifications"
 		outbound-queue = "thumb-worker-queue"
 		group = "s3-brokers"
+		dead-letter-queue = "dlq"
+		status-queue = "status"
+		status-group = "status-master-1"
+		retry-delays = ["1m", "1h"]
+		retry-jitter = 0.5
+		session-timeout = "10s"
+		wait-for-ack = true
 `, &c); err != nil {
 		t.Fatal(err)
 	}
@@ -28,5 +36,21 @@ func TestConfig_Parse(t *testing.T) {
 		t.Fatalf("unexpected outbound queue name: %s", c.OutboundQueueName)
 	} else if c.GroupName != "s3-brokers" {
 		t.Fatalf("unexpected group name: %s", c.GroupName)
+	} else if c.DeadLetterQueue != "dlq" {
+		t.Fatalf("unexpected dead letter queue: %s", c.DeadLetterQueue)
+	} else if c.StatusQueue != "status" {
+		t.Fatalf("unexpected status queue: %s", c.StatusQueue)
+	} else if c.StatusGroup != "status-master-1" {
+		t.Fatalf("unexpected status group: %s", c.StatusGroup)
+	} else if len(c.RetryDelays) != 2 || time.Duration(c.RetryDelays[1]) != time.Hour {
+		t.Fatalf("unexpected retry delays: %v", c.RetryDelays)
+	} else if c.RetryJitter != 0.5 {
+		t.Fatalf("unexpected retry jitter: %f", c.RetryJitter)
+	} else if time.Duration(c.SessionTimeout) != 10*time.Second {
+		t.Fatalf("unexpected session timeout: %s", c.SessionTimeout)
+	} else if !c.WaitForAck {
+		t.Fatal("expected wait for ack to be enabled")
+	} else if err := c.Validate(); err != nil {
+		t.Fatal(err)
 	}
 }
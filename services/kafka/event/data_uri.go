@@ -0,0 +1,60 @@
+package event
+
+import (
+	"encoding/base64"
+	"errors"
+	"mime"
+	"net/url"
+	"strings"
+)
+
+// ErrInvalidDataURI is returned for data: URIs which can't be decoded.
+var ErrInvalidDataURI = errors.New("invalid data URI")
+
+// IsDataURI returns true if u is a data: URI.
+func IsDataURI(u string) bool {
+	return len(u) >= 5 && strings.EqualFold(u[:5], "data:")
+}
+
+// DecodeDataURI returns the media type and the content of a data: URI as
+// described in RFC 2397. The media type is empty if the URI doesn't name
+// one.
+func DecodeDataURI(u string) (string, []byte, error) {
+	if !IsDataURI(u) {
+		return "", nil, ErrInvalidDataURI
+	}
+	comma := strings.IndexByte(u, ',')
+	if comma < 0 {
+		return "", nil, ErrInvalidDataURI
+	}
+	meta, content := u[5:comma], u[comma+1:]
+	encoded := false
+	if strings.HasSuffix(strings.ToLower(meta), ";base64") {
+		encoded = true
+		meta = meta[:len(meta)-len(";base64")]
+	}
+	mediaType := ""
+	if meta != "" {
+		if strings.HasPrefix(meta, ";") {
+			// parameters without a type, like ;charset=utf-8
+			meta = "text/plain" + meta
+		}
+		t, params, err := mime.ParseMediaType(meta)
+		if err != nil {
+			return "", nil, ErrInvalidDataURI
+		}
+		mediaType = mime.FormatMediaType(t, params)
+	}
+	if encoded {
+		data, err := base64.StdEncoding.DecodeString(content)
+		if err != nil {
+			return "", nil, ErrInvalidDataURI
+		}
+		return mediaType, data, nil
+	}
+	data, err := url.PathUnescape(content)
+	if err != nil {
+		return "", nil, ErrInvalidDataURI
+	}
+	return mediaType, []byte(data), nil
+}
@@ -0,0 +1,32 @@
+package event_test
+
+import (
+	"testing"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/kafka/event"
+)
+
+func TestDecodeDataURI(t *testing.T) {
+	for _, tt := range []struct {
+		uri       string
+		mediaType string
+		data      string
+	}{
+		{"data:image/png;base64,aGVsbG8=", "image/png", "hello"},
+		{"DATA:text/plain;charset=utf-8,hello%20world", "text/plain; charset=utf-8", "hello world"},
+		{"data:;charset=utf-8,hi", "text/plain; charset=utf-8", "hi"},
+		{"data:,plain", "", "plain"},
+	} {
+		mediaType, data, err := event.DecodeDataURI(tt.uri)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.uri, err)
+		} else if mediaType != tt.mediaType || string(data) != tt.data {
+			t.Fatalf("%s: unexpected result: %q %q", tt.uri, mediaType, data)
+		}
+	}
+	for _, uri := range []string{"https://example.com/a.png", "data:image/png;base64", "data:image/png;base64,!!"} {
+		if _, _, err := event.DecodeDataURI(uri); err != event.ErrInvalidDataURI {
+			t.Fatalf("%s: unexpected error: %v", uri, err)
+		}
+	}
+}
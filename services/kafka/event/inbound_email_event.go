@@ -1,10 +1,31 @@
 package event
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"strings"
+)
 
+// Attachment references a file, which is downloaded by the worker. Files
+// uploaded with the mail are referenced by the ID of their Blob instead of
+// a URL, small files may be given as data: URI.
 type Attachment struct {
-	Name string `json:"name"`
-	URL  string `json:"url"`
+	Name        string `json:"name"`
+	URL         string `json:"url,omitempty"`
+	Blob        string `json:"blob,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	// Inline attachments are embedded into the message, so the HTML body
+	// can reference them as cid:<ContentID>.
+	Inline    bool   `json:"inline,omitempty"`
+	ContentID string `json:"content_id,omitempty"`
+}
+
+// CID returns the content ID of an inline attachment, which defaults to
+// its name.
+func (a Attachment) CID() string {
+	if a.ContentID != "" {
+		return a.ContentID
+	}
+	return a.Name
 }
 
 // Contact defines either a recipient or sender
@@ -17,17 +38,78 @@ type Contact struct {
 // InboundEmailEvent is used to fanin from kafka or HTTP.
 type InboundEmailEvent struct {
 	// For tracing with zipkin or jaeger
-	TraceID   string  `json:"trace_id,omitempty"`
-	Recipient Contact `json:"recipient"`
-	Sender    Contact `json:"sender"`
+	TraceID string `json:"trace_id,omitempty"`
+	// Recipient is the single recipient of the first API version and is
+	// treated like an additional entry of To.
+	Recipient Contact   `json:"recipient"`
+	To        []Contact `json:"to,omitempty"`
+	Cc        []Contact `json:"cc,omitempty"`
+	Bcc       []Contact `json:"bcc,omitempty"`
+	Sender    Contact   `json:"sender"`
 
 	Subject string `json:"subject"`
+	// Payload is the base64 encoded HTML body of the first API version.
+	// It is only used when HTML is empty.
 	Payload []byte `json:"payload"`
+	// Text and HTML are sent as multipart/alternative. When only HTML is
+	// given, the text part is generated from it.
+	Text string `json:"text,omitempty"`
+	HTML string `json:"html,omitempty"`
+
+	// TemplateID references a stored template, which is rendered with Data
+	// by the worker and replaces subject and bodies. TemplateVersion 0 uses
+	// the latest version.
+	TemplateID      string                 `json:"template_id,omitempty"`
+	TemplateVersion int                    `json:"template_version,omitempty"`
+	Data            map[string]interface{} `json:"data,omitempty"`
+
+	// Tags and Tenant route the mail to relays. The gateway sets the tenant
+	// to the name of the authenticated caller.
+	Tags   []string `json:"tags,omitempty"`
+	Tenant string   `json:"tenant,omitempty"`
 
 	// Just the download references. not sending high volume data.
 	Attachments []Attachment `json:"attachments"`
 }
 
+// ToContacts returns all recipients of the To header.
+func (evt *InboundEmailEvent) ToContacts() []Contact {
+	var contacts []Contact
+	if evt.Recipient.Email != "" {
+		contacts = append(contacts, evt.Recipient)
+	}
+	return append(contacts, evt.To...)
+}
+
+// EnvelopeRecipients returns the addresses of all To, Cc and Bcc recipients,
+// each address only once.
+func (evt *InboundEmailEvent) EnvelopeRecipients() []string {
+	var addrs []string
+	seen := map[string]bool{}
+	for _, list := range [][]Contact{evt.ToContacts(), evt.Cc, evt.Bcc} {
+		for _, contact := range list {
+			key := strings.ToLower(contact.Email)
+			if contact.Email == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			addrs = append(addrs, contact.Email)
+		}
+	}
+	return addrs
+}
+
+// RecipientDomain returns the lower cased domain of the first envelope
+// recipient.
+func (evt *InboundEmailEvent) RecipientDomain() string {
+	recipients := evt.EnvelopeRecipients()
+	if len(recipients) == 0 {
+		return ""
+	}
+	at := strings.LastIndex(recipients[0], "@")
+	return strings.ToLower(recipients[0][at+1:])
+}
+
 // EncodeOutgoingEvent encodes an outgoing kafka event
 func EncodeOutgoingEvent(evt *InboundEmailEvent) ([]byte, error) {
 	data, err := json.Marshal(evt)
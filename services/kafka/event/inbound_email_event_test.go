@@ -30,3 +30,22 @@ func TestS3_Decoding(t *testing.T) {
 		t.Fatalf("Failed to match encoding output, got %v, expected %s", s, expectedOutput)
 	}
 }
+
+func TestS3_EnvelopeRecipients(t *testing.T) {
+	c := event.InboundEmailEvent{
+		Recipient: event.Contact{Email: "legacy@example.com"},
+		To:        []event.Contact{{Email: "to@example.com"}, {Email: "LEGACY@example.com"}},
+		Cc:        []event.Contact{{Email: "cc@example.com"}},
+		Bcc:       []event.Contact{{Email: "bcc@example.com"}, {Email: "cc@example.com"}},
+	}
+	expected := []string{"legacy@example.com", "to@example.com", "cc@example.com", "bcc@example.com"}
+	got := c.EnvelopeRecipients()
+	if len(got) != len(expected) {
+		t.Fatalf("unexpected recipients: %v", got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("unexpected recipients: %v, expected %v", got, expected)
+		}
+	}
+}
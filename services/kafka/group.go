@@ -0,0 +1,213 @@
+package kafka
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// groupProtocol is the partition assignment strategy of all group members.
+const groupProtocol = "range"
+
+// Assignment maps topics to the partitions consumed by a group member.
+type Assignment map[string][]int32
+
+// groupMember takes part in a kafka consumer group, so the partitions of
+// the topics are shared between all running workers and handed over when a
+// worker joins or leaves.
+//
+// The group only coordinates partition ownership. Offsets are committed by
+// kasper under its topic processor names, as kasper doesn't know about group
+// generations.
+type groupMember struct {
+	client         sarama.Client
+	group          string
+	topics         []string
+	sessionTimeout time.Duration
+
+	memberID   string
+	generation int32
+}
+
+func newGroupMember(client sarama.Client, group string, topics []string, sessionTimeout time.Duration) *groupMember {
+	return &groupMember{
+		client:         client,
+		group:          group,
+		topics:         topics,
+		sessionTimeout: sessionTimeout,
+	}
+}
+
+// join joins the group and returns the partitions assigned to this member.
+// The group leader assigns the partitions of all members.
+func (g *groupMember) join() (Assignment, error) {
+	broker, err := g.coordinator()
+	if err != nil {
+		return nil, err
+	}
+	req := &sarama.JoinGroupRequest{
+		GroupId:        g.group,
+		MemberId:       g.memberID,
+		SessionTimeout: int32(g.sessionTimeout / time.Millisecond),
+		ProtocolType:   "consumer",
+	}
+	if err := req.AddGroupProtocolMetadata(groupProtocol, &sarama.ConsumerGroupMemberMetadata{Topics: g.topics}); err != nil {
+		return nil, err
+	}
+	resp, err := broker.JoinGroup(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Err != sarama.ErrNoError {
+		if resp.Err == sarama.ErrUnknownMemberId {
+			g.memberID = ""
+		}
+		return nil, resp.Err
+	}
+	g.memberID = resp.MemberId
+	g.generation = resp.GenerationId
+
+	sync := &sarama.SyncGroupRequest{
+		GroupId:      g.group,
+		GenerationId: g.generation,
+		MemberId:     g.memberID,
+	}
+	if resp.LeaderId == resp.MemberId {
+		members, err := resp.GetMembers()
+		if err != nil {
+			return nil, err
+		}
+		assignments, err := g.assign(members)
+		if err != nil {
+			return nil, err
+		}
+		for memberID, topics := range assignments {
+			if err := sync.AddGroupAssignmentMember(memberID, &sarama.ConsumerGroupMemberAssignment{Topics: topics}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	syncResp, err := broker.SyncGroup(sync)
+	if err != nil {
+		return nil, err
+	}
+	if syncResp.Err != sarama.ErrNoError {
+		return nil, syncResp.Err
+	}
+	assignment, err := syncResp.GetMemberAssignment()
+	if err != nil {
+		return nil, err
+	}
+	if assignment == nil || assignment.Topics == nil {
+		return Assignment{}, nil
+	}
+	return Assignment(assignment.Topics), nil
+}
+
+// assign spreads the partitions of every topic over all members
+// subscribing to it. Each member gets a contiguous range of partitions.
+func (g *groupMember) assign(members map[string]sarama.ConsumerGroupMemberMetadata) (map[string]Assignment, error) {
+	subscribers := map[string][]string{}
+	assignments := map[string]Assignment{}
+	for memberID, meta := range members {
+		assignments[memberID] = Assignment{}
+		for _, topic := range meta.Topics {
+			subscribers[topic] = append(subscribers[topic], memberID)
+		}
+	}
+	for topic, memberIDs := range subscribers {
+		partitions, err := g.client.Partitions(topic)
+		if err != nil {
+			return nil, fmt.Errorf("discover partitions of %s: %s", topic, err)
+		}
+		for memberID, assigned := range assignRange(memberIDs, partitions) {
+			assignments[memberID][topic] = assigned
+		}
+	}
+	return assignments, nil
+}
+
+// assignRange assigns partitions to members in sorted order, the first
+// members get one more partition if they don't divide evenly.
+func assignRange(memberIDs []string, partitions []int32) map[string][]int32 {
+	memberIDs = append([]string(nil), memberIDs...)
+	partitions = append([]int32(nil), partitions...)
+	sort.Strings(memberIDs)
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+
+	assigned := map[string][]int32{}
+	size, rest := len(partitions)/len(memberIDs), len(partitions)%len(memberIDs)
+	start := 0
+	for i, memberID := range memberIDs {
+		n := size
+		if i < rest {
+			n++
+		}
+		if n > 0 {
+			assigned[memberID] = partitions[start : start+n]
+		}
+		start += n
+	}
+	return assigned
+}
+
+// heartbeat keeps the membership alive. It returns an error once the group
+// is rebalancing and the member has to join again.
+func (g *groupMember) heartbeat() error {
+	broker, err := g.coordinator()
+	if err != nil {
+		return err
+	}
+	resp, err := broker.Heartbeat(&sarama.HeartbeatRequest{
+		GroupId:      g.group,
+		MemberId:     g.memberID,
+		GenerationId: g.generation,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Err == sarama.ErrUnknownMemberId {
+		g.memberID = ""
+	}
+	if resp.Err != sarama.ErrNoError {
+		return resp.Err
+	}
+	return nil
+}
+
+// leave leaves the group, so its partitions are handed over right away
+// instead of after the session timed out.
+func (g *groupMember) leave() error {
+	if g.memberID == "" {
+		return nil
+	}
+	broker, err := g.coordinator()
+	if err != nil {
+		return err
+	}
+	resp, err := broker.LeaveGroup(&sarama.LeaveGroupRequest{
+		GroupId:  g.group,
+		MemberId: g.memberID,
+	})
+	g.memberID = ""
+	if err != nil {
+		return err
+	}
+	if resp.Err != sarama.ErrNoError {
+		return resp.Err
+	}
+	return nil
+}
+
+func (g *groupMember) coordinator() (*sarama.Broker, error) {
+	broker, err := g.client.Coordinator(g.group)
+	if err != nil {
+		if rerr := g.client.RefreshCoordinator(g.group); rerr != nil {
+			return nil, err
+		}
+		return g.client.Coordinator(g.group)
+	}
+	return broker, nil
+}
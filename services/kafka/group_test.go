@@ -0,0 +1,274 @@
+package kafka
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	itoml "github.com/influxdata/influxdb/toml"
+	"github.com/sirupsen/logrus"
+)
+
+func TestAssignRange(t *testing.T) {
+	assigned := assignRange([]string{"b", "a", "c"}, []int32{7, 0, 1, 2, 3, 4, 5})
+	expected := map[string][]int32{
+		"a": {0, 1, 2},
+		"b": {3, 4},
+		"c": {5, 7},
+	}
+	if !reflect.DeepEqual(assigned, expected) {
+		t.Fatalf("unexpected assignment: %v", assigned)
+	}
+}
+
+// Ensure members without partitions are left out when there are more
+// members than partitions.
+func TestAssignRange_MoreMembers(t *testing.T) {
+	assigned := assignRange([]string{"a", "b", "c"}, []int32{0, 1})
+	expected := map[string][]int32{
+		"a": {0},
+		"b": {1},
+	}
+	if !reflect.DeepEqual(assigned, expected) {
+		t.Fatalf("unexpected assignment: %v", assigned)
+	}
+}
+
+// newTestBroker returns a mock broker coordinating the group "workers",
+// whose topic "inbound" has 4 partitions, and a client connected to it.
+func newTestBroker(t *testing.T, handlers map[string]sarama.MockResponse) (*sarama.MockBroker, sarama.Client) {
+	broker := sarama.NewMockBroker(t, 1)
+	metadata := sarama.NewMockMetadataResponse(t).SetBroker(broker.Addr(), broker.BrokerID())
+	for partition := int32(0); partition < 4; partition++ {
+		metadata.SetLeader("inbound", partition, broker.BrokerID())
+	}
+	handlers["MetadataRequest"] = metadata
+	handlers["FindCoordinatorRequest"] = sarama.NewMockFindCoordinatorResponse(t).SetCoordinator(sarama.CoordinatorGroup, "workers", broker)
+	broker.SetHandlerByMap(handlers)
+
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_11_0_0
+	client, err := sarama.NewClient([]string{broker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return broker, client
+}
+
+func joinResponse(t *testing.T, generation int32, leader string) *sarama.MockJoinGroupResponse {
+	return sarama.NewMockJoinGroupResponse(t).
+		SetGenerationId(generation).
+		SetGroupProtocol(groupProtocol).
+		SetMemberId("self").
+		SetLeaderId(leader).
+		SetMember("self", &sarama.ConsumerGroupMemberMetadata{Topics: []string{"inbound"}}).
+		SetMember("other", &sarama.ConsumerGroupMemberMetadata{Topics: []string{"inbound"}})
+}
+
+func syncResponse(t *testing.T, partitions ...int32) *sarama.MockSyncGroupResponse {
+	return sarama.NewMockSyncGroupResponse(t).SetMemberAssignment(&sarama.ConsumerGroupMemberAssignment{
+		Topics: map[string][]int32{"inbound": partitions},
+	})
+}
+
+// requests returns the requests of a type received by broker.
+func requests(broker *sarama.MockBroker, typ interface{}) []interface{} {
+	var list []interface{}
+	for _, rr := range broker.History() {
+		if reflect.TypeOf(rr.Request) == reflect.TypeOf(typ) {
+			list = append(list, rr.Request)
+		}
+	}
+	return list
+}
+
+// Ensure the leader assigns the partitions of all members.
+func TestGroupMember_JoinAsLeader(t *testing.T) {
+	broker, client := newTestBroker(t, map[string]sarama.MockResponse{
+		"JoinGroupRequest": joinResponse(t, 1, "self"),
+		"SyncGroupRequest": syncResponse(t, 0, 1),
+	})
+	defer broker.Close()
+	defer client.Close()
+
+	g := newGroupMember(client, "workers", []string{"inbound"}, 30*time.Second)
+	assignment, err := g.join()
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(assignment, Assignment{"inbound": {0, 1}}) {
+		t.Fatalf("unexpected assignment: %v", assignment)
+	} else if g.memberID != "self" || g.generation != 1 {
+		t.Fatalf("unexpected membership: %s %d", g.memberID, g.generation)
+	}
+
+	syncs := requests(broker, &sarama.SyncGroupRequest{})
+	if len(syncs) != 1 {
+		t.Fatalf("unexpected sync requests: %d", len(syncs))
+	}
+	sync := syncs[0].(*sarama.SyncGroupRequest)
+	if sync.GenerationId != 1 || len(sync.GroupAssignments) != 2 {
+		t.Fatalf("unexpected sync request: %+v", sync)
+	}
+}
+
+// Ensure a member joins again after a rebalance, and with a new member ID
+// once the coordinator forgot about it.
+func TestGroupMember_Rejoin(t *testing.T) {
+	broker, client := newTestBroker(t, map[string]sarama.MockResponse{
+		"JoinGroupRequest": sarama.NewMockSequence(joinResponse(t, 1, "other"), joinResponse(t, 2, "other"), joinResponse(t, 3, "other")),
+		"SyncGroupRequest": sarama.NewMockSequence(syncResponse(t, 0, 1), syncResponse(t, 2, 3), syncResponse(t, 0)),
+		"HeartbeatRequest": sarama.NewMockSequence(
+			&sarama.HeartbeatResponse{Err: sarama.ErrNoError},
+			&sarama.HeartbeatResponse{Err: sarama.ErrRebalanceInProgress},
+			&sarama.HeartbeatResponse{Err: sarama.ErrUnknownMemberId},
+		),
+	})
+	defer broker.Close()
+	defer client.Close()
+
+	g := newGroupMember(client, "workers", []string{"inbound"}, 30*time.Second)
+	if _, err := g.join(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.heartbeat(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.heartbeat(); err != sarama.ErrRebalanceInProgress {
+		t.Fatalf("unexpected error: %v", err)
+	} else if g.memberID != "self" {
+		t.Fatal("expected member to keep its ID during a rebalance")
+	}
+	assignment, err := g.join()
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(assignment, Assignment{"inbound": {2, 3}}) || g.generation != 2 {
+		t.Fatalf("unexpected assignment of generation %d: %v", g.generation, assignment)
+	}
+
+	if err := g.heartbeat(); err != sarama.ErrUnknownMemberId {
+		t.Fatalf("unexpected error: %v", err)
+	} else if g.memberID != "" {
+		t.Fatal("expected member ID to be reset")
+	}
+	if _, err := g.join(); err != nil {
+		t.Fatal(err)
+	}
+	joins := requests(broker, &sarama.JoinGroupRequest{})
+	if len(joins) != 3 || joins[1].(*sarama.JoinGroupRequest).MemberId != "self" || joins[2].(*sarama.JoinGroupRequest).MemberId != "" {
+		t.Fatalf("unexpected join requests: %+v", joins)
+	}
+	// only the leader sends assignments
+	for _, sync := range requests(broker, &sarama.SyncGroupRequest{}) {
+		if len(sync.(*sarama.SyncGroupRequest).GroupAssignments) != 0 {
+			t.Fatalf("unexpected assignments of a follower: %+v", sync)
+		}
+	}
+}
+
+func TestGroupMember_Leave(t *testing.T) {
+	broker, client := newTestBroker(t, map[string]sarama.MockResponse{
+		"JoinGroupRequest":  joinResponse(t, 1, "other"),
+		"SyncGroupRequest":  syncResponse(t, 0),
+		"LeaveGroupRequest": sarama.NewMockLeaveGroupResponse(t),
+	})
+	defer broker.Close()
+	defer client.Close()
+
+	g := newGroupMember(client, "workers", []string{"inbound"}, 30*time.Second)
+	if _, err := g.join(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.leave(); err != nil {
+		t.Fatal(err)
+	} else if err := g.leave(); err != nil {
+		t.Fatal(err)
+	}
+	leaves := requests(broker, &sarama.LeaveGroupRequest{})
+	if len(leaves) != 1 || leaves[0].(*sarama.LeaveGroupRequest).MemberId != "self" {
+		t.Fatalf("unexpected leave requests: %+v", leaves)
+	}
+}
+
+// Ensure the partitions are revoked before the service joins again after a
+// rebalance, and before it leaves the group when it stops.
+func TestService_ConsumeRebalance(t *testing.T) {
+	broker, client := newTestBroker(t, map[string]sarama.MockResponse{
+		"JoinGroupRequest": sarama.NewMockSequence(joinResponse(t, 1, "other"), joinResponse(t, 2, "other")),
+		"SyncGroupRequest": sarama.NewMockSequence(syncResponse(t, 0, 1), syncResponse(t, 2)),
+		"HeartbeatRequest": sarama.NewMockSequence(
+			&sarama.HeartbeatResponse{Err: sarama.ErrRebalanceInProgress},
+			&sarama.HeartbeatResponse{Err: sarama.ErrNoError},
+		),
+		"LeaveGroupRequest": sarama.NewMockLeaveGroupResponse(t),
+	})
+	defer broker.Close()
+	defer client.Close()
+
+	c := NewConfig()
+	c.SessionTimeout = itoml.Duration(30 * time.Millisecond)
+	s := NewService(c)
+	s.Logger = logrus.New()
+	s.Logger.Out = ioutil.Discard
+	s.member = newGroupMember(client, "workers", []string{"inbound"}, time.Duration(c.SessionTimeout))
+
+	var mu sync.Mutex
+	var events []string
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+	started := make(chan Assignment, 2)
+	s.consumePartitions = func(assignment Assignment, revoked <-chan struct{}) func() {
+		record(fmt.Sprintf("start %v", assignment["inbound"]))
+		started <- assignment
+		return func() {
+			select {
+			case <-revoked:
+				record(fmt.Sprintf("stop %v", assignment["inbound"]))
+			default:
+				t.Error("partitions stopped before they were revoked")
+			}
+		}
+	}
+	go s.consume()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for partitions")
+		}
+	}
+	close(s.closing)
+	<-s.done
+
+	expected := []string{"start [0 1]", "stop [0 1]", "start [2]", "stop [2]"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("unexpected events: %v", events)
+	}
+	if len(requests(broker, &sarama.JoinGroupRequest{})) != 2 || len(requests(broker, &sarama.LeaveGroupRequest{})) != 1 {
+		t.Fatalf("unexpected requests: %+v", broker.History())
+	}
+}
+
+// Ensure every host consumes the status queue with offsets of its own.
+func TestService_StatusGroup(t *testing.T) {
+	s := NewService(NewConfig())
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, err := s.statusGroup(); err != nil || name != DefaultGroupName+"-status-"+host {
+		t.Fatalf("unexpected status group: %s %v", name, err)
+	}
+	s.Config.StatusGroup = "master-1"
+	if name, err := s.statusGroup(); err != nil || name != "master-1" {
+		t.Fatalf("unexpected status group: %s %v", name, err)
+	}
+}
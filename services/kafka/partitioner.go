@@ -0,0 +1,25 @@
+package kafka
+
+import "github.com/Shopify/sarama"
+
+// keyPartitioner hashes the partition key of a message, which the service
+// passes in the message metadata. The kafka message key stays the message
+// key, so it is still known to the consumer.
+type keyPartitioner struct {
+	hash sarama.Partitioner
+}
+
+func newKeyPartitioner(topic string) sarama.Partitioner {
+	return &keyPartitioner{hash: sarama.NewHashPartitioner(topic)}
+}
+
+func (p *keyPartitioner) Partition(msg *sarama.ProducerMessage, numPartitions int32) (int32, error) {
+	if m, ok := msg.Metadata.(*produced); ok && m.partitionKey != "" {
+		return p.hash.Partition(&sarama.ProducerMessage{Key: sarama.StringEncoder(m.partitionKey)}, numPartitions)
+	}
+	return p.hash.Partition(msg, numPartitions)
+}
+
+func (p *keyPartitioner) RequiresConsistency() bool {
+	return true
+}
@@ -0,0 +1,25 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+// Ensure messages with the same partition key end up in the same partition,
+// no matter their message key.
+func TestKeyPartitioner(t *testing.T) {
+	p := newKeyPartitioner("mail")
+	first, err := p.Partition(&sarama.ProducerMessage{Key: sarama.StringEncoder("a"), Metadata: &produced{partitionKey: "example.com"}}, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"b", "c", "d", "e"} {
+		partition, err := p.Partition(&sarama.ProducerMessage{Key: sarama.StringEncoder(key), Metadata: &produced{partitionKey: "example.com"}}, 32)
+		if err != nil {
+			t.Fatal(err)
+		} else if partition != first {
+			t.Fatalf("message %s: unexpected partition %d, expected %d", key, partition, first)
+		}
+	}
+}
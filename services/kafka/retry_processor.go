@@ -0,0 +1,70 @@
+package kafka
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/movio/kasper"
+	"github.com/sirupsen/logrus"
+)
+
+// RetryProcessor holds the messages of one retry topic until they are due
+// and moves them back into the inbound queue. All messages of a retry topic
+// are delayed equally, so waiting for the first one never holds back a
+// message which is already due.
+type RetryProcessor struct {
+	Logger  *logrus.Entry
+	Service *Service
+	Tier    int
+	// Revoked is closed when the partitions are handed over to another
+	// worker or the service stops.
+	Revoked <-chan struct{}
+}
+
+// errRevoked stops the processing of a retry topic once its partitions are
+// revoked.
+var errRevoked = errors.New("partitions revoked")
+
+// Process waits for each message to be due and releases it. Once the
+// partitions are revoked, the messages which are not due yet are left to
+// the next owner: the offsets of the batch are not committed, so it delays
+// them again. Messages released before in the same batch are released once
+// more, workers drop the ones which were delivered already.
+func (processor *RetryProcessor) Process(msgs []*sarama.ConsumerMessage, sender kasper.Sender) error {
+	for _, msg := range msgs {
+		m := toQueueMessage(msg)
+		if !processor.wait(m.NotBefore()) {
+			processor.Logger.Debugf("Leaving delayed message %s to the next owner of %s", m.Key, msg.Topic)
+			return errRevoked
+		}
+		processor.Logger.Debugf("Releasing delayed message %s", m.Key)
+		if err := processor.Service.produce(processor.Service.Config.InboundQueueName, m); err != nil {
+			return err
+		}
+		processor.Service.schedule.Released(processor.Tier)
+	}
+	return nil
+}
+
+// wait blocks until t and returns true, or false if the partitions were
+// revoked before.
+func (processor *RetryProcessor) wait(t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-processor.Revoked:
+		return false
+	}
+}
+
+// SetLogOutput sets a new log output for this module
+func (processor *RetryProcessor) SetLogOutput(log *logrus.Logger) {
+	processor.Logger = log.WithField("prefix", "retryProcessor")
+}
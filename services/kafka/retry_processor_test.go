@@ -0,0 +1,66 @@
+package kafka
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
+	"github.com/sirupsen/logrus"
+)
+
+func newRetryMessage(key string, notBefore time.Time) *sarama.ConsumerMessage {
+	m := &queue.Message{Key: key}
+	m.SetNotBefore(notBefore)
+	msg := &sarama.ConsumerMessage{Topic: "mail-retry-1m", Key: []byte(key)}
+	for k, v := range m.Headers {
+		msg.Headers = append(msg.Headers, &sarama.RecordHeader{Key: []byte(k), Value: []byte(v)})
+	}
+	return msg
+}
+
+// Ensure messages which are not due yet are left to the next owner of the
+// partitions instead of being released early.
+func TestRetryProcessor_Revoked(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	producer := mocks.NewAsyncProducer(t, config)
+	producer.ExpectInputAndSucceed()
+	defer producer.Close()
+	s := NewService(NewConfig())
+	s.Producer = producer
+
+	revoked := make(chan struct{})
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	processor := &RetryProcessor{Service: s, Revoked: revoked}
+	processor.SetLogOutput(logger)
+
+	done := make(chan error)
+	go func() {
+		done <- processor.Process([]*sarama.ConsumerMessage{
+			newRetryMessage("due", time.Now()),
+			newRetryMessage("delayed", time.Now().Add(time.Hour)),
+		}, nil)
+	}()
+	select {
+	case msg := <-producer.Successes():
+		if key, _ := msg.Key.Encode(); string(key) != "due" {
+			t.Fatalf("unexpected message: %s", key)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("due message not released")
+	}
+
+	close(revoked)
+	select {
+	case err := <-done:
+		if err != errRevoked {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("processing not stopped")
+	}
+}
@@ -1,34 +1,45 @@
 package kafka
 
 import (
+	"fmt"
+	"os"
 	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/movio/kasper"
-	"github.com/nirnanaaa/cloudive-mailer/services/kafka/event"
-	"github.com/nirnanaaa/cloudive-mailer/services/smtp"
-	"github.com/prometheus/client_golang/prometheus"
-	uuid "github.com/satori/go.uuid"
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
 	"github.com/sirupsen/logrus"
 )
 
-// Service manages the listener and handler for an HTTP endpoint.
+// Service is the kafka queue backend. Consumers join a consumer group, so
+// the partitions of the inbound and retry topics are shared by all workers.
 type Service struct {
-	Logger            *logrus.Logger
-	Config            *Config
-	topicProcessor    *kasper.TopicProcessor
-	MessageProcessors map[int]kasper.MessageProcessor
-	KafkaClient       sarama.Client
-	SMTP              *smtp.Service
+	Logger           *logrus.Logger
+	Config           *Config
+	MessageProcessor kasper.MessageProcessor
+	KafkaClient      sarama.Client
 
 	Producer sarama.AsyncProducer
+
+	schedule *queue.RetrySchedule
+	member   *groupMember
+	// consumePartitions consumes the assigned partitions until the returned
+	// function is called. Replaced in tests.
+	consumePartitions func(assignment Assignment, revoked <-chan struct{}) (stop func())
+	statusHandler     queue.Handler
+	statusProcessor   *kasper.TopicProcessor
+	closing           chan struct{}
+	done              chan struct{}
 }
 
 // NewService returns a new instance of Service.
 func NewService(c *Config) *Service {
 
 	s := &Service{
-		Config: c,
+		Config:   c,
+		schedule: queue.NewRetrySchedule(c.RetryDelays, c.RetryJitter),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
 	}
 	return s
 }
@@ -36,67 +47,303 @@ func NewService(c *Config) *Service {
 // Connect estabiles a connection without Starting to work.
 func (s *Service) Connect() error {
 
-	client, err := sarama.NewClient(s.Config.Brokers, sarama.NewConfig())
+	cConfig := sarama.NewConfig()
+	// record headers carrying the delivery attempts require kafka 0.11
+	cConfig.Version = sarama.V0_11_0_0
+	client, err := sarama.NewClient(s.Config.Brokers, cConfig)
 	if err != nil {
 		return err
 	}
 	s.KafkaClient = client
-	if len(s.MessageProcessors) < 1 {
+	return nil
+
+}
+
+// topicProcessors returns the processors for all assigned partitions. Every
+// retry topic needs its own processor, otherwise waiting for a long delay
+// would hold back the shorter ones.
+func (s *Service) topicProcessors(assignment Assignment, revoked <-chan struct{}) []*kasper.TopicProcessor {
+	var processors []*kasper.TopicProcessor
+	add := func(name, topic string, processor kasper.MessageProcessor) {
+		partitions := assignment[topic]
+		if len(partitions) == 0 {
+			return
+		}
+		config := kasper.Config{
+			TopicProcessorName: name,
+			Client:             s.KafkaClient,
+			InputTopics:        []string{topic},
+			Logger:             s.Logger.WithField("prefix", "kafka"),
+		}
+		messageProcessors := map[int]kasper.MessageProcessor{}
+		for _, partition := range partitions {
+			config.InputPartitions = append(config.InputPartitions, int(partition))
+			messageProcessors[int(partition)] = processor
+		}
+		processors = append(processors, kasper.NewTopicProcessor(&config, messageProcessors))
+	}
+	add(s.Config.GroupName, s.Config.InboundQueueName, s.MessageProcessor)
+	for tier := range s.schedule.Delays {
+		processor := &RetryProcessor{Service: s, Tier: tier, Revoked: revoked}
+		processor.SetLogOutput(s.Logger)
+		add(fmt.Sprintf("%s-retry-%s", s.Config.GroupName, s.schedule.TierName(tier)), s.retryTopic(tier), processor)
+	}
+	return processors
+}
+
+// consume joins the consumer group and processes the assigned partitions
+// until the group rebalances, then it joins again.
+func (s *Service) consume() {
+	defer close(s.done)
+	for {
+		assignment, err := s.member.join()
+		if err != nil {
+			s.Logger.WithError(err).Warn("Joining the consumer group failed")
+			select {
+			case <-s.closing:
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		s.Logger.Infof("Consuming partitions %v", assignment)
+
+		revoked := make(chan struct{})
+		stop := s.consumePartitions(assignment, revoked)
+		err = s.heartbeat()
+		// partitions must be released before joining again, otherwise two
+		// workers might consume the same partition.
+		close(revoked)
+		stop()
+		if err == nil {
+			if err := s.member.leave(); err != nil {
+				s.Logger.WithError(err).Warn("Leaving the consumer group failed")
+			}
+			return
+		}
+		s.Logger.Infof("Rebalancing the consumer group: %s", err)
+	}
+}
+
+// runProcessors consumes the assigned partitions with kasper.
+func (s *Service) runProcessors(assignment Assignment, revoked <-chan struct{}) func() {
+	processors := s.topicProcessors(assignment, revoked)
+	for _, processor := range processors {
+		go func(tp *kasper.TopicProcessor) {
+			if err := tp.RunLoop(); err != nil && err != errRevoked {
+				s.Logger.WithError(err).Error("Consuming messages failed")
+			}
+		}(processor)
+	}
+	return func() {
+		for _, processor := range processors {
+			processor.Close()
+		}
+	}
+}
+
+// heartbeat keeps the group membership alive. It returns nil when the
+// service is stopped, or the error which requires to join the group again.
+func (s *Service) heartbeat() error {
+	ticker := time.NewTicker(time.Duration(s.Config.SessionTimeout) / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closing:
+			return nil
+		case <-ticker.C:
+			if err := s.member.heartbeat(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// retryTopic returns the name of the topic holding messages of a retry tier.
+func (s *Service) retryTopic(tier int) string {
+	return fmt.Sprintf("%s-retry-%s", s.Config.InboundQueueName, s.schedule.TierName(tier))
+}
+
+// Publish queues a message into our internal kafka queue
+func (s *Service) Publish(msg *queue.Message) error {
+	return s.produce(s.Config.OutboundQueueName, msg)
+}
+
+// PublishBatch publishes messages into the outbound queue at once. When the
+// service waits for acknowledgements, it waits for them once all messages
+// have been handed to the producer.
+func (s *Service) PublishBatch(msgs []*queue.Message) []error {
+	errs := make([]error, len(msgs))
+	acks := make([]chan error, len(msgs))
+	for i, msg := range msgs {
+		outgoing, meta := s.producerMessage(s.Config.OutboundQueueName, msg)
+		if s.Config.WaitForAck {
+			meta.acked = make(chan error, 1)
+			acks[i] = meta.acked
+		}
+		s.Producer.Input() <- outgoing
+	}
+	if s.Config.WaitForAck {
+		for i := range acks {
+			errs[i] = <-acks[i]
+		}
+	}
+	return errs
+}
+
+// PublishRetry moves a message into the retry topic of its attempt, from
+// where it is moved back into the inbound queue once it is due.
+func (s *Service) PublishRetry(msg *queue.Message, attempt int) error {
+	tier := s.schedule.Schedule(msg, attempt, time.Now())
+	return s.produce(s.retryTopic(tier), msg)
+}
+
+// PublishStatus publishes a message state change into the status queue
+func (s *Service) PublishStatus(msg *queue.Message) error {
+	return s.produce(s.Config.StatusQueue, msg)
+}
+
+// PublishDeadLetter moves a message into the dead letter queue
+func (s *Service) PublishDeadLetter(msg *queue.Message) error {
+	return s.produce(s.Config.DeadLetterQueue, msg)
+}
+
+// produced is passed along with every produced message.
+type produced struct {
+	partitionKey string
+	// acked receives the result of the produce request when the service
+	// waits for acknowledgements.
+	acked chan error
+}
+
+func (s *Service) produce(topic string, msg *queue.Message) error {
+	outgoingMessage, meta := s.producerMessage(topic, msg)
+	if !s.Config.WaitForAck {
+		s.Producer.Input() <- outgoingMessage
 		return nil
 	}
-	config := kasper.Config{
-		TopicProcessorName: s.Config.GroupName,
-		Client:             client,
-		InputTopics:        []string{s.Config.InboundQueueName},
-		InputPartitions:    []int{0},
-		Logger:             s.Logger.WithField("prefix", "kafka"),
+	meta.acked = make(chan error, 1)
+	s.Producer.Input() <- outgoingMessage
+	return <-meta.acked
+}
+
+// producerMessage converts msg into a message for the producer.
+func (s *Service) producerMessage(topic string, msg *queue.Message) (*sarama.ProducerMessage, *produced) {
+	meta := &produced{partitionKey: msg.PartitionKey()}
+	outgoingMessage := &sarama.ProducerMessage{
+		Topic:    topic,
+		Key:      sarama.StringEncoder(msg.Key),
+		Value:    sarama.ByteEncoder(msg.Value),
+		Metadata: meta,
+	}
+	for key, value := range msg.Headers {
+		outgoingMessage.Headers = append(outgoingMessage.Headers, sarama.RecordHeader{
+			Key:   []byte(key),
+			Value: []byte(value),
+		})
 	}
+	return outgoingMessage, meta
+}
 
-	s.topicProcessor = kasper.NewTopicProcessor(&config, s.MessageProcessors)
-	return nil
+// Consume hands all messages of the inbound queue to h.
+func (s *Service) Consume(h queue.Handler) {
+	processor := S3Processor{
+		Handler: h,
+	}
+	processor.SetLogOutput(s.Logger)
+	s.SetProcessor(&processor)
+}
 
+// ConsumeStatus hands all messages of the status queue to h. Unlike the
+// inbound queue, the status queue is consumed in all partitions by every
+// service with offsets of its own, as each one keeps its own status store.
+func (s *Service) ConsumeStatus(h queue.Handler) {
+	s.statusHandler = h
 }
 
-// QueueMail queues a message into our internal kafka queue
-func (s *Service) QueueMail(msg *event.InboundEmailEvent) error {
-	s.Logger.Debugf("Delivering email with Trace ID %s", msg.TraceID)
-	encoded, err := event.EncodeOutgoingEvent(msg)
+// startStatusProcessor starts consuming all partitions of the status queue.
+func (s *Service) startStatusProcessor() error {
+	partitions, err := s.KafkaClient.Partitions(s.Config.StatusQueue)
+	if err != nil {
+		return fmt.Errorf("discover partitions of %s: %s", s.Config.StatusQueue, err)
+	}
+	name, err := s.statusGroup()
 	if err != nil {
 		return err
 	}
-	key := uuid.NewV4().String()
-	outgoingMessage := &sarama.ProducerMessage{
-		Topic:     s.Config.OutboundQueueName,
-		Partition: 0,
-		Key:       sarama.StringEncoder(key),
-		Value:     sarama.ByteEncoder(encoded),
+	processor := &S3Processor{Handler: s.statusHandler}
+	processor.SetLogOutput(s.Logger)
+	config := kasper.Config{
+		TopicProcessorName: name,
+		Client:             s.KafkaClient,
+		InputTopics:        []string{s.Config.StatusQueue},
+		Logger:             s.Logger.WithField("prefix", "kafka"),
 	}
-	s.Producer.Input() <- outgoingMessage
+	messageProcessors := map[int]kasper.MessageProcessor{}
+	for _, partition := range partitions {
+		config.InputPartitions = append(config.InputPartitions, int(partition))
+		messageProcessors[int(partition)] = processor
+	}
+	s.statusProcessor = kasper.NewTopicProcessor(&config, messageProcessors)
+	go func() {
+		if err := s.statusProcessor.RunLoop(); err != nil {
+			s.Logger.WithError(err).Error("Consuming status messages failed")
+		}
+	}()
 	return nil
 }
 
+// statusGroup returns the name the offsets of the status queue are committed
+// under, which is unique to this host unless configured otherwise.
+func (s *Service) statusGroup() (string, error) {
+	if s.Config.StatusGroup != "" {
+		return s.Config.StatusGroup, nil
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("status group: %s", err)
+	}
+	return s.Config.GroupName + "-status-" + host, nil
+}
+
 // ConnectProducer connects a kafka producer
 func (s *Service) ConnectProducer() error {
 	cConfig := s.KafkaClient.Config()
 	cConfig.Producer.RequiredAcks = sarama.WaitForLocal       // Only wait for the leader to ack
 	cConfig.Producer.Compression = sarama.CompressionSnappy   // Compress messages
 	cConfig.Producer.Flush.Frequency = 500 * time.Millisecond // Flush batches every 500ms
+	cConfig.Producer.Partitioner = newKeyPartitioner
+	cConfig.Producer.Return.Successes = s.Config.WaitForAck
 	producer, err := sarama.NewAsyncProducer(s.Config.Brokers, cConfig)
 	if err != nil {
 		return err
 	}
 	go func() {
 		for err := range producer.Errors() {
-			s.Logger.WithError(err).Error("Producing a message failed")
-			return
+			s.Logger.WithError(err).Errorf("Producing a message into %s failed", err.Msg.Topic)
+			if meta, ok := err.Msg.Metadata.(*produced); ok && meta.acked != nil {
+				meta.acked <- err.Err
+			}
 		}
 	}()
+	if s.Config.WaitForAck {
+		go func() {
+			for msg := range producer.Successes() {
+				if meta, ok := msg.Metadata.(*produced); ok && meta.acked != nil {
+					meta.acked <- nil
+				}
+			}
+		}()
+	}
 	s.Producer = producer
 	return nil
 }
 
 // Start starts the service
 func (s *Service) Start() error {
+	if err := queue.RegisterMetrics(); err != nil {
+		return err
+	}
 	if err := s.Connect(); err != nil {
 		return err
 	}
@@ -104,49 +351,46 @@ func (s *Service) Start() error {
 	if err := s.ConnectProducer(); err != nil {
 		return err
 	}
-	// metrics
-	if err := s.registerMetrics(); err != nil {
-		return err
+	if s.statusHandler != nil {
+		if err := s.startStatusProcessor(); err != nil {
+			return err
+		}
 	}
-	if len(s.MessageProcessors) < 1 {
+	if s.MessageProcessor == nil {
 		return nil
 	}
-	return s.topicProcessor.RunLoop()
-}
-
-// SetDefaultMessageProcessor applies the default custom message processor
-func (s *Service) SetDefaultMessageProcessor(smtp *smtp.Service) {
-	processor := S3Processor{
-		OutputTopicName: s.Config.OutboundQueueName,
-		SMTP:            smtp,
+	topics := []string{s.Config.InboundQueueName}
+	for tier := range s.schedule.Delays {
+		topics = append(topics, s.retryTopic(tier))
 	}
-	processor.SetLogOutput(s.Logger)
-	s.MessageProcessors = map[int]kasper.MessageProcessor{0: &processor}
+	// kafka refuses offset commits without a generation for groups with
+	// members, so membership and kasper's offsets use different groups.
+	group := s.Config.GroupName + "-members"
+	s.member = newGroupMember(s.KafkaClient, group, topics, time.Duration(s.Config.SessionTimeout))
+	if s.consumePartitions == nil {
+		s.consumePartitions = s.runProcessors
+	}
+	go s.consume()
+	return nil
 }
 
 // SetProcessor applies a custom message processor
 func (s *Service) SetProcessor(processor kasper.MessageProcessor) {
-	s.MessageProcessors = map[int]kasper.MessageProcessor{0: processor}
-}
-
-func (s *Service) registerMetrics() error {
-	if err := prometheus.Register(processingTime); err != nil {
-		return err
-	}
-	if err := prometheus.Register(totalProcessedCount); err != nil {
-		return err
-	}
-	return prometheus.Register(errorCount)
-
+	s.MessageProcessor = processor
 }
 
 // Stop closes the underlying listener.
+// The consumers are closed first, as they are still producing messages
+// while they finish.
 func (s *Service) Stop() error {
-	s.Producer.Close()
-	if len(s.MessageProcessors) < 1 {
-		return nil
+	close(s.closing)
+	if s.member != nil {
+		<-s.done
+	}
+	if s.statusProcessor != nil {
+		s.statusProcessor.Close()
 	}
-	s.topicProcessor.Close()
+	s.Producer.Close()
 	return nil
 }
 
@@ -0,0 +1,93 @@
+package queue
+
+import (
+	"fmt"
+	"time"
+
+	itoml "github.com/influxdata/influxdb/toml"
+)
+
+const (
+	// BackendKafka queues messages in kafka topics
+	BackendKafka = "kafka"
+
+	// BackendMemory queues messages in a channel of the running process
+	BackendMemory = "memory"
+
+	// BackendDisk queues messages as files in a local directory
+	BackendDisk = "disk"
+
+	// DefaultBackend defines the queue backend used by master and worker,
+	// the [standalone] section selects the backend of the standalone mode
+	DefaultBackend = BackendKafka
+
+	// DefaultConcurrency defines how many messages are handled in parallel
+	DefaultConcurrency = 4
+
+	// DefaultMemorySize defines how many messages the memory queue holds
+	DefaultMemorySize = 1000
+
+	// DefaultDiskPath defines where the disk queue stores its messages
+	DefaultDiskPath = "/var/lib/cloudive/queue"
+
+	// DefaultDiskPollInterval defines how often the disk queue looks for new messages
+	DefaultDiskPollInterval = time.Second
+
+	// DefaultRetryJitter defines by which fraction retry delays are randomized
+	DefaultRetryJitter = 0.1
+)
+
+// DefaultRetryDelays defines how long failed messages are delayed, one tier per attempt
+var DefaultRetryDelays = []time.Duration{time.Minute, 10 * time.Minute, time.Hour}
+
+// Config represents a configuration for the queue backends.
+type Config struct {
+	Backend          string           `toml:"backend"`
+	Concurrency      int              `toml:"concurrency"`
+	MemorySize       int              `toml:"memory-size"`
+	DiskPath         string           `toml:"disk-path"`
+	DiskPollInterval itoml.Duration   `toml:"disk-poll-interval"`
+	RetryDelays      []itoml.Duration `toml:"retry-delays"`
+	RetryJitter      float64          `toml:"retry-jitter"`
+}
+
+// NewConfig returns a new Config with default settings.
+func NewConfig() *Config {
+	return &Config{
+		Backend:          DefaultBackend,
+		Concurrency:      DefaultConcurrency,
+		MemorySize:       DefaultMemorySize,
+		DiskPath:         DefaultDiskPath,
+		DiskPollInterval: itoml.Duration(DefaultDiskPollInterval),
+		RetryDelays:      DefaultRetryDelayDurations(),
+		RetryJitter:      DefaultRetryJitter,
+	}
+}
+
+// DefaultRetryDelayDurations returns a copy of DefaultRetryDelays for configs.
+func DefaultRetryDelayDurations() []itoml.Duration {
+	delays := make([]itoml.Duration, len(DefaultRetryDelays))
+	for i, d := range DefaultRetryDelays {
+		delays[i] = itoml.Duration(d)
+	}
+	return delays
+}
+
+// Validate returns an error if the config is invalid.
+func (c *Config) Validate() error {
+	switch c.Backend {
+	case BackendKafka, BackendDisk:
+	case BackendMemory:
+		// the master would queue mails no worker ever consumes
+		return fmt.Errorf("the memory queue backend only works in standalone mode, set [standalone] backend instead")
+	default:
+		return fmt.Errorf("unknown queue backend %q", c.Backend)
+	}
+	if c.Concurrency < 1 {
+		return fmt.Errorf("queue concurrency must be at least 1")
+	}
+	if c.Backend == BackendDisk && c.DiskPath == "" {
+		return fmt.Errorf("disk queue requires a disk-path")
+	}
+	return NewRetrySchedule(c.RetryDelays, c.RetryJitter).Validate()
+}
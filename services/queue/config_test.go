@@ -0,0 +1,74 @@
+package queue_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
+)
+
+func TestConfig_Parse(t *testing.T) {
+	// Parse configuration.
+	c := queue.NewConfig()
+	if _, err := toml.Decode(`
+		backend = "disk"
+		concurrency = 2
+		memory-size = 10
+		disk-path = "/tmp/queue"
+		disk-poll-interval = "5s"
+`, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	// Validate configuration.
+	if c.Backend != queue.BackendDisk {
+		t.Fatalf("unexpected backend: %s", c.Backend)
+	} else if c.Concurrency != 2 {
+		t.Fatalf("unexpected concurrency: %d", c.Concurrency)
+	} else if c.MemorySize != 10 {
+		t.Fatalf("unexpected memory size: %d", c.MemorySize)
+	} else if c.DiskPath != "/tmp/queue" {
+		t.Fatalf("unexpected disk path: %s", c.DiskPath)
+	} else if time.Duration(c.DiskPollInterval) != 5*time.Second {
+		t.Fatalf("unexpected disk poll interval: %s", c.DiskPollInterval)
+	} else if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfig_ValidateBackend(t *testing.T) {
+	c := queue.NewConfig()
+	c.Backend = "carrier-pigeon"
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected an error for an unknown backend")
+	}
+
+	// master and worker run in separate processes
+	c.Backend = queue.BackendMemory
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected an error for the memory backend")
+	}
+}
+
+func TestConfig_ParseRetries(t *testing.T) {
+	c := queue.NewConfig()
+	if _, err := toml.Decode(`
+		retry-delays = ["30s", "5m"]
+		retry-jitter = 0.2
+`, &c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.RetryDelays) != 2 || time.Duration(c.RetryDelays[1]) != 5*time.Minute {
+		t.Fatalf("unexpected retry delays: %v", c.RetryDelays)
+	} else if c.RetryJitter != 0.2 {
+		t.Fatalf("unexpected retry jitter: %f", c.RetryJitter)
+	} else if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.RetryDelays = c.RetryDelays[:0]
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected an error without retry delays")
+	}
+}
@@ -0,0 +1,281 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	diskTmpDir    = "tmp"
+	diskNewDir    = "new"
+	diskCurDir    = "cur"
+	diskFailedDir = "failed"
+	diskDeadDir   = "dead"
+)
+
+// DiskQueue is a durable queue storing every message as a file inside a
+// local directory, similar to a maildir. Messages are written to tmp, moved
+// to new once they are completely on disk and claimed by moving them to cur.
+// Messages which can not be decoded are moved to failed, dead letters are
+// stored in dead. File names start with the time a message is due, so
+// delayed retries simply wait in new until their time has come.
+//
+// Any number of processes may publish into the same directory, but only one
+// process may consume from it, as claimed messages are recovered on start.
+type DiskQueue struct {
+	Logger *logrus.Entry
+	Config *Config
+
+	handler  Handler
+	schedule *RetrySchedule
+	claimed  chan string
+	notify   chan struct{}
+	closing  chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewDiskQueue returns a new instance of DiskQueue.
+func NewDiskQueue(c *Config) *DiskQueue {
+	return &DiskQueue{
+		Config:   c,
+		Logger:   logrus.New().WithField("prefix", "queue"),
+		schedule: NewRetrySchedule(c.RetryDelays, c.RetryJitter),
+		claimed:  make(chan string),
+		notify:   make(chan struct{}, 1),
+		closing:  make(chan struct{}),
+	}
+}
+
+func (q *DiskQueue) dir(name string) string {
+	return filepath.Join(q.Config.DiskPath, name)
+}
+
+// Publish durably writes a message into the queue directory.
+func (q *DiskQueue) Publish(msg *Message) error {
+	select {
+	case <-q.closing:
+		return ErrQueueClosed
+	default:
+	}
+	if err := q.write(diskNewDir, msg, time.Now()); err != nil {
+		return err
+	}
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// PublishRetry durably writes a message into the queue directory, it is
+// not consumed before the delay of its retry tier is over.
+func (q *DiskQueue) PublishRetry(msg *Message, attempt int) error {
+	select {
+	case <-q.closing:
+		return ErrQueueClosed
+	default:
+	}
+	tier := q.schedule.Schedule(msg, attempt, time.Now())
+	msg.SetHeader(diskRetryTierHeader, strconv.Itoa(tier))
+	return q.write(diskNewDir, msg, msg.NotBefore())
+}
+
+// diskRetryTierHeader keeps the retry tier of a delayed message until it
+// is released.
+const diskRetryTierHeader = "x-mailer-retry-tier"
+
+// PublishDeadLetter durably writes a message into the dead letter directory.
+func (q *DiskQueue) PublishDeadLetter(msg *Message) error {
+	return q.write(diskDeadDir, msg, time.Now())
+}
+
+// write writes msg to tmp and moves it into dir once it is completely on disk.
+func (q *DiskQueue) write(dir string, msg *Message, due time.Time) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	// names sort by the time messages are due, so messages are consumed
+	// first in first out.
+	name := fmt.Sprintf("%020d-%s", due.UnixNano(), uuid.NewV4().String())
+	tmp := filepath.Join(q.dir(diskTmpDir), name)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(q.dir(dir), name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Consume registers the handler for all queued messages.
+func (q *DiskQueue) Consume(h Handler) {
+	q.handler = h
+}
+
+// Start creates the queue directories and starts the configured number of
+// consumers.
+func (q *DiskQueue) Start() error {
+	if err := RegisterMetrics(); err != nil {
+		return err
+	}
+	for _, name := range []string{diskTmpDir, diskNewDir, diskCurDir, diskFailedDir, diskDeadDir} {
+		if err := os.MkdirAll(q.dir(name), 0700); err != nil {
+			return err
+		}
+	}
+	if q.handler == nil {
+		return nil
+	}
+	if err := q.recover(); err != nil {
+		return err
+	}
+	q.Logger.Infof("Starting %d disk queue consumers on %s", q.Config.Concurrency, q.Config.DiskPath)
+	q.wg.Add(1)
+	go q.dispatch()
+	for i := 0; i < q.Config.Concurrency; i++ {
+		q.wg.Add(1)
+		go q.consume()
+	}
+	return nil
+}
+
+// Stop stops all consumers after their current message has been handled.
+// Messages which are not handled yet stay in the queue directory.
+func (q *DiskQueue) Stop() error {
+	close(q.closing)
+	q.wg.Wait()
+	return nil
+}
+
+// recover moves messages claimed by a previous, crashed process back into new.
+func (q *DiskQueue) recover() error {
+	files, err := ioutil.ReadDir(q.dir(diskCurDir))
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		q.Logger.Warnf("Recovering unfinished message %s", fi.Name())
+		if err := os.Rename(filepath.Join(q.dir(diskCurDir), fi.Name()), filepath.Join(q.dir(diskNewDir), fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dispatch claims new messages and hands them over to the consumers.
+func (q *DiskQueue) dispatch() {
+	defer q.wg.Done()
+	ticker := time.NewTicker(time.Duration(q.Config.DiskPollInterval))
+	defer ticker.Stop()
+	for {
+		files, err := ioutil.ReadDir(q.dir(diskNewDir))
+		if err != nil {
+			q.Logger.WithError(err).Error("Listing queued messages failed")
+		}
+		now := time.Now()
+		for _, fi := range files {
+			name := fi.Name()
+			if due(name).After(now) {
+				// all following messages are due even later
+				break
+			}
+			if err := os.Rename(filepath.Join(q.dir(diskNewDir), name), filepath.Join(q.dir(diskCurDir), name)); err != nil {
+				// someone else has removed it in the meantime
+				continue
+			}
+			select {
+			case q.claimed <- name:
+			case <-q.closing:
+				// hand the message back, it is picked up after the next start.
+				os.Rename(filepath.Join(q.dir(diskCurDir), name), filepath.Join(q.dir(diskNewDir), name))
+				return
+			}
+		}
+		select {
+		case <-q.closing:
+			return
+		case <-q.notify:
+		case <-ticker.C:
+		}
+	}
+}
+
+// due returns the time a message file is due.
+func due(name string) time.Time {
+	if len(name) < 20 {
+		return time.Time{}
+	}
+	nsec, err := strconv.ParseInt(name[:20], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
+
+func (q *DiskQueue) consume() {
+	defer q.wg.Done()
+	for {
+		select {
+		case <-q.closing:
+			return
+		case name := <-q.claimed:
+			q.handle(name)
+		}
+	}
+}
+
+func (q *DiskQueue) handle(name string) {
+	path := filepath.Join(q.dir(diskCurDir), name)
+	var msg Message
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &msg)
+	}
+	if err != nil {
+		q.Logger.WithError(err).Errorf("Could not read message %s, moving it to %s", name, diskFailedDir)
+		os.Rename(path, filepath.Join(q.dir(diskFailedDir), name))
+		return
+	}
+	if tier, err := strconv.Atoi(msg.Header(diskRetryTierHeader)); err == nil {
+		delete(msg.Headers, diskRetryTierHeader)
+		q.schedule.Released(tier)
+	}
+	if err := q.handler.Handle(&msg); err != nil {
+		q.Logger.WithError(err).Errorf("Handling message %s errored", msg.Key)
+	}
+	if err := os.Remove(path); err != nil {
+		q.Logger.WithError(err).Errorf("Could not remove handled message %s", name)
+	}
+}
+
+// SetLogOutput sets the writer to which all logs are written. It must not be
+// called after Open is called.
+func (q *DiskQueue) SetLogOutput(log *logrus.Logger) {
+	q.Logger = log.WithField("prefix", "queue")
+}
@@ -0,0 +1,155 @@
+package queue
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MemoryQueue is a bounded queue inside the running process. Messages that
+// are still queued when the queue is stopped are lost, dead letters are
+// only logged. Delayed retries are kept in timers until they are due.
+type MemoryQueue struct {
+	Logger *logrus.Entry
+	Config *Config
+
+	handler  Handler
+	schedule *RetrySchedule
+	messages chan *Message
+	closing  chan struct{}
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	delayed int
+}
+
+// NewMemoryQueue returns a new instance of MemoryQueue.
+func NewMemoryQueue(c *Config) *MemoryQueue {
+	return &MemoryQueue{
+		Config:   c,
+		Logger:   logrus.New().WithField("prefix", "queue"),
+		schedule: NewRetrySchedule(c.RetryDelays, c.RetryJitter),
+		messages: make(chan *Message, c.MemorySize),
+		closing:  make(chan struct{}),
+	}
+}
+
+// Publish queues a message. It never blocks, so handlers may safely re-queue
+// messages; ErrQueueFull is returned instead.
+func (q *MemoryQueue) Publish(msg *Message) error {
+	select {
+	case <-q.closing:
+		return ErrQueueClosed
+	default:
+	}
+	select {
+	case q.messages <- msg:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// PublishRetry queues a message once the delay of its retry tier is over.
+func (q *MemoryQueue) PublishRetry(msg *Message, attempt int) error {
+	select {
+	case <-q.closing:
+		return ErrQueueClosed
+	default:
+	}
+	tier := q.schedule.Schedule(msg, attempt, time.Now())
+	q.mu.Lock()
+	q.delayed++
+	q.mu.Unlock()
+	time.AfterFunc(time.Until(msg.NotBefore()), func() { q.release(msg, tier) })
+	return nil
+}
+
+// release queues a delayed message, while the queue is full it is tried
+// again every second.
+func (q *MemoryQueue) release(msg *Message, tier int) {
+	err := q.Publish(msg)
+	if err == ErrQueueFull {
+		time.AfterFunc(time.Second, func() { q.release(msg, tier) })
+		return
+	}
+	q.mu.Lock()
+	q.delayed--
+	q.mu.Unlock()
+	if err == nil {
+		q.schedule.Released(tier)
+	}
+}
+
+// PublishDeadLetter logs the message, as dead letters are not kept in memory.
+func (q *MemoryQueue) PublishDeadLetter(msg *Message) error {
+	q.Logger.WithField("headers", msg.Headers).Errorf("Dropping dead letter %s: %s", msg.Key, msg.Value)
+	return nil
+}
+
+// Consume registers the handler for all queued messages.
+func (q *MemoryQueue) Consume(h Handler) {
+	q.handler = h
+}
+
+// Start starts the configured number of consumers.
+func (q *MemoryQueue) Start() error {
+	if err := RegisterMetrics(); err != nil {
+		return err
+	}
+	if q.handler == nil {
+		return nil
+	}
+	q.Logger.Infof("Starting %d memory queue consumers", q.Config.Concurrency)
+	for i := 0; i < q.Config.Concurrency; i++ {
+		q.wg.Add(1)
+		go q.consume()
+	}
+	return nil
+}
+
+// Stop stops all consumers after their current message has been handled.
+func (q *MemoryQueue) Stop() error {
+	close(q.closing)
+	q.wg.Wait()
+	if pending := len(q.messages); pending > 0 {
+		q.Logger.Warnf("Discarding %d queued messages", pending)
+	}
+	if delayed := q.Delayed(); delayed > 0 {
+		q.Logger.Warnf("Discarding %d delayed messages", delayed)
+	}
+	return nil
+}
+
+// Len returns the number of queued messages.
+func (q *MemoryQueue) Len() int {
+	return len(q.messages)
+}
+
+// Delayed returns the number of messages waiting for their retry.
+func (q *MemoryQueue) Delayed() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.delayed
+}
+
+func (q *MemoryQueue) consume() {
+	defer q.wg.Done()
+	for {
+		select {
+		case <-q.closing:
+			return
+		case msg := <-q.messages:
+			if err := q.handler.Handle(msg); err != nil {
+				q.Logger.WithError(err).Errorf("Handling message %s errored", msg.Key)
+			}
+		}
+	}
+}
+
+// SetLogOutput sets the writer to which all logs are written. It must not be
+// called after Open is called.
+func (q *MemoryQueue) SetLogOutput(log *logrus.Logger) {
+	q.Logger = log.WithField("prefix", "queue")
+}
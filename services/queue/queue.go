@@ -0,0 +1,111 @@
+package queue
+
+import "errors"
+
+var (
+	// ErrQueueFull is returned when a bounded queue can not take any more messages.
+	ErrQueueFull = errors.New("queue is full")
+
+	// ErrQueueClosed is returned when messages are published after the queue was stopped.
+	ErrQueueClosed = errors.New("queue is closed, not accepting any more messages")
+)
+
+// Message headers set when a mail is accepted.
+const (
+	// HeaderPartitionKey groups messages which should be consumed in order
+	// by the same consumer, like all mails to one recipient domain.
+	HeaderPartitionKey = "x-mailer-partition-key"
+
+	// HeaderAPIKey names the API key a mail was accepted with.
+	HeaderAPIKey = "x-mailer-api-key"
+)
+
+// Message is a broker independent representation of a queued mail.
+type Message struct {
+	Key     string            `json:"key"`
+	Value   []byte            `json:"value"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Header returns the value of a header or an empty string.
+func (m *Message) Header(key string) string {
+	return m.Headers[key]
+}
+
+// SetHeader sets the value of a header.
+func (m *Message) SetHeader(key, value string) {
+	if m.Headers == nil {
+		m.Headers = map[string]string{}
+	}
+	m.Headers[key] = value
+}
+
+// PartitionKey returns the partition key header, or the message key if it
+// is not set.
+func (m *Message) PartitionKey() string {
+	if key := m.Header(HeaderPartitionKey); key != "" {
+		return key
+	}
+	return m.Key
+}
+
+// Publisher publishes messages into a queue.
+type Publisher interface {
+	Publish(msg *Message) error
+}
+
+// BatchPublisher publishes many messages at once. It returns the error of
+// every message in the order of the messages.
+type BatchPublisher interface {
+	PublishBatch(msgs []*Message) []error
+}
+
+// PublishBatch publishes msgs at once if p supports it, otherwise one after
+// another.
+func PublishBatch(p Publisher, msgs []*Message) []error {
+	if bp, ok := p.(BatchPublisher); ok {
+		return bp.PublishBatch(msgs)
+	}
+	errs := make([]error, len(msgs))
+	for i, msg := range msgs {
+		errs[i] = p.Publish(msg)
+	}
+	return errs
+}
+
+// DeadLetterPublisher stores messages, which could not be delivered at all.
+type DeadLetterPublisher interface {
+	PublishDeadLetter(msg *Message) error
+}
+
+// Handler processes a single consumed message. A message counts as consumed
+// once the handler returned, so failed messages have to be re-published by
+// the handler itself.
+type Handler interface {
+	Handle(msg *Message) error
+}
+
+// HandlerFunc is an adapter to allow the use of ordinary functions as a Handler.
+type HandlerFunc func(msg *Message) error
+
+// Handle calls f(msg).
+func (f HandlerFunc) Handle(msg *Message) error {
+	return f(msg)
+}
+
+// Consumer hands consumed messages to a Handler. Consume must be called
+// before the consumer is started.
+type Consumer interface {
+	Consume(h Handler)
+}
+
+// Backend is a queue implementation, which is started and stopped like
+// every other service.
+type Backend interface {
+	Publisher
+	RetryPublisher
+	DeadLetterPublisher
+	Consumer
+	Start() error
+	Stop() error
+}
@@ -0,0 +1,171 @@
+package queue_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	itoml "github.com/influxdata/influxdb/toml"
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
+)
+
+// collect returns a handler which forwards every handled message to the returned channel.
+func collect(err error) (queue.Handler, <-chan *queue.Message) {
+	ch := make(chan *queue.Message, 10)
+	return queue.HandlerFunc(func(msg *queue.Message) error {
+		ch <- msg
+		return err
+	}), ch
+}
+
+func receive(t *testing.T, ch <-chan *queue.Message) *queue.Message {
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+	return nil
+}
+
+func testBackend(t *testing.T, q queue.Backend) {
+	h, ch := collect(nil)
+	q.Consume(h)
+	if err := q.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Stop()
+
+	if err := q.Publish(&queue.Message{Key: "abc", Value: []byte("payload")}); err != nil {
+		t.Fatal(err)
+	}
+	msg := receive(t, ch)
+	if msg.Key != "abc" || string(msg.Value) != "payload" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+}
+
+func TestMemoryQueue_PublishConsume(t *testing.T) {
+	testBackend(t, queue.NewMemoryQueue(queue.NewConfig()))
+}
+
+func TestMemoryQueue_Full(t *testing.T) {
+	c := queue.NewConfig()
+	c.MemorySize = 1
+	q := queue.NewMemoryQueue(c)
+	if err := q.Publish(&queue.Message{Key: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Publish(&queue.Message{Key: "b"}); err != queue.ErrQueueFull {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure batches are published one by one into backends without batches.
+func TestPublishBatch(t *testing.T) {
+	c := queue.NewConfig()
+	c.MemorySize = 1
+	q := queue.NewMemoryQueue(c)
+	errs := queue.PublishBatch(q, []*queue.Message{{Key: "a"}, {Key: "b"}})
+	if len(errs) != 2 || errs[0] != nil || errs[1] != queue.ErrQueueFull {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+}
+
+func newDiskConfig(t *testing.T) *queue.Config {
+	dir, err := ioutil.TempDir("", "cloudive-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := queue.NewConfig()
+	c.Backend = queue.BackendDisk
+	c.DiskPath = dir
+	return c
+}
+
+func TestDiskQueue_PublishConsume(t *testing.T) {
+	c := newDiskConfig(t)
+	defer os.RemoveAll(c.DiskPath)
+	testBackend(t, queue.NewDiskQueue(c))
+}
+
+// Ensure messages survive a restart of the queue.
+func TestDiskQueue_Durable(t *testing.T) {
+	c := newDiskConfig(t)
+	defer os.RemoveAll(c.DiskPath)
+
+	publisher := queue.NewDiskQueue(c)
+	if err := publisher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"first", "second"} {
+		if err := publisher.Publish(&queue.Message{Key: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publisher.Stop()
+
+	consumer := queue.NewDiskQueue(c)
+	h, ch := collect(errors.New("handled"))
+	consumer.Consume(h)
+	if err := consumer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Stop()
+	seen := map[string]bool{}
+	seen[receive(t, ch).Key] = true
+	seen[receive(t, ch).Key] = true
+	if !seen["first"] || !seen["second"] {
+		t.Fatalf("unexpected messages: %v", seen)
+	}
+}
+
+// testRetry ensures retried messages are held back until they are due.
+func testRetry(t *testing.T, q queue.Backend) {
+	h, ch := collect(nil)
+	q.Consume(h)
+	if err := q.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Stop()
+
+	start := time.Now()
+	if err := q.PublishRetry(&queue.Message{Key: "retry"}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Publish(&queue.Message{Key: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, ch); msg.Key != "new" {
+		t.Fatalf("unexpected message: %s", msg.Key)
+	}
+	msg := receive(t, ch)
+	if msg.Key != "retry" {
+		t.Fatalf("unexpected message: %s", msg.Key)
+	} else if time.Since(start) < 200*time.Millisecond {
+		t.Fatalf("retry released after %s", time.Since(start))
+	} else if msg.NotBefore().IsZero() {
+		t.Fatal("expected a not before header")
+	} else if len(msg.Headers) != 1 {
+		t.Fatalf("unexpected headers: %v", msg.Headers)
+	}
+}
+
+func newRetryConfig(c *queue.Config) *queue.Config {
+	c.RetryDelays = []itoml.Duration{itoml.Duration(200 * time.Millisecond)}
+	c.RetryJitter = 0
+	c.DiskPollInterval = itoml.Duration(20 * time.Millisecond)
+	return c
+}
+
+func TestMemoryQueue_Retry(t *testing.T) {
+	testRetry(t, queue.NewMemoryQueue(newRetryConfig(queue.NewConfig())))
+}
+
+func TestDiskQueue_Retry(t *testing.T) {
+	c := newRetryConfig(newDiskConfig(t))
+	defer os.RemoveAll(c.DiskPath)
+	testRetry(t, queue.NewDiskQueue(c))
+}
@@ -0,0 +1,140 @@
+package queue
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	itoml "github.com/influxdata/influxdb/toml"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HeaderNotBefore holds the time before which a message must not be handled.
+const HeaderNotBefore = "x-mailer-not-before"
+
+var (
+	retryScheduledCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailer_retry_scheduled",
+		Help: "Number of messages scheduled for a delayed retry",
+	}, []string{"tier"})
+	retryReleasedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailer_retry_released",
+		Help: "Number of delayed messages released back into the queue",
+	}, []string{"tier"})
+)
+
+// RegisterMetrics registers the retry metrics. It may be called by every
+// backend of the process.
+func RegisterMetrics() error {
+	for _, c := range []prometheus.Collector{retryScheduledCount, retryReleasedCount} {
+		if err := prometheus.Register(c); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RetryPublisher re-publishes failed messages after a delay depending on
+// the number of attempts so far.
+type RetryPublisher interface {
+	PublishRetry(msg *Message, attempt int) error
+}
+
+// NotBefore returns the time before which the message must not be handled.
+func (m *Message) NotBefore() time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, m.Header(HeaderNotBefore))
+	return t
+}
+
+// SetNotBefore sets the time before which the message must not be handled.
+func (m *Message) SetNotBefore(t time.Time) {
+	m.SetHeader(HeaderNotBefore, t.UTC().Format(time.RFC3339Nano))
+}
+
+// RetrySchedule maps delivery attempts onto tiers of increasing delays.
+type RetrySchedule struct {
+	Delays []time.Duration
+	// Jitter randomizes each delay by up to the given fraction, so
+	// messages failing together don't come back all at once.
+	Jitter float64
+}
+
+// NewRetrySchedule returns a RetrySchedule from configured delays.
+func NewRetrySchedule(delays []itoml.Duration, jitter float64) *RetrySchedule {
+	s := &RetrySchedule{Jitter: jitter}
+	for _, d := range delays {
+		s.Delays = append(s.Delays, time.Duration(d))
+	}
+	return s
+}
+
+// Tier returns the index of the delay tier used after the given attempt.
+// Attempts beyond the last tier stay in the last tier.
+func (s *RetrySchedule) Tier(attempt int) int {
+	tier := attempt - 1
+	if tier < 0 {
+		tier = 0
+	}
+	if tier >= len(s.Delays) {
+		tier = len(s.Delays) - 1
+	}
+	return tier
+}
+
+// TierName returns a short name of a tier, like "1m" or "1h".
+func (s *RetrySchedule) TierName(tier int) string {
+	if len(s.Delays) == 0 {
+		return "0s"
+	}
+	d := s.Delays[tier]
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return fmt.Sprintf("%ds", d/time.Second)
+}
+
+// Schedule sets the not before time of msg according to the tier of the
+// given attempt and returns the tier.
+func (s *RetrySchedule) Schedule(msg *Message, attempt int, now time.Time) int {
+	if len(s.Delays) == 0 {
+		msg.SetNotBefore(now)
+		return 0
+	}
+	tier := s.Tier(attempt)
+	delay := s.Delays[tier]
+	if s.Jitter > 0 {
+		delay += time.Duration(float64(delay) * s.Jitter * (2*rand.Float64() - 1))
+	}
+	msg.SetNotBefore(now.Add(delay))
+	retryScheduledCount.WithLabelValues(s.TierName(tier)).Inc()
+	return tier
+}
+
+// Released records that a message of the tier became due.
+func (s *RetrySchedule) Released(tier int) {
+	retryReleasedCount.WithLabelValues(s.TierName(tier)).Inc()
+}
+
+// Validate returns an error if the schedule is invalid.
+func (s *RetrySchedule) Validate() error {
+	if len(s.Delays) == 0 {
+		return fmt.Errorf("at least one retry delay is required")
+	}
+	for i, d := range s.Delays {
+		if d <= 0 {
+			return fmt.Errorf("retry delays must be positive")
+		}
+		if i > 0 && d < s.Delays[i-1] {
+			return fmt.Errorf("retry delays must be in increasing order")
+		}
+	}
+	if s.Jitter < 0 || s.Jitter >= 1 {
+		return fmt.Errorf("retry jitter must be between 0 and 1")
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package queue_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
+)
+
+func TestRetrySchedule_Schedule(t *testing.T) {
+	s := &queue.RetrySchedule{Delays: []time.Duration{time.Minute, 10 * time.Minute, time.Hour}}
+	now := time.Now()
+	for _, tt := range []struct {
+		attempt int
+		tier    int
+		name    string
+	}{
+		{1, 0, "1m"},
+		{2, 1, "10m"},
+		{3, 2, "1h"},
+		{7, 2, "1h"},
+	} {
+		msg := &queue.Message{}
+		if tier := s.Schedule(msg, tt.attempt, now); tier != tt.tier {
+			t.Fatalf("attempt %d: unexpected tier %d", tt.attempt, tier)
+		} else if name := s.TierName(tier); name != tt.name {
+			t.Fatalf("attempt %d: unexpected tier name %s", tt.attempt, name)
+		} else if !msg.NotBefore().Equal(now.Add(s.Delays[tier])) {
+			t.Fatalf("attempt %d: unexpected not before %s", tt.attempt, msg.NotBefore())
+		}
+	}
+}
+
+func TestRetrySchedule_Jitter(t *testing.T) {
+	s := &queue.RetrySchedule{Delays: []time.Duration{time.Minute}, Jitter: 0.5}
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		msg := &queue.Message{}
+		s.Schedule(msg, 1, now)
+		if d := msg.NotBefore().Sub(now); d < 30*time.Second || d > 90*time.Second {
+			t.Fatalf("delay out of jitter range: %s", d)
+		}
+	}
+}
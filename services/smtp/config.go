@@ -1,5 +1,12 @@
 package smtp
 
+import (
+	"fmt"
+	"time"
+
+	itoml "github.com/influxdata/influxdb/toml"
+)
+
 const (
 	DefaultFromEmail              = "info@cloudive.cc"
 	DefaultFromName               = "Cloudive"
@@ -7,6 +14,35 @@ const (
 	DefaultSmtpPort               = 25
 	DefaultHostName               = "mailcatcher"
 	DefaultDomainWhitelistEnabled = false
+
+	// DefaultPoolSize defines how many connections to the relay are kept open
+	DefaultPoolSize = 4
+
+	// DefaultPoolMaxMessages defines after how many mails a connection is replaced
+	DefaultPoolMaxMessages = 100
+
+	// DefaultPoolIdleTimeout defines how long idle connections are kept open
+	DefaultPoolIdleTimeout = 30 * time.Second
+
+	// DefaultTransport defines how mails leave the worker
+	DefaultTransport = TransportRelay
+
+	// DefaultMXPort defines the port of MX hosts
+	DefaultMXPort = 25
+
+	// DefaultBreakerThreshold defines after how many failures in a row a relay is skipped
+	DefaultBreakerThreshold = 5
+
+	// DefaultBreakerCooldown defines how long a failing relay is skipped
+	DefaultBreakerCooldown = time.Minute
+)
+
+// Transports of the worker.
+const (
+	// TransportRelay delivers through the configured relays.
+	TransportRelay = "relay"
+	// TransportMX delivers straight to the MX hosts of the recipients.
+	TransportMX = "mx"
 )
 
 // Config represents a configuration for a HTTP service.
@@ -20,17 +56,72 @@ type Config struct {
 	FromMail                         string   `toml:"from-mail"`
 	AttachmentDomainWhitelistEnabled bool     `toml:"domain-whitelist-enabled"`
 	DomainWhitelist                  []string `toml:"domain-whitelist"`
+	// EmbedImages embeds remote images of HTML bodies into the message,
+	// so clients don't have to load them.
+	EmbedImages bool `toml:"embed-images"`
+
+	// Transport is relay to deliver through the relays or mx to deliver
+	// straight to the MX hosts of the recipient domains.
+	Transport string `toml:"transport"`
+	MXPort    int    `toml:"mx-port"`
+	// LocalName is sent with EHLO, by default localhost is sent to relays
+	// and the hostname of the machine to MX hosts.
+	LocalName string `toml:"local-name"`
+
+	// PoolSize limits the connections kept open to the relay, 0 opens a
+	// new connection for every mail.
+	PoolSize        int            `toml:"pool-size"`
+	PoolMaxMessages int            `toml:"pool-max-messages"`
+	PoolIdleTimeout itoml.Duration `toml:"pool-idle-timeout"`
+
+	TLS TLSConfig `toml:"tls"`
+	// DKIM signs mails of the configured domains.
+	DKIM DKIMConfig `toml:"dkim"`
+
+	// Relays replace the relay of the settings above. Mails fail over to
+	// the next relay on network errors and 4xx replies.
+	Relays []RelayConfig `toml:"relay"`
+	Routes []RouteConfig `toml:"route"`
+	// BreakerThreshold failures in a row make the worker skip a relay for
+	// BreakerCooldown, 0 never skips relays.
+	BreakerThreshold int            `toml:"breaker-threshold"`
+	BreakerCooldown  itoml.Duration `toml:"breaker-cooldown"`
 }
 
 // NewConfig returns a new Config with default settings.
 func NewConfig() Config {
 	return Config{
 		AttachmentDomainWhitelistEnabled: DefaultDomainWhitelistEnabled,
-		Enabled:         DefaultEnabled,
-		Port:            DefaultSmtpPort,
-		Hostname:        DefaultHostName,
-		FromMail:        DefaultFromEmail,
-		FromName:        DefaultFromName,
-		DomainWhitelist: []string{},
+		Enabled:                          DefaultEnabled,
+		Port:                             DefaultSmtpPort,
+		Hostname:                         DefaultHostName,
+		FromMail:                         DefaultFromEmail,
+		FromName:                         DefaultFromName,
+		DomainWhitelist:                  []string{},
+		PoolSize:                         DefaultPoolSize,
+		PoolMaxMessages:                  DefaultPoolMaxMessages,
+		PoolIdleTimeout:                  itoml.Duration(DefaultPoolIdleTimeout),
+		TLS:                              NewTLSConfig(),
+		DKIM:                             NewDKIMConfig(),
+		Transport:                        DefaultTransport,
+		MXPort:                           DefaultMXPort,
+		BreakerThreshold:                 DefaultBreakerThreshold,
+		BreakerCooldown:                  itoml.Duration(DefaultBreakerCooldown),
+	}
+}
+
+// Validate returns an error if the config is invalid.
+func (c Config) Validate() error {
+	if err := c.TLS.Validate(); err != nil {
+		return err
+	}
+	if err := c.DKIM.Validate(); err != nil {
+		return err
+	}
+	switch c.Transport {
+	case TransportRelay, TransportMX:
+	default:
+		return fmt.Errorf("unknown transport %q", c.Transport)
 	}
+	return c.validateRelays()
 }
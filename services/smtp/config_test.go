@@ -0,0 +1,133 @@
+package smtp_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nirnanaaa/cloudive-mailer/services/smtp"
+)
+
+func TestConfig_Parse(t *testing.T) {
+	// Parse configuration.
+	c := smtp.NewConfig()
+	if _, err := toml.Decode(`
+		hostname = "relay.example.com"
+		port = 587
+		pool-size = 8
+		pool-max-messages = 50
+		pool-idle-timeout = "1m"
+		transport = "mx"
+		mx-port = 2525
+		local-name = "mailer.example.com"
+`, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	// Validate configuration.
+	if c.Hostname != "relay.example.com" || c.Port != 587 {
+		t.Fatalf("unexpected relay: %s:%d", c.Hostname, c.Port)
+	} else if c.PoolSize != 8 || c.PoolMaxMessages != 50 || time.Duration(c.PoolIdleTimeout) != time.Minute {
+		t.Fatalf("unexpected pool: %d %d %s", c.PoolSize, c.PoolMaxMessages, time.Duration(c.PoolIdleTimeout))
+	} else if c.Transport != smtp.TransportMX || c.MXPort != 2525 || c.LocalName != "mailer.example.com" {
+		t.Fatalf("unexpected transport: %s %d %s", c.Transport, c.MXPort, c.LocalName)
+	} else if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Transport = "pigeon"
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected an error for an unknown transport")
+	}
+}
+
+func TestConfig_ParseRelays(t *testing.T) {
+	c := smtp.NewConfig()
+	if _, err := toml.Decode(`
+		breaker-threshold = 3
+		breaker-cooldown = "30s"
+
+		[[relay]]
+		name = "ses"
+		hostname = "email-smtp.eu-west-1.amazonaws.com"
+		port = 587
+		weight = 3
+
+		[[relay]]
+		name = "postmark"
+		hostname = "smtp.postmarkapp.com"
+		port = 587
+		priority = 1
+		[relay.tls]
+		mode = "starttls"
+
+		[[route]]
+		tags = ["bulk"]
+		relays = ["ses"]
+`, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.BreakerThreshold != 3 || time.Duration(c.BreakerCooldown) != 30*time.Second {
+		t.Fatalf("unexpected breaker: %d %s", c.BreakerThreshold, time.Duration(c.BreakerCooldown))
+	} else if relays := c.RelayConfigs(); len(relays) != 2 || relays[0].Weight != 3 || relays[1].Priority != 1 {
+		t.Fatalf("unexpected relays: %+v", relays)
+	} else if relays[1].TLS == nil || relays[1].TLS.Mode != smtp.TLSModeStartTLS {
+		t.Fatalf("unexpected TLS policy: %+v", relays[1].TLS)
+	} else if len(c.Routes) != 1 || c.Routes[0].Tags[0] != "bulk" {
+		t.Fatalf("unexpected routes: %+v", c.Routes)
+	} else if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Routes[0].Relays = []string{"sendgrid"}
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected an error for an unknown relay")
+	}
+	c.Routes = nil
+	c.Relays = append(c.Relays, smtp.RelayConfig{Name: "ses", Hostname: "localhost"})
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected an error for a duplicate relay")
+	}
+}
+
+func TestConfig_DefaultRelay(t *testing.T) {
+	c := smtp.NewConfig()
+	relays := c.RelayConfigs()
+	if len(relays) != 1 || relays[0].Name != smtp.DefaultRelayName || relays[0].Hostname != smtp.DefaultHostName {
+		t.Fatalf("unexpected relays: %+v", relays)
+	}
+}
+
+func TestConfig_ParseDKIM(t *testing.T) {
+	c := smtp.NewConfig()
+	if _, err := toml.Decode(`
+		[dkim]
+		enabled = true
+		headers = ["From", "To", "Subject"]
+
+		[[dkim.key]]
+		domain = "example.com"
+		selector = "mailer"
+		key-file = "/etc/cloudive/dkim/example.com.pem"
+`, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.DKIM.Enabled || len(c.DKIM.Headers) != 3 {
+		t.Fatalf("unexpected DKIM config: %+v", c.DKIM)
+	} else if len(c.DKIM.Keys) != 1 || c.DKIM.Keys[0].Selector != "mailer" {
+		t.Fatalf("unexpected keys: %+v", c.DKIM.Keys)
+	} else if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.DKIM.Keys = append(c.DKIM.Keys, smtp.DKIMKeyConfig{Domain: "Example.com", Selector: "s2", KeyFile: "k"})
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected an error for a duplicate domain")
+	}
+	c.DKIM.Keys = []smtp.DKIMKeyConfig{{Domain: "example.com"}}
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected an error for an incomplete key")
+	}
+}
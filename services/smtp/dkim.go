@@ -0,0 +1,330 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// DKIM signing algorithms, see RFC 6376 and RFC 8463.
+const (
+	DKIMAlgorithmRSA     = "rsa-sha256"
+	DKIMAlgorithmEd25519 = "ed25519-sha256"
+)
+
+// DefaultDKIMHeaders are the headers signed by default.
+var DefaultDKIMHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"Mime-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// DKIMConfig represents the keys messages are signed with.
+type DKIMConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Headers are the names of the signed headers. From is always signed.
+	Headers []string        `toml:"headers"`
+	Keys    []DKIMKeyConfig `toml:"key"`
+}
+
+// DKIMKeyConfig is the key of a signing domain. Messages are signed with
+// the key of their From domain, or of its closest parent domain.
+type DKIMKeyConfig struct {
+	Domain   string `toml:"domain"`
+	Selector string `toml:"selector"`
+	// KeyFile is a PEM encoded RSA or Ed25519 private key, or the base64
+	// encoded seed of an Ed25519 key.
+	KeyFile string `toml:"key-file"`
+}
+
+// NewDKIMConfig returns a new DKIMConfig with default settings.
+func NewDKIMConfig() DKIMConfig {
+	return DKIMConfig{
+		Headers: DefaultDKIMHeaders,
+	}
+}
+
+// Validate returns an error if a key is incomplete.
+func (c DKIMConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	domains := map[string]bool{}
+	for _, k := range c.Keys {
+		if k.Domain == "" || k.Selector == "" || k.KeyFile == "" {
+			return errors.New("every DKIM key needs a domain, a selector and a key-file")
+		} else if domains[strings.ToLower(k.Domain)] {
+			return fmt.Errorf("DKIM key of %s is configured twice", k.Domain)
+		}
+		domains[strings.ToLower(k.Domain)] = true
+	}
+	return nil
+}
+
+// DKIMSigner adds a DKIM-Signature header to rendered messages, using
+// relaxed/relaxed canonicalization.
+type DKIMSigner struct {
+	headers []string
+	keys    map[string]*dkimKey
+}
+
+type dkimKey struct {
+	domain    string
+	selector  string
+	algorithm string
+	signer    crypto.Signer
+}
+
+// NewDKIMSigner loads the keys of c.
+func NewDKIMSigner(c DKIMConfig) (*DKIMSigner, error) {
+	s := &DKIMSigner{keys: make(map[string]*dkimKey)}
+	seen := map[string]bool{}
+	for _, h := range append([]string{"From"}, c.Headers...) {
+		if key := strings.ToLower(h); !seen[key] {
+			seen[key] = true
+			s.headers = append(s.headers, h)
+		}
+	}
+	for _, k := range c.Keys {
+		data, err := ioutil.ReadFile(k.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseDKIMKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("DKIM key of %s: %s", k.Domain, err)
+		}
+		key.domain, key.selector = strings.ToLower(k.Domain), k.Selector
+		s.keys[key.domain] = key
+	}
+	return s, nil
+}
+
+// oidEd25519 identifies Ed25519 keys, see RFC 8410.
+var oidEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+
+// pkcs8 is a PKCS #8 private key, see RFC 5208 and RFC 5958.
+type pkcs8 struct {
+	Version    int
+	Algo       pkix.AlgorithmIdentifier
+	PrivateKey []byte
+	// attributes and the public key of RFC 5958
+	Optional []asn1.RawValue `asn1:"optional"`
+}
+
+// parseDKIMKey reads an RSA or Ed25519 private key.
+func parseDKIMKey(data []byte) (*dkimKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, errors.New("no PEM encoded key or Ed25519 seed found")
+		}
+		return &dkimKey{algorithm: DKIMAlgorithmEd25519, signer: ed25519.NewKeyFromSeed(seed)}, nil
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return &dkimKey{algorithm: DKIMAlgorithmRSA, signer: key}, nil
+	}
+	// Ed25519 keys are parsed here, as x509 only knows them since Go 1.13
+	// and then returns the type of crypto/ed25519.
+	var info pkcs8
+	if _, err := asn1.Unmarshal(block.Bytes, &info); err == nil && info.Algo.Algorithm.Equal(oidEd25519) {
+		var seed []byte
+		if _, err := asn1.Unmarshal(info.PrivateKey, &seed); err != nil || len(seed) != ed25519.SeedSize {
+			return nil, errors.New("invalid Ed25519 private key")
+		}
+		return &dkimKey{algorithm: DKIMAlgorithmEd25519, signer: ed25519.NewKeyFromSeed(seed)}, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if key, ok := parsed.(*rsa.PrivateKey); ok {
+		return &dkimKey{algorithm: DKIMAlgorithmRSA, signer: key}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", parsed)
+}
+
+// key returns the key of domain or of its closest parent domain.
+func (s *DKIMSigner) key(domain string) *dkimKey {
+	domain = strings.ToLower(domain)
+	for {
+		if key, ok := s.keys[domain]; ok {
+			return key
+		}
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			return nil
+		}
+		domain = domain[i+1:]
+	}
+}
+
+// Sign returns msg with a DKIM-Signature header for the key of the From
+// domain. Messages from domains without a key are returned as they are.
+func (s *DKIMSigner) Sign(msg []byte, fromDomain string, now time.Time) ([]byte, error) {
+	key := s.key(fromDomain)
+	if key == nil {
+		return msg, nil
+	}
+	header, body := splitMessage(msg)
+	bodyHash := sha256.Sum256(relaxedBody(body))
+
+	fields := parseHeader(header)
+	var signed []string
+	hash := sha256.New()
+	for _, name := range s.headers {
+		// multiple instances are signed from the bottom up, see RFC 6376
+		// section 5.4.2
+		for i := len(fields) - 1; i >= 0; i-- {
+			if strings.EqualFold(fields[i].name, name) {
+				hash.Write([]byte(relaxedHeader(fields[i].name, fields[i].value)))
+				signed = append(signed, strings.ToLower(name))
+			}
+		}
+	}
+	tags := []string{
+		"v=1",
+		"a=" + key.algorithm,
+		"c=relaxed/relaxed",
+		"d=" + key.domain,
+		"s=" + key.selector,
+		fmt.Sprintf("t=%d", now.Unix()),
+		"h=" + strings.Join(signed, ":"),
+		"bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]),
+		"b=",
+	}
+	value := strings.Join(tags, "; ")
+	// the signature header is signed without its trailing CRLF
+	hash.Write([]byte(strings.TrimSuffix(relaxedHeader("DKIM-Signature", value), "\r\n")))
+	digest := hash.Sum(nil)
+
+	var sig []byte
+	var err error
+	switch key.algorithm {
+	case DKIMAlgorithmEd25519:
+		// Ed25519 signs the hash itself, see RFC 8463 section 3
+		sig, err = key.signer.Sign(rand.Reader, digest, crypto.Hash(0))
+	default:
+		sig, err = key.signer.Sign(rand.Reader, digest, crypto.SHA256)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.WriteString("DKIM-Signature: " + strings.Join(tags[:len(tags)-1], ";\r\n ") + ";\r\n b=")
+	// folding whitespace is ignored inside the signature
+	b := base64.StdEncoding.EncodeToString(sig)
+	for len(b) > 72 {
+		out.WriteString(b[:72] + "\r\n  ")
+		b = b[72:]
+	}
+	out.WriteString(b + "\r\n")
+	out.Write(msg)
+	return out.Bytes(), nil
+}
+
+// splitMessage splits msg into its header, including the final CRLF, and
+// its body.
+func splitMessage(msg []byte) ([]byte, []byte) {
+	if i := bytes.Index(msg, []byte("\r\n\r\n")); i >= 0 {
+		return msg[:i+2], msg[i+4:]
+	}
+	return msg, nil
+}
+
+type headerField struct {
+	name  string
+	value string
+}
+
+// parseHeader returns the fields of a header with their folded values.
+func parseHeader(header []byte) []headerField {
+	var fields []headerField
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].value += line
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		fields = append(fields, headerField{name: line[:i], value: line[i+1:]})
+	}
+	return fields
+}
+
+// relaxedHeader canonicalizes a header field, see RFC 6376 section 3.4.2.
+func relaxedHeader(name, value string) string {
+	value = strings.Replace(value, "\r\n", "", -1)
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(collapseWSP(value)) + "\r\n"
+}
+
+// relaxedBody canonicalizes a body, see RFC 6376 section 3.4.4.
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(collapseWSP(line), " ")
+	}
+	// empty lines at the end of the body are ignored
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// collapseWSP replaces all sequences of spaces and tabs by a single space.
+func collapseWSP(s string) string {
+	var buf bytes.Buffer
+	space := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			buf.WriteByte(' ')
+			space = false
+		}
+		buf.WriteByte(s[i])
+	}
+	if space {
+		buf.WriteByte(' ')
+	}
+	return buf.String()
+}
+
+// renderedMessage is a message which has been rendered already, so it can
+// be sent any number of times.
+type renderedMessage []byte
+
+func (m renderedMessage) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(m)
+	return int64(n), err
+}
@@ -0,0 +1,91 @@
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	gomail "gopkg.in/gomail.v2"
+)
+
+// embedImages embeds the remote sources of all images in body into m and
+// replaces them with cid: references. Images from the same URL are only
+// embedded once, sources which aren't whitelisted are kept.
+func (s *Service) embedImages(m *gomail.Message, body string) string {
+	var buf bytes.Buffer
+	cids := map[string]string{}
+	z := html.NewTokenizer(strings.NewReader(body))
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			if z.Err() != io.EOF {
+				return body
+			}
+			return buf.String()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			// reading the token lowercases the raw tag name in place
+			raw := string(z.Raw())
+			tok := z.Token()
+			if tok.DataAtom == atom.Img && s.embedImage(m, &tok, cids) {
+				buf.WriteString(tok.String())
+				continue
+			}
+			buf.WriteString(raw)
+		default:
+			buf.Write(z.Raw())
+		}
+	}
+}
+
+// embedImage embeds the source of the img tag tok and points it to the
+// embedded image. It returns false if the source is kept.
+func (s *Service) embedImage(m *gomail.Message, tok *html.Token, cids map[string]string) bool {
+	for i, a := range tok.Attr {
+		if a.Key != "src" {
+			continue
+		}
+		src := strings.TrimSpace(a.Val)
+		cid, ok := cids[src]
+		if !ok {
+			u, err := url.Parse(src)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return false
+			}
+			if s.Config.AttachmentDomainWhitelistEnabled {
+				if err := s.CheckAttachmentForDomainWhitelist(src); err != nil {
+					logrus.WithError(err).Debugf("Not embedding image %s", src)
+					return false
+				}
+			}
+			cid = fmt.Sprintf("image%d", len(cids)+1)
+			cids[src] = cid
+			name := path.Base(u.Path)
+			if name == "." || name == "/" {
+				name = cid
+			}
+			m.Embed(name,
+				gomail.SetHeader(map[string][]string{"Content-ID": {"<" + cid + ">"}}),
+				gomail.SetCopyFunc(func(w io.Writer) error {
+					r, err := s.DownloadAttachment(src)
+					if err != nil {
+						return err
+					}
+					if c, ok := r.(io.Closer); ok {
+						defer c.Close()
+					}
+					_, err = io.Copy(w, r)
+					return err
+				}))
+		}
+		tok.Attr[i].Val = "cid:" + cid
+		return true
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package smtp
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/kafka/event"
+)
+
+func TestService_EmbedImages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("image data"))
+	}))
+	defer server.Close()
+
+	c := NewConfig()
+	c.EmbedImages = true
+	s := NewService(c)
+	m := s.newMessage(&event.InboundEmailEvent{
+		Sender:    event.Contact{Email: "sender@example.com"},
+		Recipient: event.Contact{Email: "to@example.com"},
+		HTML: `<p><IMG src="` + server.URL + `/logo.png" alt="Logo"><img src="` + server.URL + `/logo.png"/>` +
+			`<img src="cid:other"></p>`,
+	})
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, expected := range []string{
+		`<img src=3D"cid:image1" alt=3D"Logo"><img src=3D"cid:image1"/>`,
+		`"cid:other"`,
+		"Content-ID: <image1>",
+		`filename="logo.png"`,
+		"aW1hZ2UgZGF0YQ==",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("expected %q in message:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, "image2") {
+		t.Fatalf("image embedded twice:\n%s", out)
+	}
+}
@@ -0,0 +1,83 @@
+package smtp
+
+import (
+	"fmt"
+	"net/textproto"
+	"regexp"
+	"strconv"
+)
+
+// Class tells whether a failed delivery is worth trying again.
+type Class string
+
+const (
+	// ClassPermanent failures are rejected by the server with a 5xx code,
+	// trying again won't change anything.
+	ClassPermanent Class = "permanent"
+
+	// ClassTransient failures are rejected by the server with a 4xx code,
+	// they might succeed later.
+	ClassTransient Class = "transient"
+
+	// ClassNetwork failures didn't get an answer from the server, like
+	// connection timeouts. They might succeed later.
+	ClassNetwork Class = "network"
+)
+
+// enhancedStatusCode matches an RFC 3463 status code at the start of a reply.
+var enhancedStatusCode = regexp.MustCompile(`^([245])\.(\d{1,3})\.(\d{1,3})\b`)
+
+// DeliveryError is a failed delivery, classified by the SMTP reply.
+type DeliveryError struct {
+	// Code is the SMTP reply code, 0 if the server didn't reply.
+	Code int
+	// Status is the enhanced status code like "5.1.1", if the server sent one.
+	Status string
+	Class  Class
+	// Recipient is set when the server rejected this recipient rather
+	// than the whole session or message.
+	Recipient string
+	Err       error
+}
+
+func (e *DeliveryError) Error() string {
+	return e.Err.Error()
+}
+
+// Permanent reports whether the delivery must not be retried.
+func (e *DeliveryError) Permanent() bool {
+	return e.Class == ClassPermanent
+}
+
+// Classify turns err into a DeliveryError. The enhanced status code is
+// preferred over the reply code, as it is more specific. Errors without a
+// reply from the server are network errors.
+func Classify(err error) *DeliveryError {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *DeliveryError:
+		return e
+	case *textproto.Error:
+		de := &DeliveryError{Code: e.Code, Err: err}
+		class := e.Code / 100
+		if m := enhancedStatusCode.FindStringSubmatch(e.Msg); m != nil {
+			de.Status = m[0]
+			class, _ = strconv.Atoi(m[1])
+		}
+		switch class {
+		case 5:
+			de.Class = ClassPermanent
+		default:
+			de.Class = ClassTransient
+		}
+		return de
+	}
+	return &DeliveryError{Class: ClassNetwork, Err: err}
+}
+
+// permanentErrorf returns a permanent DeliveryError which is not caused by
+// the server, like a message without any recipients.
+func permanentErrorf(format string, a ...interface{}) *DeliveryError {
+	return &DeliveryError{Class: ClassPermanent, Err: fmt.Errorf(format, a...)}
+}
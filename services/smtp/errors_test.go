@@ -0,0 +1,39 @@
+package smtp_test
+
+import (
+	"errors"
+	"io"
+	"net/textproto"
+	"testing"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/smtp"
+)
+
+func TestClassify(t *testing.T) {
+	for _, tt := range []struct {
+		err    error
+		class  smtp.Class
+		code   int
+		status string
+	}{
+		{&textproto.Error{Code: 550, Msg: "5.1.1 user unknown"}, smtp.ClassPermanent, 550, "5.1.1"},
+		{&textproto.Error{Code: 421, Msg: "try again later"}, smtp.ClassTransient, 421, ""},
+		{&textproto.Error{Code: 452, Msg: "4.2.2 mailbox full"}, smtp.ClassTransient, 452, "4.2.2"},
+		// the enhanced status code is more specific than the reply code
+		{&textproto.Error{Code: 550, Msg: "4.7.1 greylisted"}, smtp.ClassTransient, 550, "4.7.1"},
+		{&textproto.Error{Code: 554, Msg: "transaction failed"}, smtp.ClassPermanent, 554, ""},
+		{io.EOF, smtp.ClassNetwork, 0, ""},
+		{errors.New("dial tcp: connection refused"), smtp.ClassNetwork, 0, ""},
+	} {
+		de := smtp.Classify(tt.err)
+		if de.Class != tt.class || de.Code != tt.code || de.Status != tt.status {
+			t.Errorf("%v: unexpected classification %+v", tt.err, de)
+		}
+		if de.Error() != tt.err.Error() {
+			t.Errorf("%v: unexpected message %s", tt.err, de.Error())
+		}
+	}
+	if smtp.Classify(nil) != nil {
+		t.Error("expected no classification without error")
+	}
+}
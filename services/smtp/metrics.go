@@ -0,0 +1,34 @@
+package smtp
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	relayDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailer_smtp_relay_deliveries",
+		Help: "Number of deliveries by relay and result, which is delivered or the class of the SMTP error",
+	}, []string{"relay", "result"})
+	relayDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "mailer_smtp_relay_duration",
+		Help: "Time it takes to deliver a mail through a relay",
+	}, []string{"relay"})
+	relayFailovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailer_smtp_relay_failovers",
+		Help: "Number of mails which failed over from a relay to the next one",
+	}, []string{"relay"})
+	relayUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mailer_smtp_relay_up",
+		Help: "Whether a relay is used (1) or skipped by its circuit breaker (0)",
+	}, []string{"relay"})
+)
+
+// RegisterMetrics registers the relay metrics.
+func RegisterMetrics() error {
+	for _, c := range []prometheus.Collector{relayDeliveries, relayDuration, relayFailovers, relayUp} {
+		if err := prometheus.Register(c); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Resolver looks up the hosts mails to a domain are delivered to.
+type Resolver interface {
+	LookupMX(domain string) ([]*net.MX, error)
+	LookupHost(host string) ([]string, error)
+}
+
+// netResolver resolves through the resolver of the system.
+type netResolver struct{}
+
+func (netResolver) LookupMX(domain string) ([]*net.MX, error) { return net.LookupMX(domain) }
+func (netResolver) LookupHost(host string) ([]string, error)  { return net.LookupHost(host) }
+
+// MXTransport delivers mails straight to the MX hosts of the recipient
+// domains instead of a relay. The hosts of a domain are tried in order of
+// their preference until one of them answers without a 4xx reply.
+type MXTransport struct {
+	Resolver Resolver
+	Port     int
+	// LocalName is sent with EHLO, MX hosts often reject localhost.
+	LocalName string
+	TLSConfig *tls.Config
+	StartTLS  StartTLSPolicy
+}
+
+// NewMXTransport returns a new MXTransport using the resolver of the system.
+func NewMXTransport(port int, localName string) *MXTransport {
+	return &MXTransport{
+		Resolver:  netResolver{},
+		Port:      port,
+		LocalName: localName,
+	}
+}
+
+// Deliver sends msg to the MX hosts of every recipient domain. It also fails
+// when some domains accepted msg, but others failed with a temporary error:
+// the report lists the accepted recipients, so only the others are retried.
+func (t *MXTransport) Deliver(from string, to []string, msg io.WriterTo) (*DeliveryReport, error) {
+	var domains []string
+	recipients := map[string][]string{}
+	for _, addr := range to {
+		d := strings.ToLower(domain(addr))
+		if _, ok := recipients[d]; !ok {
+			domains = append(domains, d)
+		}
+		recipients[d] = append(recipients[d], addr)
+	}
+
+	report := &DeliveryReport{}
+	var lastErr *DeliveryError
+	for _, d := range domains {
+		r, err := t.deliverDomain(d, from, recipients[d], msg)
+		if err != nil {
+			de := Classify(err)
+			if lastErr == nil || !de.Permanent() {
+				lastErr = de
+			}
+			if r == nil {
+				r = failedReport(recipients[d], de)
+			}
+		}
+		report.Recipients = append(report.Recipients, r.Recipients...)
+	}
+	if lastErr != nil && (!lastErr.Permanent() || len(report.Accepted()) == 0) {
+		return report, lastErr
+	}
+	return report, nil
+}
+
+// deliverDomain sends msg to the recipients of one domain, trying all of its
+// hosts until one of them doesn't fail with a network error or 4xx reply.
+func (t *MXTransport) deliverDomain(domain, from string, to []string, msg io.WriterTo) (*DeliveryReport, error) {
+	hosts, err := t.hosts(domain)
+	if err != nil {
+		return nil, err
+	}
+	var report *DeliveryReport
+	for _, host := range hosts {
+		d := NewDialer(host, t.Port, "", "")
+		d.LocalName = t.LocalName
+		d.TLSConfig = t.TLSConfig
+		d.StartTLS = t.StartTLS
+		report, err = d.DialAndDeliver(from, to, msg)
+		// once some recipients accepted msg, the next host would deliver it
+		// to them twice
+		if err == nil || Classify(err).Permanent() || delivered(report) {
+			return report, err
+		}
+	}
+	return report, err
+}
+
+// hosts returns the MX hosts of domain in order of their preference. Domains
+// without MX records are their own host, see RFC 5321 section 5.1.
+func (t *MXTransport) hosts(domain string) ([]string, error) {
+	mxs, err := t.Resolver.LookupMX(domain)
+	if err != nil && !notFound(err) {
+		return nil, &DeliveryError{Class: ClassTransient, Err: fmt.Errorf("looking up MX records of %s failed: %s", domain, err)}
+	}
+	if len(mxs) == 0 {
+		if _, err := t.Resolver.LookupHost(domain); err != nil {
+			if notFound(err) {
+				return nil, permanentErrorf("domain %s has neither MX nor address records", domain)
+			}
+			return nil, &DeliveryError{Class: ClassTransient, Err: fmt.Errorf("looking up %s failed: %s", domain, err)}
+		}
+		return []string{domain}, nil
+	}
+	// a single MX record with the root as host doesn't accept any mail, see RFC 7505
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return nil, permanentErrorf("domain %s does not accept mail", domain)
+	}
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+	}
+	return hosts, nil
+}
+
+// notFound returns true if err shows a name doesn't exist, rather than the
+// lookup failing.
+func notFound(err error) bool {
+	de, ok := err.(*net.DNSError)
+	return ok && !de.Timeout() && !de.Temporary()
+}
+
+// rejectAll marks the accepted recipients of report as rejected by err.
+func rejectAll(report *DeliveryReport, err *DeliveryError) {
+	for i, r := range report.Recipients {
+		if r.Accepted {
+			report.Recipients[i] = RecipientResult{
+				Email:  r.Email,
+				Error:  err.Error(),
+				Code:   err.Code,
+				Status: err.Status,
+				Class:  err.Class,
+			}
+		}
+	}
+}
+
+// delivered returns true if any recipient of report accepted the message.
+func delivered(report *DeliveryReport) bool {
+	return report != nil && len(report.Accepted()) > 0
+}
+
+// failedReport reports all recipients as rejected by err.
+func failedReport(to []string, err *DeliveryError) *DeliveryReport {
+	report := &DeliveryReport{}
+	for _, addr := range to {
+		report.Recipients = append(report.Recipients, RecipientResult{
+			Email:  addr,
+			Error:  err.Error(),
+			Code:   err.Code,
+			Status: err.Status,
+			Class:  err.Class,
+		})
+	}
+	return report
+}
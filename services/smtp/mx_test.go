@@ -0,0 +1,173 @@
+package smtp
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// fakeResolver answers lookups from maps, names which aren't listed don't
+// exist.
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+	err   error
+}
+
+func (r *fakeResolver) LookupMX(domain string) ([]*net.MX, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if mx, ok := r.mx[domain]; ok {
+		return mx, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: domain}
+}
+
+func (r *fakeResolver) LookupHost(host string) ([]string, error) {
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host}
+}
+
+func newTestMX() *MXTransport {
+	t := NewMXTransport(25, "mailer.example.com")
+	t.Resolver = &fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {{Host: "mx2.example.com.", Pref: 20}, {Host: "mx1.example.com.", Pref: 10}},
+			"null.com":    {{Host: ".", Pref: 0}},
+			"busy.com":    {{Host: "mx.busy.com.", Pref: 10}},
+		},
+		hosts: map[string][]string{"a-only.com": {"192.0.2.1"}},
+	}
+	return t
+}
+
+func TestMXTransport_Preference(t *testing.T) {
+	var dialed []string
+	defer stubRelays(map[string]bool{"mx1.example.com": true}, nil, &dialed)()
+
+	report, err := newTestMX().Deliver("from@shop.com", []string{"to@example.com", "other@EXAMPLE.com", "to@a-only.com"}, strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(report.Accepted()) != 3 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	// recipients of a domain are sent at once, domains without MX records
+	// are their own host
+	if got := strings.Join(dialed, " "); got != "mx1.example.com mx2.example.com a-only.com" {
+		t.Fatalf("unexpected hosts: %s", got)
+	}
+}
+
+func TestMXTransport_Failures(t *testing.T) {
+	var dialed []string
+	defer stubRelays(nil, nil, &dialed)()
+	mx := newTestMX()
+
+	// some domains don't accept mail, the others still get it
+	report, err := mx.Deliver("from@shop.com", []string{"to@example.com", "to@null.com", "to@missing.com"}, strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(report.Accepted()) != 1 || len(report.Rejected()) != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	} else if r := report.Rejected()[0]; r.Class != ClassPermanent || !strings.Contains(r.Error, "does not accept mail") {
+		t.Fatalf("unexpected rejection: %+v", r)
+	}
+
+	_, err = mx.Deliver("from@shop.com", []string{"to@missing.com"}, strings.NewReader("body"))
+	if de := Classify(err); de == nil || !de.Permanent() {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	mx.Resolver.(*fakeResolver).err = &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}
+	_, err = mx.Deliver("from@shop.com", []string{"to@example.com"}, strings.NewReader("body"))
+	if de := Classify(err); de == nil || de.Class != ClassTransient {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestMXTransport_DataRejected(t *testing.T) {
+	var dialed []string
+	defer stubRelays(nil, nil, &dialed)()
+	newClient := smtpNewClient
+	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
+		c, err := newClient(conn, host)
+		c.(*mockClient).dataErr = &textproto.Error{Code: 554, Msg: "5.7.1 message rejected as spam"}
+		return c, err
+	}
+
+	// the recipients were accepted before the message was rejected
+	report, err := newTestMX().Deliver("from@shop.com", []string{"to@example.com"}, strings.NewReader("body"))
+	if de := Classify(err); de == nil || !de.Permanent() || de.Status != "5.7.1" {
+		t.Fatalf("unexpected error: %v", err)
+	} else if len(report.Accepted()) != 0 || len(report.Rejected()) != 1 || report.Rejected()[0].Code != 554 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+}
+
+func TestMXTransport_PartiallyDeferred(t *testing.T) {
+	var dialed []string
+	defer stubRelays(map[string]bool{"mx.busy.com": true}, nil, &dialed)()
+
+	// the mail is retried for the deferred domain only
+	report, err := newTestMX().Deliver("from@shop.com", []string{"to@example.com", "to@busy.com"}, strings.NewReader("body"))
+	if de := Classify(err); de == nil || de.Permanent() {
+		t.Fatalf("unexpected error: %v", err)
+	} else if accepted := report.Accepted(); len(accepted) != 1 || accepted[0].Email != "to@example.com" {
+		t.Fatalf("unexpected accepted recipients: %+v", accepted)
+	} else if rejected := report.Rejected(); len(rejected) != 1 || rejected[0].Email != "to@busy.com" || rejected[0].Class != ClassNetwork {
+		t.Fatalf("unexpected rejected recipients: %+v", rejected)
+	}
+}
+
+// Ensure greylisted recipients are retried without sending the mail to the
+// accepted ones through the next MX host.
+func TestMXTransport_Greylisted(t *testing.T) {
+	var dialed []string
+	defer stubRelays(nil, nil, &dialed)()
+	newClient := smtpNewClient
+	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
+		c, err := newClient(conn, host)
+		c.(*mockClient).greylisted = map[string]bool{"new@example.com": true}
+		return c, err
+	}
+
+	report, err := newTestMX().Deliver("from@shop.com", []string{"to@example.com", "new@example.com"}, strings.NewReader("body"))
+	if de := Classify(err); de == nil || de.Class != ClassTransient || de.Code != 451 {
+		t.Fatalf("unexpected error: %v", err)
+	} else if accepted := report.Accepted(); len(accepted) != 1 || accepted[0].Email != "to@example.com" {
+		t.Fatalf("unexpected accepted recipients: %+v", accepted)
+	} else if got := strings.Join(dialed, " "); got != "mx1.example.com" {
+		t.Fatalf("unexpected hosts: %s", got)
+	}
+}
+
+func TestMXTransport_LocalName(t *testing.T) {
+	var dialed []string
+	defer stubRelays(nil, nil, &dialed)()
+	newClient := smtpNewClient
+	var hello string
+	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
+		c, err := newClient(conn, host)
+		return &helloClient{c.(*mockClient), &hello}, err
+	}
+
+	if _, err := newTestMX().Deliver("from@shop.com", []string{"to@example.com"}, strings.NewReader("body")); err != nil {
+		t.Fatal(err)
+	} else if hello != "mailer.example.com" {
+		t.Fatalf("unexpected EHLO: %q", hello)
+	}
+}
+
+type helloClient struct {
+	*mockClient
+	name *string
+}
+
+func (c *helloClient) Hello(name string) error {
+	*c.name = name
+	return nil
+}
@@ -0,0 +1,154 @@
+package smtp
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrPoolClosed is returned for deliveries after the pool has been closed.
+var ErrPoolClosed = errors.New("smtp: connection pool is closed")
+
+// Pool keeps up to Size authenticated connections to the relay open, so
+// consecutive deliveries don't pay for connecting, the TLS handshake and
+// AUTH again. Idle connections are probed with NOOP before they are reused
+// and replaced after MaxMessages deliveries or once they were idle for
+// longer than IdleTimeout. Deliveries wait while all connections are busy.
+type Pool struct {
+	Size        int
+	MaxMessages int
+	IdleTimeout time.Duration
+
+	newDialer func() *Dialer
+	slots     chan struct{}
+
+	mu     sync.Mutex
+	idle   []*pooledConn
+	closed bool
+}
+
+type pooledConn struct {
+	*smtpSender
+	messages int
+	lastUsed time.Time
+}
+
+// NewPool returns a pool of connections opened by the dialers returned by
+// newDialer.
+func NewPool(size, maxMessages int, idleTimeout time.Duration, newDialer func() *Dialer) *Pool {
+	return &Pool{
+		Size:        size,
+		MaxMessages: maxMessages,
+		IdleTimeout: idleTimeout,
+		newDialer:   newDialer,
+		slots:       make(chan struct{}, size),
+	}
+}
+
+// Deliver sends msg over a pooled connection. When a reused connection has
+// been closed by the relay in the meantime, msg is sent over a new one.
+func (p *Pool) Deliver(from string, to []string, msg io.WriterTo) (*DeliveryReport, error) {
+	p.slots <- struct{}{}
+	defer func() { <-p.slots }()
+
+	c, reused, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	report, err := c.deliver(from, to, msg)
+	if err != nil && reused && closedByRelay(err) {
+		c.smtpClient.Close()
+		if c, err = p.open(); err != nil {
+			return nil, err
+		}
+		report, err = c.deliver(from, to, msg)
+	}
+	p.put(c, err)
+	return report, err
+}
+
+// get returns an idle connection which is still alive or opens a new one.
+func (p *Pool) get() (*pooledConn, bool, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, false, ErrPoolClosed
+		}
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			c, err := p.open()
+			return c, false, err
+		}
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if p.IdleTimeout > 0 && time.Since(c.lastUsed) > p.IdleTimeout {
+			c.Close()
+			continue
+		}
+		if err := c.Noop(); err != nil {
+			c.smtpClient.Close()
+			continue
+		}
+		return c, true, nil
+	}
+}
+
+func (p *Pool) open() (*pooledConn, error) {
+	s, err := p.newDialer().dial()
+	if err != nil {
+		return nil, err
+	}
+	return &pooledConn{smtpSender: s}, nil
+}
+
+// put returns c into the pool unless it is worn out or broken. Connections
+// with a failed transaction are reset first.
+func (p *Pool) put(c *pooledConn, err error) {
+	c.messages++
+	c.lastUsed = time.Now()
+	if err != nil {
+		if de := Classify(err); de.Class == ClassNetwork || closedByRelay(err) || c.Reset() != nil {
+			c.smtpClient.Close()
+			return
+		}
+	}
+	if p.MaxMessages > 0 && c.messages >= p.MaxMessages {
+		c.Close()
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		c.Close()
+		return
+	}
+	p.idle = append(p.idle, c)
+}
+
+// Close closes all idle connections, connections in use are closed once
+// their delivery is done.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+	for _, c := range idle {
+		c.Close()
+	}
+	return nil
+}
+
+// closedByRelay returns true if err shows the relay closed the connection,
+// either with 421 or without a reply.
+func closedByRelay(err error) bool {
+	if err == io.EOF {
+		return true
+	}
+	de := Classify(err)
+	return de.Code == 421
+}
@@ -0,0 +1,106 @@
+package smtp
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+type poolClient struct {
+	mockClient
+	noopErr error
+	mailErr error
+	quit    bool
+}
+
+func (c *poolClient) Noop() error { return c.noopErr }
+func (c *poolClient) Quit() error { c.quit = true; return nil }
+
+func (c *poolClient) Mail(string) error {
+	err := c.mailErr
+	c.mailErr = nil
+	return err
+}
+
+// newTestPool returns a pool whose connections are recorded in clients and
+// a function restoring the stubbed dialing.
+func newTestPool(size, maxMessages int, idleTimeout time.Duration, clients *[]*poolClient) (*Pool, func()) {
+	dial, newClient := netDialTimeout, smtpNewClient
+	netDialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
+		c := &poolClient{}
+		*clients = append(*clients, c)
+		return c, nil
+	}
+	p := NewPool(size, maxMessages, idleTimeout, func() *Dialer {
+		return NewDialer("relay.example.com", 587, "", "")
+	})
+	return p, func() { netDialTimeout, smtpNewClient = dial, newClient }
+}
+
+func deliverTo(t *testing.T, p *Pool) {
+	if _, err := p.Deliver("from@example.com", []string{"to@example.com"}, strings.NewReader("body")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPool_Reuse(t *testing.T) {
+	var clients []*poolClient
+	p, restore := newTestPool(2, 3, time.Minute, &clients)
+	defer restore()
+	for i := 0; i < 4; i++ {
+		deliverTo(t, p)
+	}
+	// the first connection is replaced after three mails
+	if len(clients) != 2 {
+		t.Fatalf("unexpected connections: %d", len(clients))
+	} else if !clients[0].quit || clients[1].quit {
+		t.Fatalf("unexpected closed connections: %v %v", clients[0].quit, clients[1].quit)
+	}
+	p.Close()
+	if !clients[1].quit {
+		t.Fatal("idle connection not closed")
+	}
+	if _, err := p.Deliver("from@example.com", []string{"to@example.com"}, strings.NewReader("body")); err != ErrPoolClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestPool_Broken(t *testing.T) {
+	var clients []*poolClient
+	p, restore := newTestPool(1, 0, time.Minute, &clients)
+	defer restore()
+	deliverTo(t, p)
+	clients[0].noopErr = textproto.ProtocolError("connection reset")
+	deliverTo(t, p)
+	if len(clients) != 2 {
+		t.Fatalf("broken connection reused: %d connections", len(clients))
+	}
+
+	// the relay closes the connection while it is in use
+	clients[1].mailErr = &textproto.Error{Code: 421, Msg: "4.4.2 idle for too long"}
+	deliverTo(t, p)
+	if len(clients) != 3 {
+		t.Fatalf("no new connection after 421: %d connections", len(clients))
+	} else if clients[2].data.String() != "body" {
+		t.Fatalf("unexpected data: %q", clients[2].data.String())
+	}
+}
+
+func TestPool_IdleTimeout(t *testing.T) {
+	var clients []*poolClient
+	p, restore := newTestPool(1, 0, time.Millisecond, &clients)
+	defer restore()
+	deliverTo(t, p)
+	time.Sleep(5 * time.Millisecond)
+	deliverTo(t, p)
+	if len(clients) != 2 || !clients[0].quit {
+		t.Fatalf("idle connection reused: %d connections", len(clients))
+	}
+}
@@ -0,0 +1,244 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/kafka/event"
+)
+
+// DefaultRelayName is the name of the relay configured by the top-level
+// settings of [smtp].
+const DefaultRelayName = "default"
+
+// RelayConfig represents one of the relays mails are delivered through.
+type RelayConfig struct {
+	Name     string `toml:"name"`
+	Hostname string `toml:"hostname"`
+	Port     int    `toml:"port"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	// Relays with a lower priority are tried first, relays with the same
+	// priority share the mails by their weight.
+	Priority int `toml:"priority"`
+	Weight   int `toml:"weight"`
+	// TLS replaces the policy of [smtp.tls] for this relay.
+	TLS *TLSConfig `toml:"tls"`
+}
+
+// RouteConfig sends the matching mails through some of the relays only.
+// Mails match if they match every criterion which is set.
+type RouteConfig struct {
+	SenderDomains []string `toml:"sender-domains"`
+	// RecipientDomains are matched against the first recipient.
+	RecipientDomains []string `toml:"recipient-domains"`
+	// Tags match if the mail has one of them.
+	Tags    []string `toml:"tags"`
+	Tenants []string `toml:"tenants"`
+	Relays  []string `toml:"relays"`
+}
+
+// matches returns true if u is sent through the relays of the route.
+func (r RouteConfig) matches(u *event.InboundEmailEvent) bool {
+	if len(r.SenderDomains) > 0 && !containsFold(r.SenderDomains, domain(u.Sender.Email)) {
+		return false
+	}
+	if len(r.RecipientDomains) > 0 {
+		recipients := u.EnvelopeRecipients()
+		if len(recipients) == 0 || !containsFold(r.RecipientDomains, domain(recipients[0])) {
+			return false
+		}
+	}
+	if len(r.Tags) > 0 {
+		tagged := false
+		for _, tag := range u.Tags {
+			if containsFold(r.Tags, tag) {
+				tagged = true
+				break
+			}
+		}
+		if !tagged {
+			return false
+		}
+	}
+	if len(r.Tenants) > 0 && !containsFold(r.Tenants, u.Tenant) {
+		return false
+	}
+	return true
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// domain returns the domain of an address.
+func domain(address string) string {
+	return address[strings.LastIndex(address, "@")+1:]
+}
+
+// RelayConfigs returns the configured relays. Without any [[smtp.relay]],
+// the top-level settings make up the only relay.
+func (c Config) RelayConfigs() []RelayConfig {
+	if len(c.Relays) > 0 {
+		return c.Relays
+	}
+	return []RelayConfig{{
+		Name:     DefaultRelayName,
+		Hostname: c.Hostname,
+		Port:     c.Port,
+		Username: c.Username,
+		Password: c.Password,
+	}}
+}
+
+// validateRelays returns an error if a relay or a route is invalid.
+func (c Config) validateRelays() error {
+	names := map[string]bool{}
+	for _, r := range c.Relays {
+		if r.Name == "" {
+			return errors.New("every [[smtp.relay]] needs a name")
+		} else if names[r.Name] {
+			return fmt.Errorf("relay %q is configured twice", r.Name)
+		} else if r.Hostname == "" {
+			return fmt.Errorf("relay %q needs a hostname", r.Name)
+		} else if r.Weight < 0 {
+			return fmt.Errorf("weight of relay %q must not be negative", r.Name)
+		}
+		if r.TLS != nil {
+			if err := r.TLS.Validate(); err != nil {
+				return fmt.Errorf("relay %q: %s", r.Name, err)
+			}
+		}
+		names[r.Name] = true
+	}
+	for i, route := range c.Routes {
+		if len(route.Relays) == 0 {
+			return fmt.Errorf("route %d needs at least one relay", i)
+		}
+		for _, name := range route.Relays {
+			if !names[name] {
+				return fmt.Errorf("route %d references unknown relay %q", i, name)
+			}
+		}
+	}
+	return nil
+}
+
+// relay delivers mails through one relay, keeping track of its health.
+type relay struct {
+	config    RelayConfig
+	localName string
+	policy    TLSConfig
+	tlsConfig *tls.Config
+	pool      *Pool
+	breaker   *breaker
+}
+
+func newRelay(c Config, rc RelayConfig) *relay {
+	r := &relay{
+		config:    rc,
+		localName: c.LocalName,
+		policy:    c.TLS,
+		breaker: &breaker{
+			threshold: c.BreakerThreshold,
+			cooldown:  time.Duration(c.BreakerCooldown),
+		},
+	}
+	if rc.TLS != nil {
+		r.policy = *rc.TLS
+	}
+	if r.config.Weight == 0 {
+		r.config.Weight = 1
+	}
+	return r
+}
+
+// start loads the certificates of the TLS policy and opens the connection
+// pool.
+func (r *relay) start(c Config) error {
+	tlsConfig, err := r.policy.Load()
+	if err != nil {
+		return fmt.Errorf("relay %q: %s", r.config.Name, err)
+	}
+	r.tlsConfig = tlsConfig
+	if c.PoolSize > 0 {
+		r.pool = NewPool(c.PoolSize, c.PoolMaxMessages, time.Duration(c.PoolIdleTimeout), r.newDialer)
+	}
+	relayUp.WithLabelValues(r.config.Name).Set(1)
+	return nil
+}
+
+func (r *relay) stop() error {
+	if r.pool != nil {
+		return r.pool.Close()
+	}
+	return nil
+}
+
+// newDialer returns a dialer to the relay, which follows the TLS policy.
+func (r *relay) newDialer() *Dialer {
+	d := NewDialer(r.config.Hostname, r.config.Port, r.config.Username, r.config.Password)
+	d.TLSConfig = r.tlsConfig
+	d.LocalName = r.localName
+	switch r.policy.Mode {
+	case TLSModeNone:
+		d.SSL = false
+		d.StartTLS = NoStartTLS
+	case TLSModeStartTLS:
+		d.SSL = false
+		d.StartTLS = MandatoryStartTLS
+	case TLSModeImplicit:
+		d.SSL = true
+	}
+	return d
+}
+
+func (r *relay) deliver(from string, to []string, msg io.WriterTo) (*DeliveryReport, error) {
+	if r.pool != nil {
+		return r.pool.Deliver(from, to, msg)
+	}
+	return r.newDialer().DialAndDeliver(from, to, msg)
+}
+
+// order returns the relays in the order they are tried: by priority, and
+// randomly by weight among relays with the same priority.
+func order(relays []*relay) []*relay {
+	ordered := make([]*relay, 0, len(relays))
+	remaining := append([]*relay{}, relays...)
+	sort.SliceStable(remaining, func(i, j int) bool {
+		return remaining[i].config.Priority < remaining[j].config.Priority
+	})
+	for len(remaining) > 0 {
+		// relays of the current priority
+		n := 1
+		for n < len(remaining) && remaining[n].config.Priority == remaining[0].config.Priority {
+			n++
+		}
+		group := remaining[:n]
+		for len(group) > 0 {
+			total := 0
+			for _, r := range group {
+				total += r.config.Weight
+			}
+			pick, i := rand.Intn(total), 0
+			for ; pick >= group[i].config.Weight; i++ {
+				pick -= group[i].config.Weight
+			}
+			ordered = append(ordered, group[i])
+			group = append(group[:i:i], group[i+1:]...)
+		}
+		remaining = remaining[n:]
+	}
+	return ordered
+}
@@ -0,0 +1,213 @@
+package smtp
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/kafka/event"
+)
+
+// stubRelays makes dialing hosts listed in down fail and records the hosts
+// connected to in dialed. Clients of hosts listed in rejecting reject all
+// recipients.
+func stubRelays(down, rejecting map[string]bool, dialed *[]string) func() {
+	dial, newClient := netDialTimeout, smtpNewClient
+	netDialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		host, _, _ := net.SplitHostPort(address)
+		*dialed = append(*dialed, host)
+		if down[host] {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
+		c := &mockClient{rejected: map[string]bool{}}
+		if rejecting[host] {
+			c.rejected["to@example.com"] = true
+		}
+		return c, nil
+	}
+	return func() { netDialTimeout, smtpNewClient = dial, newClient }
+}
+
+func newRelayService(routes ...RouteConfig) *Service {
+	c := NewConfig()
+	c.PoolSize = 0
+	c.BreakerThreshold = 2
+	c.Relays = []RelayConfig{
+		{Name: "primary", Hostname: "primary.example.com", Port: 25},
+		{Name: "backup", Hostname: "backup.example.com", Port: 25, Priority: 1},
+	}
+	c.Routes = routes
+	return NewService(c)
+}
+
+var relayMail = &event.InboundEmailEvent{
+	Sender:    event.Contact{Email: "news@shop.example.com"},
+	Recipient: event.Contact{Email: "to@example.com"},
+	Subject:   "test",
+	Tags:      []string{"bulk"},
+}
+
+func TestService_Failover(t *testing.T) {
+	var dialed []string
+	defer stubRelays(map[string]bool{"primary.example.com": true}, nil, &dialed)()
+	s := newRelayService()
+
+	for i := 0; i < 3; i++ {
+		if _, err := s.Deliver(relayMail); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the primary relay is skipped after two failures in a row
+	expected := "primary.example.com backup.example.com primary.example.com backup.example.com backup.example.com"
+	if got := strings.Join(dialed, " "); got != expected {
+		t.Fatalf("unexpected relays: %s", got)
+	}
+}
+
+func TestService_FailoverPermanent(t *testing.T) {
+	var dialed []string
+	defer stubRelays(nil, map[string]bool{"primary.example.com": true}, &dialed)()
+	s := newRelayService()
+
+	_, err := s.Deliver(relayMail)
+	if de, ok := err.(*DeliveryError); !ok || !de.Permanent() {
+		t.Fatalf("unexpected error: %v", err)
+	} else if len(dialed) != 1 {
+		t.Fatalf("permanent errors must not fail over: %v", dialed)
+	}
+}
+
+// Ensure a mail which some recipients accepted isn't sent to them again
+// through the next relay.
+func TestService_FailoverPartiallyDeferred(t *testing.T) {
+	var dialed []string
+	defer stubRelays(nil, nil, &dialed)()
+	newClient := smtpNewClient
+	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
+		c, err := newClient(conn, host)
+		c.(*mockClient).greylisted = map[string]bool{"cc@example.org": true}
+		return c, err
+	}
+	s := newRelayService()
+
+	mail := *relayMail
+	mail.Cc = []event.Contact{{Email: "cc@example.org"}}
+	report, err := s.Deliver(&mail)
+	if de := Classify(err); de == nil || de.Class != ClassTransient {
+		t.Fatalf("unexpected error: %v", err)
+	} else if len(report.Accepted()) != 1 || len(report.Rejected()) != 1 {
+		t.Fatalf("unexpected report: %+v", report)
+	} else if len(dialed) != 1 {
+		t.Fatalf("partially deferred mails must not fail over: %v", dialed)
+	}
+}
+
+// Ensure recipients deferred by their domain don't open the breaker of a
+// healthy relay.
+func TestService_BreakerGreylisted(t *testing.T) {
+	var dialed []string
+	defer stubRelays(nil, nil, &dialed)()
+	newClient := smtpNewClient
+	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
+		c, err := newClient(conn, host)
+		c.(*mockClient).greylisted = map[string]bool{"to@example.com": true}
+		return c, err
+	}
+	s := newRelayService()
+
+	for i := 0; i < 3; i++ {
+		if _, err := s.Deliver(relayMail); err == nil || Classify(err).Class != ClassTransient {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	expected := "primary.example.com backup.example.com primary.example.com backup.example.com primary.example.com backup.example.com"
+	if got := strings.Join(dialed, " "); got != expected {
+		t.Fatalf("unexpected relays: %s", got)
+	}
+}
+
+func TestService_NoHealthyRelay(t *testing.T) {
+	var dialed []string
+	defer stubRelays(map[string]bool{"primary.example.com": true, "backup.example.com": true}, nil, &dialed)()
+	s := newRelayService()
+
+	for i := 0; i < 2; i++ {
+		if _, err := s.Deliver(relayMail); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+	_, err := s.Deliver(relayMail)
+	if err == nil || !strings.Contains(err.Error(), "no healthy relay") {
+		t.Fatalf("unexpected error: %v", err)
+	} else if Classify(err).Permanent() {
+		t.Fatalf("mails must be retried once relays recover: %v", err)
+	}
+}
+
+func TestService_Route(t *testing.T) {
+	var dialed []string
+	defer stubRelays(nil, nil, &dialed)()
+	s := newRelayService(
+		RouteConfig{Tenants: []string{"billing"}, Relays: []string{"primary"}},
+		RouteConfig{SenderDomains: []string{"SHOP.example.com"}, Tags: []string{"bulk"}, Relays: []string{"backup"}},
+	)
+
+	if _, err := s.Deliver(relayMail); err != nil {
+		t.Fatal(err)
+	}
+	if len(dialed) != 1 || dialed[0] != "backup.example.com" {
+		t.Fatalf("unexpected relays: %v", dialed)
+	}
+	if r := s.route(&event.InboundEmailEvent{Sender: relayMail.Sender, Tenant: "billing"}); len(r) != 1 || r[0].config.Name != "primary" {
+		t.Fatalf("unexpected route: %v", r)
+	}
+	if r := s.route(&event.InboundEmailEvent{Sender: event.Contact{Email: "info@example.com"}}); len(r) != 2 {
+		t.Fatalf("unexpected route: %v", r)
+	}
+}
+
+func TestOrder(t *testing.T) {
+	relays := []*relay{
+		{config: RelayConfig{Name: "fallback", Priority: 1, Weight: 1}},
+		{config: RelayConfig{Name: "heavy", Weight: 3}},
+		{config: RelayConfig{Name: "light", Weight: 1}},
+	}
+	first := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		ordered := order(relays)
+		if len(ordered) != 3 || ordered[2].config.Name != "fallback" {
+			t.Fatalf("unexpected order: %v", ordered)
+		}
+		first[ordered[0].config.Name]++
+	}
+	if first["heavy"] < 650 || first["heavy"] > 850 {
+		t.Fatalf("unexpected distribution: %v", first)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	b := &breaker{threshold: 2, cooldown: time.Minute}
+	now := time.Now()
+	if b.failure(now) || !b.allow(now) {
+		t.Fatal("breaker opened too early")
+	}
+	if !b.failure(now) || b.allow(now) {
+		t.Fatal("breaker not opened")
+	}
+	// a single delivery is let through after the cooldown
+	later := now.Add(2 * time.Minute)
+	if !b.allow(later) || b.allow(later) {
+		t.Fatal("unexpected half open breaker")
+	}
+	b.success()
+	if !b.allow(later) || !b.allow(later) {
+		t.Fatal("breaker not closed")
+	}
+}
@@ -0,0 +1,37 @@
+package smtp
+
+// RecipientResult reports whether the SMTP server accepted a single
+// envelope recipient. Rejections carry the classified reply of the server.
+type RecipientResult struct {
+	Email    string `json:"email"`
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+	Code     int    `json:"code,omitempty"`
+	Status   string `json:"status,omitempty"`
+	Class    Class  `json:"class,omitempty"`
+}
+
+// DeliveryReport describes the outcome of a delivered message.
+type DeliveryReport struct {
+	Recipients []RecipientResult `json:"recipients"`
+}
+
+// Accepted returns all recipients accepted by the SMTP server.
+func (r *DeliveryReport) Accepted() []RecipientResult {
+	return r.filter(true)
+}
+
+// Rejected returns all recipients rejected by the SMTP server.
+func (r *DeliveryReport) Rejected() []RecipientResult {
+	return r.filter(false)
+}
+
+func (r *DeliveryReport) filter(accepted bool) []RecipientResult {
+	var results []RecipientResult
+	for _, result := range r.Recipients {
+		if result.Accepted == accepted {
+			results = append(results, result)
+		}
+	}
+	return results
+}
@@ -1,11 +1,14 @@
 package smtp
 
 import (
+	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
-	"mime"
-	"net/mail"
+	"os"
+	"time"
 
+	"github.com/nirnanaaa/cloudive-mailer/services/blobs"
 	"github.com/nirnanaaa/cloudive-mailer/services/kafka/event"
 	"github.com/sirupsen/logrus"
 
@@ -16,72 +19,360 @@ import (
 type Service struct {
 	Logger *logrus.Logger
 	Config Config
+	// Blobs holds the attachments uploaded to the gateway.
+	Blobs blobs.Store
+
+	relays []*relay
+	named  map[string]*relay
+	mx     *MXTransport
+	dkim   *DKIMSigner
 }
 
 // NewService returns a new instance of Service.
 func NewService(c Config) *Service {
 	s := &Service{
 		Config: c,
+		Logger: logrus.New(),
+		named:  make(map[string]*relay),
+	}
+	if c.Transport == TransportMX {
+		localName := c.LocalName
+		if localName == "" {
+			localName, _ = os.Hostname()
+		}
+		s.mx = NewMXTransport(c.MXPort, localName)
+	}
+	for _, rc := range c.RelayConfigs() {
+		r := newRelay(c, rc)
+		s.relays = append(s.relays, r)
+		s.named[rc.Name] = r
 	}
 	return s
 }
 
-// Start starts the service
+// Start loads the certificates of the TLS policies and the DKIM keys and
+// opens the connection pools of all relays.
 func (s *Service) Start() error {
+	if err := RegisterMetrics(); err != nil {
+		return err
+	}
+	if s.Config.DKIM.Enabled {
+		signer, err := NewDKIMSigner(s.Config.DKIM)
+		if err != nil {
+			return err
+		}
+		s.dkim = signer
+	}
+	if s.mx != nil {
+		return s.startMX()
+	}
+	for _, r := range s.relays {
+		if err := r.start(s.Config); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// Stop closes the underlying listener.
+// startMX applies the TLS policy to the MX transport. Unless STARTTLS is
+// required, certificates of MX hosts are not verified, as most of them
+// don't match the name of the host.
+func (s *Service) startMX() error {
+	c, err := s.Config.TLS.Load()
+	if err != nil {
+		return err
+	}
+	switch s.Config.TLS.Mode {
+	case TLSModeNone:
+		s.mx.StartTLS = NoStartTLS
+	case TLSModeStartTLS:
+		s.mx.StartTLS = MandatoryStartTLS
+		s.mx.TLSConfig = c
+	default:
+		s.mx.StartTLS = OpportunisticStartTLS
+		s.mx.TLSConfig = &tls.Config{InsecureSkipVerify: true, MinVersion: c.MinVersion}
+	}
+	return nil
+}
+
+// Stop closes all pooled connections.
 func (s *Service) Stop() error {
+	for _, r := range s.relays {
+		if err := r.stop(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func formatEmail(name, email string) string {
-	s := fmt.Sprintf("%s <%s>", name, email)
-	se := mime.QEncoding.Encode("utf-8", s)
-	_, e := mail.ParseAddress(se)
-	if e != nil {
-		return email
+func formatContacts(m *gomail.Message, contacts []event.Contact) []string {
+	var addrs []string
+	for _, contact := range contacts {
+		if contact.Email == "" {
+			continue
+		}
+		addrs = append(addrs, m.FormatAddress(contact.Email, contact.Name))
 	}
-	return s
+	return addrs
+}
+
+// Deliver performs all necessary operations to send an outgoing email via SMTP.
+// The returned report lists which recipients were accepted by the server,
+// failures are returned as a *DeliveryError. A transient error with accepted
+// recipients in the report means only the rejected ones need a retry.
+func (s *Service) Deliver(u *event.InboundEmailEvent) (*DeliveryReport, error) {
+	return s.DeliverTo(u, u.EnvelopeRecipients())
 }
 
-// Deliver performs all necessary operations to send an outgoing email via SMTP
-func (s *Service) Deliver(u *event.InboundEmailEvent) error {
+// DeliverTo sends u to some of its envelope recipients only, like the ones
+// a previous attempt did not reach. The headers still list all recipients.
+func (s *Service) DeliverTo(u *event.InboundEmailEvent, recipients []string) (*DeliveryReport, error) {
 	if !s.Config.Enabled {
-		return fmt.Errorf("SMTP Service is not enabled, we're not delivering any emails")
+		return nil, &DeliveryError{Class: ClassTransient, Err: fmt.Errorf("SMTP Service is not enabled, we're not delivering any emails")}
+	}
+
+	if len(recipients) == 0 {
+		return nil, permanentErrorf("email with Trace ID %s has no recipients", u.TraceID)
+	}
+	if err := s.checkBlobs(u); err != nil {
+		return nil, err
+	}
+
+	m := s.newMessage(u)
+	if s.dkim == nil {
+		return s.deliver(u, recipients, m)
+	}
+	msg, err := s.sign(u, m)
+	if err != nil {
+		return nil, err
+	}
+	return s.deliver(u, recipients, msg)
+}
+
+// sign renders m and adds the DKIM signature of the sender domain. The
+// rendered message is sent as it is, so relays tried after a failure get the
+// same signed bytes.
+func (s *Service) sign(u *event.InboundEmailEvent, m *gomail.Message) (renderedMessage, error) {
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return nil, &DeliveryError{Class: ClassTransient, Err: fmt.Errorf("rendering email with Trace ID %s failed: %s", u.TraceID, err)}
+	}
+	signed, err := s.dkim.Sign(buf.Bytes(), domain(u.Sender.Email), time.Now())
+	if err != nil {
+		return nil, &DeliveryError{Class: ClassTransient, Err: fmt.Errorf("signing email with Trace ID %s failed: %s", u.TraceID, err)}
+	}
+	return renderedMessage(signed), nil
+}
+
+// deliver sends msg straight to the MX hosts of the recipients or through
+// the relays routed to for u. On network errors
+// and 4xx replies the next relay is tried, permanent errors are returned
+// right away.
+func (s *Service) deliver(u *event.InboundEmailEvent, recipients []string, msg io.WriterTo) (*DeliveryReport, error) {
+	if s.mx != nil {
+		report, err := s.mx.Deliver(u.Sender.Email, recipients, msg)
+		if err != nil {
+			return report, Classify(err)
+		}
+		return report, nil
+	}
+	var lastReport *DeliveryReport
+	var lastErr *DeliveryError
+	var previous *relay
+	for _, r := range order(s.route(u)) {
+		if !r.breaker.allow(time.Now()) {
+			continue
+		}
+		if previous != nil {
+			relayFailovers.WithLabelValues(previous.config.Name).Inc()
+			s.Logger.WithError(lastErr).Warnf("Delivery of email with Trace ID %s through relay %s failed, trying %s", u.TraceID, previous.config.Name, r.config.Name)
+		}
+		start := time.Now()
+		report, err := r.deliver(u.Sender.Email, recipients, msg)
+		relayDuration.WithLabelValues(r.config.Name).Observe(time.Since(start).Seconds())
+		if err == nil {
+			relayDeliveries.WithLabelValues(r.config.Name, "delivered").Inc()
+			s.healthy(r)
+			return report, nil
+		}
+		de := Classify(err)
+		relayDeliveries.WithLabelValues(r.config.Name, string(de.Class)).Inc()
+		if de.Permanent() || delivered(report) {
+			// the relay answered, so it is healthy. Recipients which accepted
+			// the message must not get it again through another relay.
+			s.healthy(r)
+			return report, de
+		}
+		if de.Class != ClassNetwork && de.Recipient != "" {
+			// recipients deferred by their domain, like greylisting, say
+			// nothing about the health of the relay
+			s.healthy(r)
+		} else if r.breaker.failure(time.Now()) {
+			relayUp.WithLabelValues(r.config.Name).Set(0)
+			s.Logger.WithError(de).Warnf("Skipping relay %s for %s after repeated failures", r.config.Name, time.Duration(s.Config.BreakerCooldown))
+		}
+		lastReport, lastErr, previous = report, de, r
+	}
+	if lastErr == nil {
+		return nil, &DeliveryError{Class: ClassTransient, Err: fmt.Errorf("no healthy relay for email with Trace ID %s", u.TraceID)}
 	}
+	return lastReport, lastErr
+}
+
+// healthy closes the circuit breaker of r.
+func (s *Service) healthy(r *relay) {
+	r.breaker.success()
+	relayUp.WithLabelValues(r.config.Name).Set(1)
+}
+
+// route returns the relays of the first route matching u, or all relays.
+func (s *Service) route(u *event.InboundEmailEvent) []*relay {
+	for _, route := range s.Config.Routes {
+		if !route.matches(u) {
+			continue
+		}
+		var relays []*relay
+		for _, name := range route.Relays {
+			if r, ok := s.named[name]; ok {
+				relays = append(relays, r)
+			}
+		}
+		return relays
+	}
+	return s.relays
+}
+
+// checkBlobs makes sure all uploaded attachments of u are still stored, as
+// missing files can't be recovered by retrying the delivery.
+func (s *Service) checkBlobs(u *event.InboundEmailEvent) *DeliveryError {
+	for _, attachment := range u.Attachments {
+		if attachment.Blob == "" {
+			continue
+		}
+		if s.Blobs == nil {
+			return permanentErrorf("attachment %s of email with Trace ID %s was uploaded, but no blob store is configured", attachment.Name, u.TraceID)
+		}
+		r, err := s.Blobs.Open(attachment.Blob)
+		if err == blobs.ErrNotFound || err == blobs.ErrInvalidID {
+			return permanentErrorf("attachment %s of email with Trace ID %s is not stored anymore", attachment.Name, u.TraceID)
+		} else if err != nil {
+			return &DeliveryError{Class: ClassTransient, Err: err}
+		}
+		r.Close()
+	}
+	return nil
+}
+
+// setBody adds the text and HTML parts of u to m. Clients pick the last
+// alternative they are able to display, so HTML is added after the text.
+func (s *Service) setBody(m *gomail.Message, u *event.InboundEmailEvent) {
+	html := u.HTML
+	if html == "" {
+		html = string(u.Payload)
+	}
+	text := u.Text
+	if text == "" && html != "" {
+		text = HTMLToText(html)
+	}
+	m.SetBody("text/plain", text)
+	if html != "" {
+		if s.Config.EmbedImages {
+			html = s.embedImages(m, html)
+		}
+		m.AddAlternative("text/html", html)
+	}
+}
 
-	d := NewDialer(s.Config.Hostname, s.Config.Port, s.Config.Username, s.Config.Password)
+// newMessage renders the headers and body of u.
+func (s *Service) newMessage(u *event.InboundEmailEvent) *gomail.Message {
 	m := gomail.NewMessage()
-	from := formatEmail(u.Sender.Name, u.Sender.Email)
-	to := formatEmail(u.Recipient.Name, u.Recipient.Email)
-	m.SetHeader("From", from)
-	m.SetHeader("To", to)
+	m.SetAddressHeader("From", u.Sender.Email, u.Sender.Name)
+	if to := formatContacts(m, u.ToContacts()); len(to) > 0 {
+		m.SetHeader("To", to...)
+	} else {
+		// only blind copies, see RFC 5322 section 3.6.3
+		m.SetHeader("To", "undisclosed-recipients:;")
+	}
+	if cc := formatContacts(m, u.Cc); len(cc) > 0 {
+		m.SetHeader("Cc", cc...)
+	}
+	// Bcc recipients are only part of the envelope and never set as header.
 	m.SetHeader("Subject", u.Subject)
-	htmlData := string(u.Payload)
-	m.SetBody("text/html", htmlData)
+	s.setBody(m, u)
 
 	for _, attachment := range u.Attachments {
+		s.attach(m, attachment)
+	}
+	return m
+}
+
+// attach adds an attachment to m, inline attachments are embedded and get
+// their content ID.
+func (s *Service) attach(m *gomail.Message, a event.Attachment) {
+	header := map[string][]string{}
+	if a.ContentType != "" {
+		header["Content-Type"] = []string{a.ContentType}
+	}
+	var copyFunc func(w io.Writer) error
+	switch {
+	case a.Blob != "":
+		copyFunc = func(w io.Writer) error {
+			r, err := s.Blobs.Open(a.Blob)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			_, err = io.Copy(w, r)
+			return err
+		}
+	case event.IsDataURI(a.URL):
+		mediaType, data, err := event.DecodeDataURI(a.URL)
+		if err != nil {
+			logrus.WithError(err).Warnf("Skipping attachment %s", a.Name)
+			return
+		}
+		if a.ContentType == "" && mediaType != "" {
+			header["Content-Type"] = []string{mediaType}
+		}
+		copyFunc = func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		}
+	default:
 		if s.Config.AttachmentDomainWhitelistEnabled {
-			if err := s.CheckAttachmentForDomainWhitelist(attachment.URL); err != nil {
-				logrus.WithError(err).Warnf("Attachment Domain whitelisting is enabled and URL does not match whitelist: %s", attachment.URL)
-				continue
+			if err := s.CheckAttachmentForDomainWhitelist(a.URL); err != nil {
+				logrus.WithError(err).Warnf("Attachment Domain whitelisting is enabled and URL does not match whitelist: %s", a.URL)
+				return
 			}
 		}
-		m.Attach(attachment.Name, gomail.SetCopyFunc(func(w io.Writer) error {
-			r, err := s.DownloadAttachment(attachment.URL)
+		copyFunc = func(w io.Writer) error {
+			r, err := s.DownloadAttachment(a.URL)
 			if err != nil {
 				return err
 			}
+			if c, ok := r.(io.Closer); ok {
+				defer c.Close()
+			}
 			if _, err := io.Copy(w, r); err != nil {
 				return err
 			}
 			return nil
-		}))
+		}
 	}
-
-	return d.DialAndSend(m)
+	settings := []gomail.FileSetting{gomail.SetCopyFunc(copyFunc)}
+	if !a.Inline {
+		if len(header) > 0 {
+			settings = append(settings, gomail.SetHeader(header))
+		}
+		m.Attach(a.Name, settings...)
+		return
+	}
+	name := a.Name
+	if name == "" {
+		name = a.CID()
+	}
+	header["Content-ID"] = []string{"<" + a.CID() + ">"}
+	m.Embed(name, append(settings, gomail.SetHeader(header))...)
 }
 
 // SetLogOutput sets the writer to which all logs are written. It must not be
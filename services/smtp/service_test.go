@@ -0,0 +1,169 @@
+package smtp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/blobs"
+	"github.com/nirnanaaa/cloudive-mailer/services/kafka/event"
+)
+
+func TestService_NewMessageHeaders(t *testing.T) {
+	s := NewService(NewConfig())
+	m := s.newMessage(&event.InboundEmailEvent{
+		Sender:    event.Contact{Name: "Sender", Email: "sender@example.com"},
+		Recipient: event.Contact{Name: "Legacy", Email: "legacy@example.com"},
+		To:        []event.Contact{{Email: "to@example.com"}},
+		Cc:        []event.Contact{{Name: "Copy", Email: "cc@example.com"}},
+		Bcc:       []event.Contact{{Email: "hidden@example.com"}},
+		Subject:   "test",
+	})
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, expected := range []string{
+		`From: "Sender" <sender@example.com>`,
+		`To: "Legacy" <legacy@example.com>, to@example.com`,
+		`Cc: "Copy" <cc@example.com>`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("expected %q in message:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, "hidden@example.com") {
+		t.Fatalf("bcc recipient leaked into message:\n%s", out)
+	}
+}
+
+func TestService_NewMessageOnlyBcc(t *testing.T) {
+	s := NewService(NewConfig())
+	m := s.newMessage(&event.InboundEmailEvent{
+		Sender: event.Contact{Email: "sender@example.com"},
+		Bcc:    []event.Contact{{Email: "hidden@example.com"}},
+	})
+	if to := m.GetHeader("To"); len(to) != 1 || to[0] != "undisclosed-recipients:;" {
+		t.Fatalf("unexpected To header: %v", to)
+	}
+}
+
+func TestService_NewMessageAlternative(t *testing.T) {
+	s := NewService(NewConfig())
+	m := s.newMessage(&event.InboundEmailEvent{
+		Sender:    event.Contact{Email: "sender@example.com"},
+		Recipient: event.Contact{Email: "to@example.com"},
+		HTML:      `<p>Hello <a href="https://cloudive.cc">World</a></p>`,
+	})
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, expected := range []string{
+		"multipart/alternative",
+		"Content-Type: text/plain",
+		"Hello World (https://cloudive.cc)",
+		"Content-Type: text/html",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("expected %q in message:\n%s", expected, out)
+		}
+	}
+	if strings.Index(out, "text/plain") > strings.Index(out, "text/html") {
+		t.Fatalf("text part has to precede the HTML part:\n%s", out)
+	}
+}
+
+func TestService_NewMessageTextOnly(t *testing.T) {
+	s := NewService(NewConfig())
+	m := s.newMessage(&event.InboundEmailEvent{
+		Sender:    event.Contact{Email: "sender@example.com"},
+		Recipient: event.Contact{Email: "to@example.com"},
+		Text:      "just text",
+	})
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); strings.Contains(out, "multipart") || strings.Contains(out, "text/html") {
+		t.Fatalf("unexpected multipart message:\n%s", out)
+	}
+}
+
+func TestService_NewMessageBlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudive-blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := blobs.NewDiskStore(&blobs.Config{Path: dir})
+	id, _, err := store.Put(strings.NewReader("uploaded report"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewService(NewConfig())
+	s.Blobs = store
+	u := &event.InboundEmailEvent{
+		Sender:      event.Contact{Email: "sender@example.com"},
+		Recipient:   event.Contact{Email: "to@example.com"},
+		Text:        "see attachment",
+		Attachments: []event.Attachment{{Name: "report.txt", Blob: id, ContentType: "text/plain"}},
+	}
+	if err := s.checkBlobs(u); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := s.newMessage(u).WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, expected := range []string{
+		`filename="report.txt"`,
+		"Content-Type: text/plain",
+		"dXBsb2FkZWQgcmVwb3J0", // base64 of the content
+	} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("expected %q in message:\n%s", expected, out)
+		}
+	}
+
+	// missing uploads are never going to show up again
+	store.Delete(id)
+	if err := s.checkBlobs(u); err == nil || !err.Permanent() {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestService_NewMessageInline(t *testing.T) {
+	s := NewService(NewConfig())
+	m := s.newMessage(&event.InboundEmailEvent{
+		Sender:    event.Contact{Email: "sender@example.com"},
+		Recipient: event.Contact{Email: "to@example.com"},
+		HTML:      `<p><img src="cid:logo"></p>`,
+		Attachments: []event.Attachment{
+			{Name: "logo.png", URL: "data:image/png;base64,aGVsbG8=", Inline: true, ContentID: "logo"},
+			{Name: "notes.txt", URL: "data:text/plain,hi"},
+		},
+	})
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, expected := range []string{
+		"multipart/related",
+		"Content-ID: <logo>",
+		"Content-Disposition: inline; filename=\"logo.png\"",
+		"Content-Type: image/png",
+		"aGVsbG8=",
+		"Content-Disposition: attachment; filename=\"notes.txt\"",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("expected %q in message:\n%s", expected, out)
+		}
+	}
+}
@@ -12,6 +12,19 @@ import (
 	gomail "gopkg.in/gomail.v2"
 )
 
+// StartTLSPolicy decides whether the STARTTLS extension is used on
+// connections which don't use SSL.
+type StartTLSPolicy int
+
+const (
+	// OpportunisticStartTLS uses STARTTLS if the server offers it.
+	OpportunisticStartTLS StartTLSPolicy = iota
+	// MandatoryStartTLS fails if the server doesn't offer STARTTLS.
+	MandatoryStartTLS
+	// NoStartTLS never uses STARTTLS.
+	NoStartTLS
+)
+
 // A Dialer is a dialer to an SMTP server.
 type Dialer struct {
 	// Host represents the host of the SMTP server.
@@ -32,6 +45,8 @@ type Dialer struct {
 	// TSLConfig represents the TLS configuration used for the TLS (when the
 	// STARTTLS extension is used) or SSL connection.
 	TLSConfig *tls.Config
+	// StartTLS decides whether STARTTLS is used when SSL is false.
+	StartTLS StartTLSPolicy
 	// LocalName is the hostname sent to the SMTP server with the HELO command.
 	// By default, "localhost" is sent.
 	LocalName string
@@ -60,6 +75,10 @@ func NewPlainDialer(host string, port int, username, password string) *Dialer {
 // Dial dials and authenticates to an SMTP server. The returned SendCloser
 // should be closed when done using it.
 func (d *Dialer) Dial() (gomail.SendCloser, error) {
+	return d.dial()
+}
+
+func (d *Dialer) dial() (*smtpSender, error) {
 	conn, err := netDialTimeout("tcp", addr(d.Host, d.Port), 1*time.Minute)
 	if err != nil {
 		return nil, err
@@ -80,12 +99,15 @@ func (d *Dialer) Dial() (gomail.SendCloser, error) {
 		}
 	}
 
-	if !d.SSL {
+	if !d.SSL && d.StartTLS != NoStartTLS {
 		if ok, _ := c.Extension("STARTTLS"); ok {
 			if err := c.StartTLS(d.tlsConfig()); err != nil {
 				c.Close()
 				return nil, err
 			}
+		} else if d.StartTLS == MandatoryStartTLS {
+			c.Close()
+			return nil, &DeliveryError{Class: ClassTransient, Err: fmt.Errorf("smtp: %s doesn't offer STARTTLS, which is required by the TLS policy", d.Host)}
 		}
 	}
 
@@ -116,17 +138,38 @@ func (d *Dialer) Dial() (gomail.SendCloser, error) {
 	return &smtpSender{c, d}, nil
 }
 
+// tlsConfig returns the TLS configuration, verifying the certificate of
+// the server against Host unless another server name is set.
 func (d *Dialer) tlsConfig() *tls.Config {
 	if d.TLSConfig == nil {
-		return &tls.Config{ServerName: d.Host, InsecureSkipVerify: true}
+		return &tls.Config{ServerName: d.Host}
 	}
-	return d.TLSConfig
+	if d.TLSConfig.ServerName != "" {
+		return d.TLSConfig
+	}
+	c := d.TLSConfig.Clone()
+	c.ServerName = d.Host
+	return c
 }
 
 func addr(host string, port int) string {
 	return fmt.Sprintf("%s:%d", host, port)
 }
 
+// DialAndDeliver opens a connection to the SMTP server, sends msg to every
+// recipient accepted by the server and closes the connection. Unlike
+// DialAndSend the envelope is passed explicitly, so recipients don't have to
+// appear in the message headers.
+func (d *Dialer) DialAndDeliver(from string, to []string, msg io.WriterTo) (*DeliveryReport, error) {
+	s, err := d.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	return s.deliver(from, to, msg)
+}
+
 // DialAndSend opens a connection to the SMTP server, sends the given emails and
 // closes the connection.
 func (d *Dialer) DialAndSend(m ...*gomail.Message) error {
@@ -165,6 +208,65 @@ func (c *smtpSender) Send(from string, to []string, msg io.WriterTo) error {
 		}
 	}
 
+	return c.data(msg)
+}
+
+// deliver sends msg to all recipients accepted by the server. It fails when
+// no recipient was accepted at all, the message itself got rejected or some
+// recipients were deferred with a 4xx reply: the report tells which
+// recipients accepted msg, so only the others are retried.
+func (c *smtpSender) deliver(from string, to []string, msg io.WriterTo) (*DeliveryReport, error) {
+	if err := c.Mail(from); err != nil {
+		if err == io.EOF {
+			// This is probably due to a timeout, so reconnect and try again.
+			s, derr := c.d.dial()
+			if derr == nil {
+				*c = *s
+				return c.deliver(from, to, msg)
+			}
+		}
+		return nil, err
+	}
+
+	report := &DeliveryReport{}
+	var lastErr *DeliveryError
+	for _, addr := range to {
+		result := RecipientResult{Email: addr, Accepted: true}
+		if err := c.Rcpt(addr); err != nil {
+			de := Classify(err)
+			de.Recipient = addr
+			result.Accepted = false
+			result.Error = err.Error()
+			result.Code = de.Code
+			result.Status = de.Status
+			result.Class = de.Class
+			// a single recipient which might be accepted later makes the
+			// whole delivery worth retrying.
+			if lastErr == nil || !de.Permanent() {
+				lastErr = de
+			}
+		}
+		report.Recipients = append(report.Recipients, result)
+	}
+	if len(report.Accepted()) == 0 {
+		if lastErr == nil {
+			return report, permanentErrorf("no recipients given")
+		}
+		return report, lastErr
+	}
+
+	if err := c.data(msg); err != nil {
+		// the recipients were accepted, but the message was not
+		rejectAll(report, Classify(err))
+		return report, err
+	}
+	if lastErr != nil && !lastErr.Permanent() {
+		return report, lastErr
+	}
+	return report, nil
+}
+
+func (c *smtpSender) data(msg io.WriterTo) error {
 	w, err := c.Data()
 	if err != nil {
 		return err
@@ -187,10 +289,32 @@ var (
 	netDialTimeout = net.DialTimeout
 	tlsClient      = tls.Client
 	smtpNewClient  = func(conn net.Conn, host string) (smtpClient, error) {
-		return smtp.NewClient(conn, host)
+		c, err := smtp.NewClient(conn, host)
+		if err != nil {
+			return nil, err
+		}
+		return &netClient{c}, nil
 	}
 )
 
+// netClient adds the NOOP command to smtp.Client.
+type netClient struct {
+	*smtp.Client
+}
+
+// Noop sends the NOOP command, which checks whether the connection is
+// still alive.
+func (c *netClient) Noop() error {
+	id, err := c.Text.Cmd("NOOP")
+	if err != nil {
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_, _, err = c.Text.ReadResponse(250)
+	return err
+}
+
 type smtpClient interface {
 	Hello(string) error
 	Extension(string) (bool, string)
@@ -199,6 +323,8 @@ type smtpClient interface {
 	Mail(string) error
 	Rcpt(string) error
 	Data() (io.WriteCloser, error)
+	Noop() error
+	Reset() error
 	Quit() error
 	Close() error
 }
@@ -0,0 +1,173 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mockClient struct {
+	rejected map[string]bool
+	deferred map[string]bool
+	// greylisted recipients are deferred with a 451 reply
+	greylisted map[string]bool
+	rcpts      []string
+	data       bytes.Buffer
+	// dataErr rejects the message after it was sent
+	dataErr error
+}
+
+func (c *mockClient) Hello(string) error              { return nil }
+func (c *mockClient) Extension(string) (bool, string) { return false, "" }
+func (c *mockClient) StartTLS(*tls.Config) error      { return nil }
+func (c *mockClient) Auth(smtp.Auth) error            { return nil }
+func (c *mockClient) Mail(string) error               { return nil }
+func (c *mockClient) Noop() error                     { return nil }
+func (c *mockClient) Reset() error                    { return nil }
+func (c *mockClient) Quit() error                     { return nil }
+func (c *mockClient) Close() error                    { return nil }
+
+func (c *mockClient) Rcpt(addr string) error {
+	if c.rejected[addr] {
+		return &textproto.Error{Code: 550, Msg: "5.1.1 user unknown"}
+	}
+	if c.deferred[addr] {
+		return &textproto.Error{Code: 450, Msg: "4.2.1 mailbox busy, try again later"}
+	}
+	if c.greylisted[addr] {
+		return &textproto.Error{Code: 451, Msg: "4.7.1 greylisted, please try again later"}
+	}
+	c.rcpts = append(c.rcpts, addr)
+	return nil
+}
+
+func (c *mockClient) Data() (io.WriteCloser, error) {
+	if c.dataErr != nil {
+		return errCloser{&c.data, c.dataErr}, nil
+	}
+	return nopCloser{&c.data}, nil
+}
+
+type errCloser struct {
+	io.Writer
+	err error
+}
+
+func (c errCloser) Close() error { return c.err }
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func TestSmtpSender_DeliverPartial(t *testing.T) {
+	c := &mockClient{rejected: map[string]bool{"unknown@example.com": true}}
+	s := &smtpSender{c, NewDialer("localhost", 25, "", "")}
+	report, err := s.deliver("from@example.com", []string{"to@example.com", "unknown@example.com"}, strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Accepted()) != 1 || report.Accepted()[0].Email != "to@example.com" {
+		t.Fatalf("unexpected accepted recipients: %+v", report.Accepted())
+	}
+	if len(report.Rejected()) != 1 || report.Rejected()[0].Email != "unknown@example.com" {
+		t.Fatalf("unexpected rejected recipients: %+v", report.Rejected())
+	}
+	if c.data.String() != "body" {
+		t.Fatalf("unexpected data: %s", c.data.String())
+	}
+}
+
+func TestSmtpSender_DeliverAllRejected(t *testing.T) {
+	c := &mockClient{rejected: map[string]bool{"unknown@example.com": true}}
+	s := &smtpSender{c, NewDialer("localhost", 25, "", "")}
+	_, err := s.deliver("from@example.com", []string{"unknown@example.com"}, strings.NewReader("body"))
+	if err == nil {
+		t.Fatal("expected an error when all recipients are rejected")
+	} else if de := Classify(err); !de.Permanent() || de.Status != "5.1.1" {
+		t.Fatalf("unexpected error: %+v", de)
+	}
+	if c.data.Len() != 0 {
+		t.Fatal("no data must be sent without accepted recipients")
+	}
+}
+
+// Ensure deferred recipients are retried, even if others accepted the message.
+func TestSmtpSender_DeliverPartiallyDeferred(t *testing.T) {
+	c := &mockClient{greylisted: map[string]bool{"new@example.org": true}}
+	s := &smtpSender{c, NewDialer("localhost", 25, "", "")}
+	report, err := s.deliver("from@example.com", []string{"to@example.com", "new@example.org"}, strings.NewReader("body"))
+	if de := Classify(err); de == nil || de.Class != ClassTransient || de.Code != 451 {
+		t.Fatalf("unexpected error: %+v", de)
+	}
+	if accepted := report.Accepted(); len(accepted) != 1 || accepted[0].Email != "to@example.com" {
+		t.Fatalf("unexpected accepted recipients: %+v", accepted)
+	} else if rejected := report.Rejected(); len(rejected) != 1 || rejected[0].Email != "new@example.org" || rejected[0].Status != "4.7.1" {
+		t.Fatalf("unexpected rejected recipients: %+v", rejected)
+	}
+	if c.data.String() != "body" {
+		t.Fatalf("unexpected data: %s", c.data.String())
+	}
+}
+
+// Ensure a delivery is retried if any recipient might be accepted later.
+func TestSmtpSender_DeliverAllRejectedTransient(t *testing.T) {
+	c := &mockClient{
+		rejected: map[string]bool{"unknown@example.com": true},
+		deferred: map[string]bool{"busy@example.com": true},
+	}
+	s := &smtpSender{c, NewDialer("localhost", 25, "", "")}
+	report, err := s.deliver("from@example.com", []string{"busy@example.com", "unknown@example.com"}, strings.NewReader("body"))
+	if de := Classify(err); de == nil || de.Class != ClassTransient || de.Code != 450 {
+		t.Fatalf("unexpected error: %+v", de)
+	}
+	if rejected := report.Rejected(); len(rejected) != 2 || rejected[0].Class != ClassTransient || rejected[1].Class != ClassPermanent {
+		t.Fatalf("unexpected rejected recipients: %+v", rejected)
+	}
+}
+
+func TestDialer_MandatoryStartTLS(t *testing.T) {
+	defer func(dial func(string, string, time.Duration) (net.Conn, error), newClient func(net.Conn, string) (smtpClient, error)) {
+		netDialTimeout, smtpNewClient = dial, newClient
+	}(netDialTimeout, smtpNewClient)
+	netDialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
+		return &mockClient{}, nil
+	}
+
+	d := NewDialer("relay.example.com", 587, "", "")
+	if _, err := d.dial(); err != nil {
+		t.Fatalf("opportunistic STARTTLS failed: %s", err)
+	}
+	d.StartTLS = MandatoryStartTLS
+	_, err := d.dial()
+	if err == nil || !strings.Contains(err.Error(), "doesn't offer STARTTLS") {
+		t.Fatalf("unexpected error: %v", err)
+	} else if Classify(err).Permanent() {
+		t.Fatalf("missing STARTTLS must be retried: %v", err)
+	}
+}
+
+func TestDialer_TLSConfig(t *testing.T) {
+	d := NewDialer("relay.example.com", 587, "", "")
+	if c := d.tlsConfig(); c.InsecureSkipVerify || c.ServerName != "relay.example.com" {
+		t.Fatalf("unexpected default TLS config: %+v", c)
+	}
+	d.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if c := d.tlsConfig(); c.ServerName != "relay.example.com" || c.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("unexpected TLS config: %+v", c)
+	} else if d.TLSConfig.ServerName != "" {
+		t.Fatal("shared TLS config must not be modified")
+	}
+}
@@ -0,0 +1,169 @@
+package smtp
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// blockElements start on a new line in the plain text version.
+var blockElements = map[atom.Atom]bool{
+	atom.Address: true, atom.Article: true, atom.Aside: true, atom.Blockquote: true,
+	atom.Div: true, atom.Dl: true, atom.Dt: true, atom.Dd: true, atom.Footer: true,
+	atom.Form: true, atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true,
+	atom.H5: true, atom.H6: true, atom.Header: true, atom.Hr: true, atom.Li: true,
+	atom.Main: true, atom.Nav: true, atom.Ol: true, atom.P: true, atom.Pre: true,
+	atom.Section: true, atom.Table: true, atom.Tr: true, atom.Ul: true,
+}
+
+// skippedElements don't contain any readable content.
+var skippedElements = map[atom.Atom]bool{
+	atom.Head: true, atom.Script: true, atom.Style: true, atom.Title: true,
+}
+
+// HTMLToText generates a readable plain text version of an HTML body. Tags
+// are stripped, block elements are separated by blank lines and link targets
+// are kept in parentheses after the link text.
+func HTMLToText(body string) string {
+	w := &textWriter{}
+	var links []string
+	skipDepth := 0
+	z := html.NewTokenizer(strings.NewReader(body))
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			if z.Err() != io.EOF {
+				return strings.TrimSpace(body)
+			}
+			return w.String()
+		case html.TextToken:
+			if skipDepth == 0 {
+				w.text(string(z.Text()))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			if skippedElements[tok.DataAtom] {
+				if tt == html.StartTagToken {
+					skipDepth++
+				}
+				continue
+			}
+			if skipDepth > 0 {
+				continue
+			}
+			switch {
+			case tok.DataAtom == atom.Br:
+				w.newline()
+			case tok.DataAtom == atom.A:
+				links = append(links, attr(tok, "href"))
+			case tok.DataAtom == atom.Img:
+				w.text(attr(tok, "alt"))
+			case blockElements[tok.DataAtom]:
+				w.paragraph()
+				if tok.DataAtom == atom.Li {
+					w.text("* ")
+				}
+			}
+		case html.EndTagToken:
+			tok := z.Token()
+			if skippedElements[tok.DataAtom] {
+				if skipDepth > 0 {
+					skipDepth--
+				}
+				continue
+			}
+			if skipDepth > 0 {
+				continue
+			}
+			switch {
+			case tok.DataAtom == atom.A && len(links) > 0:
+				href := links[len(links)-1]
+				links = links[:len(links)-1]
+				w.link(href)
+			case blockElements[tok.DataAtom]:
+				w.paragraph()
+			}
+		}
+	}
+}
+
+func attr(tok html.Token, name string) string {
+	for _, a := range tok.Attr {
+		if a.Key == name {
+			return strings.TrimSpace(a.Val)
+		}
+	}
+	return ""
+}
+
+// textWriter collapses whitespace like a browser would and keeps track of
+// the line breaks between blocks.
+type textWriter struct {
+	buf      bytes.Buffer
+	line     bytes.Buffer
+	space    bool
+	newlines int
+}
+
+func (w *textWriter) text(s string) {
+	if s == "" {
+		return
+	}
+	if unicode.IsSpace(rune(s[0])) {
+		w.space = true
+	}
+	for _, field := range strings.Fields(s) {
+		if w.space && w.line.Len() > 0 {
+			w.line.WriteByte(' ')
+		}
+		w.line.WriteString(field)
+		w.space = true
+	}
+	w.space = unicode.IsSpace(rune(s[len(s)-1]))
+}
+
+func (w *textWriter) link(href string) {
+	if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(href, "mailto:") {
+		return
+	}
+	if strings.HasSuffix(w.line.String(), href) {
+		return
+	}
+	w.line.WriteString(" (" + href + ")")
+}
+
+func (w *textWriter) flush() {
+	line := strings.TrimSpace(w.line.String())
+	w.line.Reset()
+	w.space = false
+	if line == "" {
+		return
+	}
+	if w.buf.Len() > 0 {
+		w.buf.WriteString(strings.Repeat("\n", w.newlines))
+	}
+	w.buf.WriteString(line)
+	w.newlines = 0
+}
+
+func (w *textWriter) newline() {
+	w.flush()
+	if w.newlines < 1 {
+		w.newlines = 1
+	}
+}
+
+func (w *textWriter) paragraph() {
+	w.flush()
+	w.newlines = 2
+}
+
+func (w *textWriter) String() string {
+	w.flush()
+	return w.buf.String()
+}
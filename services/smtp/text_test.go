@@ -0,0 +1,26 @@
+package smtp_test
+
+import (
+	"testing"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/smtp"
+)
+
+func TestHTMLToText(t *testing.T) {
+	for _, tt := range []struct {
+		html string
+		text string
+	}{
+		{`<p>Hello <b>World</b></p>`, "Hello World"},
+		{`<html><head><title>x</title><style>p{}</style></head><body><h1>Title</h1><p>first</p><p>second<br>line</p></body></html>`, "Title\n\nfirst\n\nsecond\nline"},
+		{`Visit <a href="https://cloudive.cc">our site</a>!`, "Visit our site (https://cloudive.cc)!"},
+		{`<a href="https://cloudive.cc">https://cloudive.cc</a>`, "https://cloudive.cc"},
+		{`<ul><li>one</li><li>two</li></ul>`, "* one\n\n* two"},
+		{`<img src="logo.png" alt="Logo"> &amp; more`, "Logo & more"},
+		{`<script>alert(1)</script>plain`, "plain"},
+	} {
+		if got := smtp.HTMLToText(tt.html); got != tt.text {
+			t.Errorf("HTMLToText(%q) = %q, expected %q", tt.html, got, tt.text)
+		}
+	}
+}
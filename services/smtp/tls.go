@@ -0,0 +1,157 @@
+package smtp
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// TLS modes of the connection to the relay.
+const (
+	// TLSModeNone never encrypts the connection.
+	TLSModeNone = "none"
+	// TLSModeOpportunistic uses STARTTLS if the relay offers it and
+	// implicit TLS on port 465.
+	TLSModeOpportunistic = "opportunistic"
+	// TLSModeStartTLS fails the delivery if the relay doesn't offer STARTTLS.
+	TLSModeStartTLS = "starttls"
+	// TLSModeImplicit connects with TLS right away.
+	TLSModeImplicit = "tls"
+)
+
+const (
+	// DefaultTLSMode defines how the connection to the relay is encrypted
+	DefaultTLSMode = TLSModeOpportunistic
+
+	// DefaultTLSMinVersion defines the oldest TLS version accepted
+	DefaultTLSMinVersion = "1.2"
+)
+
+// tlsVersions are the accepted minimum versions. 1.3 is added by tls13.go
+// when built with Go 1.12 or later.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+}
+
+// TLSConfig represents the TLS policy for connections to the relay.
+type TLSConfig struct {
+	Mode string `toml:"mode"`
+	// InsecureSkipVerify accepts any certificate of the relay. Pinned
+	// fingerprints are still checked.
+	InsecureSkipVerify bool `toml:"insecure-skip-verify"`
+	// ServerName is verified instead of the hostname of the relay.
+	ServerName string `toml:"server-name"`
+	// CAFiles are PEM bundles of the certificate authorities trusted
+	// instead of the system roots.
+	CAFiles []string `toml:"ca-files"`
+	// CertFile and KeyFile are the client certificate for mutual TLS.
+	CertFile   string `toml:"cert-file"`
+	KeyFile    string `toml:"key-file"`
+	MinVersion string `toml:"min-version"`
+	// PinnedFingerprints are the hex encoded SHA-256 fingerprints of
+	// certificates, one of which the relay has to present.
+	PinnedFingerprints []string `toml:"pinned-fingerprints"`
+}
+
+// NewTLSConfig returns a new TLSConfig with default settings.
+func NewTLSConfig() TLSConfig {
+	return TLSConfig{
+		Mode:       DefaultTLSMode,
+		MinVersion: DefaultTLSMinVersion,
+	}
+}
+
+// Validate returns an error if the TLS policy is invalid.
+func (c TLSConfig) Validate() error {
+	switch c.Mode {
+	case TLSModeNone, TLSModeOpportunistic, TLSModeStartTLS, TLSModeImplicit:
+	default:
+		return fmt.Errorf("unknown TLS mode %q", c.Mode)
+	}
+	if _, ok := tlsVersions[c.MinVersion]; !ok && c.MinVersion != "" {
+		return fmt.Errorf("unknown TLS version %q", c.MinVersion)
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("TLS client certificates need both cert-file and key-file")
+	}
+	for _, fp := range c.PinnedFingerprints {
+		if _, err := parseFingerprint(fp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load builds the tls.Config of the policy, reading all certificates.
+func (c TLSConfig) Load() (*tls.Config, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		MinVersion:         tlsVersions[c.MinVersion],
+	}
+	if len(c.CAFiles) > 0 {
+		config.RootCAs = x509.NewCertPool()
+		for _, path := range c.CAFiles {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			if !config.RootCAs.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificates found in %s", path)
+			}
+		}
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if len(c.PinnedFingerprints) > 0 {
+		var pins [][]byte
+		for _, fp := range c.PinnedFingerprints {
+			pin, _ := parseFingerprint(fp)
+			pins = append(pins, pin)
+		}
+		config.VerifyPeerCertificate = verifyPins(pins)
+	}
+	return config, nil
+}
+
+// parseFingerprint decodes a SHA-256 fingerprint, which may be separated by
+// colons like the output of openssl x509 -fingerprint.
+func parseFingerprint(fp string) ([]byte, error) {
+	pin, err := hex.DecodeString(strings.Replace(strings.TrimPrefix(strings.ToLower(fp), "sha256:"), ":", "", -1))
+	if err != nil || len(pin) != sha256.Size {
+		return nil, fmt.Errorf("invalid SHA-256 fingerprint %q", fp)
+	}
+	return pin, nil
+}
+
+// verifyPins accepts the connection if one of the certificates presented by
+// the relay matches a pin.
+func verifyPins(pins [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		for _, raw := range rawCerts {
+			sum := sha256.Sum256(raw)
+			for _, pin := range pins {
+				if subtle.ConstantTimeCompare(sum[:], pin) == 1 {
+					return nil
+				}
+			}
+		}
+		return errors.New("smtp: certificate of the relay doesn't match any pinned fingerprint")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build go1.12
+// +build go1.12
+
+package smtp
+
+import "crypto/tls"
+
+func init() {
+	tlsVersions["1.3"] = tls.VersionTLS13
+}
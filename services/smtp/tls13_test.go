@@ -0,0 +1,33 @@
+//go:build go1.12
+// +build go1.12
+
+package smtp_test
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nirnanaaa/cloudive-mailer/services/smtp"
+)
+
+func TestConfig_ParseTLS13(t *testing.T) {
+	c := smtp.NewConfig()
+	if _, err := toml.Decode(`
+		[tls]
+		mode = "tls"
+		min-version = "1.3"
+`, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	config, err := c.TLS.Load()
+	if err != nil {
+		t.Fatal(err)
+	} else if config.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("unexpected min version: %x", config.MinVersion)
+	}
+}
@@ -0,0 +1,70 @@
+package smtp_test
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nirnanaaa/cloudive-mailer/services/smtp"
+)
+
+func TestConfig_ParseTLS(t *testing.T) {
+	c := smtp.NewConfig()
+	if _, err := toml.Decode(`
+		hostname = "relay.example.com"
+
+		[tls]
+		mode = "starttls"
+		server-name = "mx.example.com"
+		min-version = "1.1"
+		pinned-fingerprints = ["SHA256:`+colons(sha256.Sum256([]byte("cert")))+`"]
+`, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.TLS.Mode != smtp.TLSModeStartTLS || c.TLS.ServerName != "mx.example.com" || c.TLS.InsecureSkipVerify {
+		t.Fatalf("unexpected TLS config: %+v", c.TLS)
+	}
+	config, err := c.TLS.Load()
+	if err != nil {
+		t.Fatal(err)
+	} else if config.MinVersion != tls.VersionTLS11 || config.ServerName != "mx.example.com" {
+		t.Fatalf("unexpected tls.Config: %+v", config)
+	}
+	if err := config.VerifyPeerCertificate([][]byte{[]byte("other"), []byte("cert")}, nil); err != nil {
+		t.Fatalf("pinned certificate rejected: %s", err)
+	}
+	if err := config.VerifyPeerCertificate([][]byte{[]byte("other")}, nil); err == nil {
+		t.Fatal("expected an error for a certificate which isn't pinned")
+	}
+}
+
+func TestTLSConfig_Validate(t *testing.T) {
+	if err := smtp.NewTLSConfig().Validate(); err != nil {
+		t.Fatalf("default TLS config is invalid: %s", err)
+	}
+	for name, c := range map[string]smtp.TLSConfig{
+		"mode":        {Mode: "always"},
+		"version":     {Mode: smtp.TLSModeNone, MinVersion: "2.0"},
+		"client cert": {Mode: smtp.TLSModeImplicit, CertFile: "client.pem"},
+		"fingerprint": {Mode: smtp.TLSModeImplicit, PinnedFingerprints: []string{"abc"}},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+}
+
+func colons(sum [sha256.Size]byte) string {
+	s := hex.EncodeToString(sum[:])
+	var out []byte
+	for i := 0; i < len(s); i += 2 {
+		if i > 0 {
+			out = append(out, ':')
+		}
+		out = append(out, s[i:i+2]...)
+	}
+	return string(out)
+}
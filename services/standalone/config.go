@@ -0,0 +1,34 @@
+package standalone
+
+import (
+	"fmt"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
+)
+
+const (
+	// DefaultBackend defines the queue backend used in standalone mode
+	DefaultBackend = queue.BackendMemory
+)
+
+// Config represents a configuration for the standalone mode. All other
+// queue settings are taken from the [queue] section.
+type Config struct {
+	Backend string `toml:"backend"`
+}
+
+// NewConfig returns a new Config with default settings.
+func NewConfig() *Config {
+	return &Config{
+		Backend: DefaultBackend,
+	}
+}
+
+// Validate returns an error if the config is invalid.
+func (c *Config) Validate() error {
+	switch c.Backend {
+	case queue.BackendKafka, queue.BackendMemory, queue.BackendDisk:
+		return nil
+	}
+	return fmt.Errorf("unknown standalone queue backend %q", c.Backend)
+}
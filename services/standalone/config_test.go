@@ -0,0 +1,25 @@
+package standalone_test
+
+import (
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nirnanaaa/cloudive-mailer/services/standalone"
+)
+
+func TestConfig_Parse(t *testing.T) {
+	// Parse configuration.
+	c := standalone.NewConfig()
+	if _, err := toml.Decode(`
+		backend = "disk"
+`, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	// Validate configuration.
+	if c.Backend != "disk" {
+		t.Fatalf("unexpected backend: %s", c.Backend)
+	} else if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,42 @@
+package status
+
+import (
+	"time"
+
+	itoml "github.com/influxdata/influxdb/toml"
+)
+
+const (
+	// DefaultEnabled enables or disables message status tracking
+	DefaultEnabled = false
+
+	// DefaultPath defines where message states are stored
+	DefaultPath = "/var/lib/cloudive/status"
+
+	// DefaultRetention defines how long the states of messages are kept
+	// after their last change
+	DefaultRetention = 30 * 24 * time.Hour
+
+	// DefaultSweepInterval defines how often expired states are removed
+	DefaultSweepInterval = time.Hour
+)
+
+// Config represents a configuration for the message status store.
+type Config struct {
+	Enabled bool   `toml:"enabled"`
+	Path    string `toml:"path"`
+	// Retention defines how long the state of a message is kept after its
+	// last change, 0 keeps them forever.
+	Retention     itoml.Duration `toml:"retention"`
+	SweepInterval itoml.Duration `toml:"sweep-interval"`
+}
+
+// NewConfig returns a new Config with default settings.
+func NewConfig() *Config {
+	return &Config{
+		Enabled:       DefaultEnabled,
+		Path:          DefaultPath,
+		Retention:     itoml.Duration(DefaultRetention),
+		SweepInterval: itoml.Duration(DefaultSweepInterval),
+	}
+}
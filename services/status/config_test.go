@@ -0,0 +1,30 @@
+package status_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nirnanaaa/cloudive-mailer/services/status"
+)
+
+func TestConfig_Parse(t *testing.T) {
+	// Parse configuration.
+	c := status.NewConfig()
+	if _, err := toml.Decode(`
+		enabled = true
+		path = "/tmp/status"
+		retention = "168h"
+`, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	// Validate configuration.
+	if !c.Enabled {
+		t.Fatalf("unexpected Enabled, want true got false")
+	} else if c.Path != "/tmp/status" {
+		t.Fatalf("unexpected path: %s", c.Path)
+	} else if time.Duration(c.Retention) != 7*24*time.Hour || time.Duration(c.SweepInterval) != status.DefaultSweepInterval {
+		t.Fatalf("unexpected retention: %s %s", time.Duration(c.Retention), time.Duration(c.SweepInterval))
+	}
+}
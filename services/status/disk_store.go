@@ -0,0 +1,278 @@
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DiskStore stores the status of every message as a JSON file in
+// <path>/<id>.json. States which haven't changed for longer than the
+// retention are removed periodically while the store is started.
+type DiskStore struct {
+	Logger        *logrus.Entry
+	Path          string
+	Retention     time.Duration
+	SweepInterval time.Duration
+
+	// mu serializes the updates of status files within the process, lock
+	// files with other processes using the same path. Readers don't need
+	// them as files are replaced atomically.
+	mu      sync.Mutex
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewDiskStore returns a new instance of DiskStore.
+func NewDiskStore(c *Config) *DiskStore {
+	return &DiskStore{
+		Logger:        logrus.New().WithField("prefix", "status"),
+		Path:          c.Path,
+		Retention:     time.Duration(c.Retention),
+		SweepInterval: time.Duration(c.SweepInterval),
+		closing:       make(chan struct{}),
+	}
+}
+
+// Start starts removing expired states.
+func (s *DiskStore) Start() error {
+	if err := os.MkdirAll(s.Path, 0700); err != nil {
+		return err
+	}
+	if s.Retention > 0 && s.SweepInterval > 0 {
+		s.wg.Add(1)
+		go s.sweepLoop()
+	}
+	return nil
+}
+
+// Stop stops removing expired states.
+func (s *DiskStore) Stop() error {
+	close(s.closing)
+	s.wg.Wait()
+	return nil
+}
+
+func (s *DiskStore) sweepLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.SweepInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.Sweep(time.Now()); err != nil {
+			s.Logger.WithError(err).Error("Removing expired states failed")
+		}
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep removes the states which haven't changed for longer than the
+// retention, including temporary files of interrupted writes.
+func (s *DiskStore) Sweep(now time.Time) error {
+	if s.Retention <= 0 {
+		return nil
+	}
+	files, err := ioutil.ReadDir(s.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	expired := now.Add(-s.Retention)
+	for _, fi := range files {
+		if fi.ModTime().After(expired) {
+			continue
+		}
+		if err := s.remove(fi.Name(), expired); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove removes a file unless it was updated since it was listed.
+func (s *DiskStore) remove(name string, expired time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if strings.HasSuffix(name, ".json") {
+		unlock, err := s.lock(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	path := filepath.Join(s.Path, name)
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.ModTime().After(expired) {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Report applies e to the status of its message.
+func (s *DiskStore) Report(e *Event) error {
+	if err := ValidateID(e.ID); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := s.lock(e.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	status, err := s.read(e.ID)
+	if err == ErrNotFound {
+		status = &Status{}
+	} else if err != nil {
+		return err
+	}
+	status.Apply(*e)
+	return s.write(status)
+}
+
+// Get returns the status of a message.
+func (s *DiskStore) Get(id string) (*Status, error) {
+	if err := ValidateID(id); err != nil {
+		return nil, err
+	}
+	return s.read(id)
+}
+
+// List returns the messages selected by f, the most recently updated first.
+// Reports are not blocked while the directory is scanned.
+func (s *DiskStore) List(f Filter) ([]*Status, error) {
+	files, err := ioutil.ReadDir(s.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var list []*Status
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		status, err := s.read(strings.TrimSuffix(fi.Name(), ".json"))
+		if err == ErrNotFound {
+			// removed by the sweeper in the meantime
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if f.Match(status) {
+			list = append(list, status)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].UpdatedAt.After(list[j].UpdatedAt) })
+	if f.Limit > 0 && len(list) > f.Limit {
+		list = list[:f.Limit]
+	}
+	return list, nil
+}
+
+// lock takes the lock file of the status of id, which is shared with other
+// processes using the same path, like workers on the host of their master.
+// Locks older than staleLockAge were left behind by a crashed process and
+// are broken.
+func (s *DiskStore) lock(id string) (unlock func(), err error) {
+	if err := os.MkdirAll(s.Path, 0700); err != nil {
+		return nil, err
+	}
+	path := s.file(id) + ".lock"
+	deadline := time.Now().Add(staleLockAge)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		} else if !os.IsExist(err) {
+			return nil, err
+		}
+		if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) > staleLockAge {
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("status of %s is locked by another process", id)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// staleLockAge is the age of lock files which are not held anymore.
+const staleLockAge = 10 * time.Second
+
+func (s *DiskStore) file(id string) string {
+	return filepath.Join(s.Path, id+".json")
+}
+
+func (s *DiskStore) read(id string) (*Status, error) {
+	data, err := ioutil.ReadFile(s.file(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var status Status
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// write replaces the status file atomically, so readers never see a
+// partially written file.
+func (s *DiskStore) write(status *Status) error {
+	if err := os.MkdirAll(s.Path, 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.Path, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), s.file(status.ID)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// SetLogOutput sets the writer to which all logs are written. It must not be
+// called after Open is called.
+func (s *DiskStore) SetLogOutput(log *logrus.Logger) {
+	s.Logger = log.WithField("prefix", "status")
+}
@@ -0,0 +1,144 @@
+package status
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
+)
+
+// State is a step in the lifecycle of a message.
+type State string
+
+// All states of a message.
+const (
+	StateAccepted     State = "accepted"
+	StateQueued       State = "queued"
+	StateAttempting   State = "attempting"
+	StateDelivered    State = "delivered"
+	StateDeferred     State = "deferred"
+	StateBounced      State = "bounced"
+	StateDeadLettered State = "dead_lettered"
+)
+
+var (
+	// ErrNotFound is returned for unknown messages.
+	ErrNotFound = errors.New("message not found")
+
+	// ErrInvalidID is returned for message IDs which can't be stored.
+	ErrInvalidID = errors.New("invalid message id")
+)
+
+var validID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// ValidateID returns ErrInvalidID if id can't be used as message ID.
+func ValidateID(id string) error {
+	if len(id) > 128 || !validID.MatchString(id) {
+		return ErrInvalidID
+	}
+	return nil
+}
+
+// Event is a transition of a message into a new state.
+type Event struct {
+	ID      string    `json:"id"`
+	State   State     `json:"state"`
+	At      time.Time `json:"at"`
+	TraceID string    `json:"trace_id,omitempty"`
+	Attempt int       `json:"attempt,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	// Rejected lists the recipients rejected by the SMTP server.
+	Rejected []string `json:"rejected,omitempty"`
+}
+
+// Status is the current state of a message together with its history.
+type Status struct {
+	ID        string    `json:"id"`
+	State     State     `json:"state"`
+	TraceID   string    `json:"trace_id,omitempty"`
+	Attempts  int       `json:"attempts"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Events    []Event   `json:"events"`
+}
+
+// Apply adds an event to the history. Events reported by different
+// processes may arrive out of order, so the state is taken from the latest
+// event.
+func (s *Status) Apply(e Event) {
+	s.Events = append(s.Events, e)
+	sort.SliceStable(s.Events, func(i, j int) bool { return s.Events[i].At.Before(s.Events[j].At) })
+	s.ID = e.ID
+	if e.TraceID != "" {
+		s.TraceID = e.TraceID
+	}
+	if e.Attempt > s.Attempts {
+		s.Attempts = e.Attempt
+	}
+	s.CreatedAt = s.Events[0].At
+	last := s.Events[len(s.Events)-1]
+	s.State = last.State
+	s.UpdatedAt = last.At
+}
+
+// Filter selects messages from a store.
+type Filter struct {
+	State State
+	// Since only selects messages updated after the given time.
+	Since time.Time
+	// Limit is the maximum number of messages returned, 0 means no limit.
+	Limit int
+}
+
+// Match returns true if the filter selects s.
+func (f Filter) Match(s *Status) bool {
+	if f.State != "" && s.State != f.State {
+		return false
+	}
+	return f.Since.IsZero() || s.UpdatedAt.After(f.Since)
+}
+
+// Reporter reports state transitions of messages.
+type Reporter interface {
+	Report(e *Event) error
+}
+
+// Store keeps track of the state of all messages.
+type Store interface {
+	Reporter
+	// Get returns the status of a message.
+	Get(id string) (*Status, error)
+	// List returns the messages selected by f, the most recently updated
+	// first.
+	List(f Filter) ([]*Status, error)
+}
+
+// QueueReporter publishes events into a queue, from where they are recorded
+// by the process owning the store.
+type QueueReporter struct {
+	Publish func(msg *queue.Message) error
+}
+
+// Report publishes e.
+func (r *QueueReporter) Report(e *Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return r.Publish(&queue.Message{Key: e.ID, Value: data})
+}
+
+// Recorder returns a handler recording the events published by a
+// QueueReporter into store.
+func Recorder(store Store) queue.Handler {
+	return queue.HandlerFunc(func(msg *queue.Message) error {
+		var e Event
+		if err := json.Unmarshal(msg.Value, &e); err != nil {
+			return err
+		}
+		return store.Report(&e)
+	})
+}
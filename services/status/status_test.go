@@ -0,0 +1,156 @@
+package status_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/status"
+)
+
+func NewTestStore(t *testing.T) *status.DiskStore {
+	dir, err := ioutil.TempDir("", "cloudive-status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status.NewDiskStore(&status.Config{Path: dir})
+}
+
+// Ensure the state is taken from the latest event, no matter in which order
+// the events arrive.
+func TestStatus_Apply(t *testing.T) {
+	now := time.Now()
+	var s status.Status
+	s.Apply(status.Event{ID: "abc", State: status.StateAttempting, At: now.Add(time.Second), Attempt: 1})
+	s.Apply(status.Event{ID: "abc", State: status.StateAccepted, At: now, TraceID: "trace"})
+	if s.State != status.StateAttempting {
+		t.Fatalf("unexpected state: %s", s.State)
+	} else if !s.CreatedAt.Equal(now) || !s.UpdatedAt.Equal(now.Add(time.Second)) {
+		t.Fatalf("unexpected times: %s %s", s.CreatedAt, s.UpdatedAt)
+	} else if s.TraceID != "trace" || s.Attempts != 1 || len(s.Events) != 2 {
+		t.Fatalf("unexpected status: %+v", s)
+	}
+}
+
+func TestDiskStore(t *testing.T) {
+	store := NewTestStore(t)
+	defer os.RemoveAll(store.Path)
+
+	now := time.Now().UTC()
+	for _, e := range []*status.Event{
+		{ID: "first", State: status.StateAccepted, At: now},
+		{ID: "first", State: status.StateDelivered, At: now.Add(time.Second)},
+		{ID: "second", State: status.StateAccepted, At: now.Add(2 * time.Second)},
+	} {
+		if err := store.Report(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := store.Get("first")
+	if err != nil {
+		t.Fatal(err)
+	} else if s.State != status.StateDelivered || len(s.Events) != 2 {
+		t.Fatalf("unexpected status: %+v", s)
+	}
+	if _, err := store.Get("missing"); err != status.ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := store.Get("../etc/passwd"); err != status.ErrInvalidID {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	list, err := store.List(status.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(list) != 2 || list[0].ID != "second" {
+		t.Fatalf("unexpected list: %+v", list)
+	}
+	list, err = store.List(status.Filter{State: status.StateDelivered})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(list) != 1 || list[0].ID != "first" {
+		t.Fatalf("unexpected filtered list: %+v", list)
+	}
+	list, err = store.List(status.Filter{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(list) != 1 {
+		t.Fatalf("unexpected limited list: %+v", list)
+	}
+}
+
+// Ensure events published by a QueueReporter are recorded by a Recorder.
+func TestQueueReporter(t *testing.T) {
+	store := NewTestStore(t)
+	defer os.RemoveAll(store.Path)
+
+	recorder := status.Recorder(store)
+	reporter := &status.QueueReporter{Publish: recorder.Handle}
+	if err := reporter.Report(&status.Event{ID: "abc", State: status.StateBounced, At: time.Now(), Error: "550 user unknown"}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := store.Get("abc")
+	if err != nil {
+		t.Fatal(err)
+	} else if s.State != status.StateBounced || s.Events[0].Error != "550 user unknown" {
+		t.Fatalf("unexpected status: %+v", s)
+	}
+}
+
+func TestDiskStore_Sweep(t *testing.T) {
+	store := NewTestStore(t)
+	defer os.RemoveAll(store.Path)
+	store.Retention = time.Hour
+
+	if err := store.Report(&status.Event{ID: "first", State: status.StateAccepted, At: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Sweep(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("first"); err != nil {
+		t.Fatalf("state removed before its retention: %v", err)
+	}
+	if err := store.Sweep(time.Now().Add(store.Retention + time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("first"); err != status.ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if list, err := store.List(status.Filter{}); err != nil || len(list) != 0 {
+		t.Fatalf("unexpected list: %+v %v", list, err)
+	}
+}
+
+// Ensure stores of different processes sharing a path don't lose updates.
+func TestDiskStore_SharedPath(t *testing.T) {
+	master := NewTestStore(t)
+	defer os.RemoveAll(master.Path)
+	worker := status.NewDiskStore(&status.Config{Path: master.Path})
+
+	now := time.Now()
+	var wg sync.WaitGroup
+	for i, store := range []*status.DiskStore{master, worker} {
+		wg.Add(1)
+		go func(i int, store *status.DiskStore) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				e := &status.Event{ID: "abc", State: status.StateAttempting, At: now.Add(time.Duration(j) * time.Second), Error: fmt.Sprint(i)}
+				if err := store.Report(e); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i, store)
+	}
+	wg.Wait()
+
+	if s, err := master.Get("abc"); err != nil {
+		t.Fatal(err)
+	} else if len(s.Events) != 100 {
+		t.Fatalf("unexpected number of events: %d", len(s.Events))
+	}
+}
@@ -0,0 +1,23 @@
+package templates
+
+const (
+	// DefaultEnabled enables or disables server side templates
+	DefaultEnabled = false
+
+	// DefaultPath defines where templates are stored
+	DefaultPath = "/var/lib/cloudive/templates"
+)
+
+// Config represents a configuration for the template store.
+type Config struct {
+	Enabled bool   `toml:"enabled"`
+	Path    string `toml:"path"`
+}
+
+// NewConfig returns a new Config with default settings.
+func NewConfig() *Config {
+	return &Config{
+		Enabled: DefaultEnabled,
+		Path:    DefaultPath,
+	}
+}
@@ -0,0 +1,26 @@
+package templates_test
+
+import (
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nirnanaaa/cloudive-mailer/services/templates"
+)
+
+func TestConfig_Parse(t *testing.T) {
+	// Parse configuration.
+	c := templates.NewConfig()
+	if _, err := toml.Decode(`
+		enabled = true
+		path = "/tmp/templates"
+`, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	// Validate configuration.
+	if !c.Enabled {
+		t.Fatalf("unexpected Enabled, want true got false")
+	} else if c.Path != "/tmp/templates" {
+		t.Fatalf("unexpected path: %s", c.Path)
+	}
+}
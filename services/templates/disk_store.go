@@ -0,0 +1,189 @@
+package templates
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiskStore stores every template version as a JSON file in
+// <path>/<id>/<version>.json.
+type DiskStore struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// NewDiskStore returns a new instance of DiskStore.
+func NewDiskStore(c *Config) *DiskStore {
+	return &DiskStore{Path: c.Path}
+}
+
+// Get returns a version of a template. Version 0 returns the latest version.
+func (s *DiskStore) Get(id string, version int) (*Template, error) {
+	if err := ValidateID(id); err != nil {
+		return nil, err
+	}
+	if version == 0 {
+		versions, err := s.versions(id)
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) == 0 {
+			return nil, ErrNotFound
+		}
+		version = versions[len(versions)-1]
+	}
+	return s.read(id, version)
+}
+
+// Put stores t as a new version of the template with t.ID.
+func (s *DiskStore) Put(t *Template) (*Template, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := filepath.Join(s.Path, t.ID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	for {
+		versions, err := s.versions(t.ID)
+		if err != nil {
+			return nil, err
+		}
+		stored := *t
+		stored.Version = 1
+		if len(versions) > 0 {
+			stored.Version = versions[len(versions)-1] + 1
+		}
+		stored.CreatedAt = time.Now().UTC()
+		data, err := json.Marshal(&stored)
+		if err != nil {
+			return nil, err
+		}
+		// O_EXCL detects versions written concurrently by other processes.
+		f, err := os.OpenFile(s.file(t.ID, stored.Version), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		_, err = f.Write(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(s.file(t.ID, stored.Version))
+			return nil, err
+		}
+		return &stored, nil
+	}
+}
+
+// List returns the latest version of every template.
+func (s *DiskStore) List() ([]*Template, error) {
+	dirs, err := ioutil.ReadDir(s.Path)
+	if os.IsNotExist(err) {
+		return []*Template{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	templates := []*Template{}
+	for _, dir := range dirs {
+		if !dir.IsDir() || ValidateID(dir.Name()) != nil {
+			continue
+		}
+		t, err := s.Get(dir.Name(), 0)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+// Versions returns all versions of a template.
+func (s *DiskStore) Versions(id string) ([]*Template, error) {
+	if err := ValidateID(id); err != nil {
+		return nil, err
+	}
+	versions, err := s.versions(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, ErrNotFound
+	}
+	templates := make([]*Template, 0, len(versions))
+	for _, version := range versions {
+		t, err := s.read(id, version)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+// Delete removes a template with all its versions.
+func (s *DiskStore) Delete(id string) error {
+	if err := ValidateID(id); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dir := filepath.Join(s.Path, id)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return os.RemoveAll(dir)
+}
+
+func (s *DiskStore) file(id string, version int) string {
+	return filepath.Join(s.Path, id, strconv.Itoa(version)+".json")
+}
+
+func (s *DiskStore) read(id string, version int) (*Template, error) {
+	data, err := ioutil.ReadFile(s.file(id, version))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var t Template
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// versions returns the sorted version numbers of a template.
+func (s *DiskStore) versions(id string) ([]int, error) {
+	files, err := ioutil.ReadDir(filepath.Join(s.Path, id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var versions []int
+	for _, fi := range files {
+		version, err := strconv.Atoi(strings.TrimSuffix(fi.Name(), ".json"))
+		if err != nil || !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
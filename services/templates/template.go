@@ -0,0 +1,152 @@
+package templates
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"regexp"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/kafka/event"
+)
+
+var (
+	// ErrNotFound is returned when a template or template version does not exist.
+	ErrNotFound = errors.New("template not found")
+
+	// ErrInvalidID is returned for template ids, which are not safe to be used as file name.
+	ErrInvalidID = errors.New("template id may only contain letters, digits, '-' and '_'")
+
+	validID = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,128}$`)
+)
+
+// ParseError is returned when a part of a template does not parse.
+type ParseError struct {
+	Part string
+	Err  error
+}
+
+func (e ParseError) Error() string {
+	return fmt.Sprintf("invalid %s template: %s", e.Part, e.Err)
+}
+
+// Template is a stored version of a mail template.
+type Template struct {
+	ID        string    `json:"id"`
+	Version   int       `json:"version"`
+	Subject   string    `json:"subject"`
+	HTML      string    `json:"html"`
+	Text      string    `json:"text,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Rendered is the output of a rendered template.
+type Rendered struct {
+	Subject string `json:"subject"`
+	HTML    string `json:"html"`
+	Text    string `json:"text,omitempty"`
+}
+
+// Store stores templates by id and version.
+type Store interface {
+	// Get returns a version of a template. Version 0 returns the latest version.
+	Get(id string, version int) (*Template, error)
+	// Put stores t as a new version of the template with t.ID and returns it.
+	Put(t *Template) (*Template, error)
+	// List returns the latest version of every template.
+	List() ([]*Template, error)
+	// Versions returns all versions of a template.
+	Versions(id string) ([]*Template, error)
+	// Delete removes a template with all its versions.
+	Delete(id string) error
+}
+
+// ValidateID returns ErrInvalidID if id is not a valid template id.
+func ValidateID(id string) error {
+	if !validID.MatchString(id) {
+		return ErrInvalidID
+	}
+	return nil
+}
+
+// Validate returns an error if any part of the template does not parse.
+func (t *Template) Validate() error {
+	if err := ValidateID(t.ID); err != nil {
+		return err
+	}
+	_, err := t.parse()
+	return err
+}
+
+type parsed struct {
+	subject *texttemplate.Template
+	html    *htmltemplate.Template
+	text    *texttemplate.Template
+}
+
+// parse parses the template parts. The HTML is parsed with html/template, so
+// all data is escaped according to its context. Subject and text are no HTML
+// and parsed with text/template, otherwise an "&" would end up as "&amp;".
+func (t *Template) parse() (*parsed, error) {
+	var (
+		p   parsed
+		err error
+	)
+	if p.subject, err = texttemplate.New("subject").Parse(t.Subject); err != nil {
+		return nil, ParseError{Part: "subject", Err: err}
+	}
+	if p.html, err = htmltemplate.New("html").Parse(t.HTML); err != nil {
+		return nil, ParseError{Part: "html", Err: err}
+	}
+	if p.text, err = texttemplate.New("text").Parse(t.Text); err != nil {
+		return nil, ParseError{Part: "text", Err: err}
+	}
+	return &p, nil
+}
+
+// Render executes the template with data.
+func (t *Template) Render(data map[string]interface{}) (*Rendered, error) {
+	p, err := t.parse()
+	if err != nil {
+		return nil, err
+	}
+	var r Rendered
+	var buf bytes.Buffer
+	if err := p.subject.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	r.Subject = buf.String()
+	buf.Reset()
+	if err := p.html.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	r.HTML = buf.String()
+	buf.Reset()
+	if err := p.text.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	r.Text = buf.String()
+	return &r, nil
+}
+
+// RenderEvent renders the template referenced by evt and replaces subject
+// and bodies of evt with the result. Events without template are left alone.
+func RenderEvent(store Store, evt *event.InboundEmailEvent) error {
+	if evt.TemplateID == "" {
+		return nil
+	}
+	t, err := store.Get(evt.TemplateID, evt.TemplateVersion)
+	if err != nil {
+		return err
+	}
+	r, err := t.Render(evt.Data)
+	if err != nil {
+		return err
+	}
+	evt.Subject = r.Subject
+	evt.HTML = r.HTML
+	evt.Text = r.Text
+	return nil
+}
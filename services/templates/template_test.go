@@ -0,0 +1,83 @@
+package templates_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/kafka/event"
+	"github.com/nirnanaaa/cloudive-mailer/services/templates"
+)
+
+func TestTemplate_Render(t *testing.T) {
+	tmpl := &templates.Template{
+		ID:      "welcome",
+		Subject: "Welcome {{.name}} & friends",
+		HTML:    "<p>Hello {{.name}}</p>",
+		Text:    "Hello {{.name}}",
+	}
+	r, err := tmpl.Render(map[string]interface{}{"name": "<Tom>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Subject != "Welcome <Tom> & friends" {
+		t.Fatalf("unexpected subject: %s", r.Subject)
+	} else if r.HTML != "<p>Hello &lt;Tom&gt;</p>" {
+		t.Fatalf("unexpected html: %s", r.HTML)
+	} else if r.Text != "Hello <Tom>" {
+		t.Fatalf("unexpected text: %s", r.Text)
+	}
+}
+
+func TestTemplate_ValidateID(t *testing.T) {
+	tmpl := &templates.Template{ID: "../etc"}
+	if err := tmpl.Validate(); err != templates.ErrInvalidID {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestDiskStore_Versions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudive-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := templates.NewDiskStore(&templates.Config{Path: dir})
+
+	for _, subject := range []string{"first", "second"} {
+		if _, err := store.Put(&templates.Template{ID: "welcome", Subject: subject}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	latest, err := store.Get("welcome", 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if latest.Version != 2 || latest.Subject != "second" {
+		t.Fatalf("unexpected latest version: %+v", latest)
+	}
+	first, err := store.Get("welcome", 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if first.Subject != "first" {
+		t.Fatalf("unexpected first version: %+v", first)
+	}
+	if list, err := store.List(); err != nil {
+		t.Fatal(err)
+	} else if len(list) != 1 {
+		t.Fatalf("unexpected template list: %+v", list)
+	}
+
+	evt := &event.InboundEmailEvent{TemplateID: "welcome", TemplateVersion: 1}
+	if err := templates.RenderEvent(store, evt); err != nil {
+		t.Fatal(err)
+	} else if evt.Subject != "first" {
+		t.Fatalf("unexpected subject: %s", evt.Subject)
+	}
+
+	if err := store.Delete("welcome"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("welcome", 0); err != templates.ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
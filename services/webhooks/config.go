@@ -0,0 +1,94 @@
+package webhooks
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	itoml "github.com/influxdata/influxdb/toml"
+)
+
+const (
+	// DefaultEnabled enables or disables delivery event webhooks
+	DefaultEnabled = false
+
+	// DefaultTimeout defines how long a webhook call may take
+	DefaultTimeout = 10 * time.Second
+
+	// DefaultMaxAttempts defines how often a webhook is called until it is given up
+	DefaultMaxAttempts = 5
+
+	// DefaultRetryDelay defines the delay before the first retry, it doubles with every attempt
+	DefaultRetryDelay = 5 * time.Second
+
+	// DefaultQueueSize defines how many webhook calls may be pending
+	DefaultQueueSize = 1000
+
+	// DefaultConcurrency defines how many webhooks are called in parallel
+	DefaultConcurrency = 4
+)
+
+// Config represents a configuration for delivery event webhooks.
+type Config struct {
+	Enabled     bool           `toml:"enabled"`
+	Timeout     itoml.Duration `toml:"timeout"`
+	MaxAttempts int            `toml:"max-attempts"`
+	RetryDelay  itoml.Duration `toml:"retry-delay"`
+	QueueSize   int            `toml:"queue-size"`
+	Concurrency int            `toml:"concurrency"`
+	Endpoints   []Endpoint     `toml:"endpoint"`
+}
+
+// Endpoint is a URL receiving delivery events. Events are only sent when
+// they match all of the given restrictions, empty lists match everything.
+type Endpoint struct {
+	URL string `toml:"url"`
+	// Secret signs the request body.
+	Secret string `toml:"secret"`
+	// Events lists the event types sent, like "delivered" or "bounced".
+	Events []string `toml:"events"`
+	// SenderDomains restricts the endpoint to mails from these domains.
+	SenderDomains []string `toml:"sender-domains"`
+	// APIKeys restricts the endpoint to mails accepted with these API keys.
+	APIKeys []string `toml:"api-keys"`
+}
+
+// NewConfig returns a new Config with default settings.
+func NewConfig() *Config {
+	return &Config{
+		Enabled:     DefaultEnabled,
+		Timeout:     itoml.Duration(DefaultTimeout),
+		MaxAttempts: DefaultMaxAttempts,
+		RetryDelay:  itoml.Duration(DefaultRetryDelay),
+		QueueSize:   DefaultQueueSize,
+		Concurrency: DefaultConcurrency,
+	}
+}
+
+// Validate returns an error if the config is invalid.
+func (c *Config) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.MaxAttempts < 1 {
+		return fmt.Errorf("webhook max-attempts must be at least 1")
+	}
+	if c.Concurrency < 1 {
+		return fmt.Errorf("webhook concurrency must be at least 1")
+	}
+	for _, e := range c.Endpoints {
+		u, err := url.Parse(e.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook url %q", e.URL)
+		}
+		if e.Secret == "" {
+			return fmt.Errorf("webhook %s requires a secret", e.URL)
+		}
+		for _, typ := range e.Events {
+			if !validEventTypes[EventType(typ)] {
+				return fmt.Errorf("unknown webhook event %q", typ)
+			}
+		}
+	}
+	return nil
+}
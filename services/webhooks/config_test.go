@@ -0,0 +1,67 @@
+package webhooks_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nirnanaaa/cloudive-mailer/services/webhooks"
+)
+
+func TestConfig_Parse(t *testing.T) {
+	// Parse configuration.
+	c := webhooks.NewConfig()
+	if _, err := toml.Decode(`
+		enabled = true
+		timeout = "5s"
+		max-attempts = 3
+		retry-delay = "1s"
+
+		[[endpoint]]
+		url = "https://example.com/hooks/mail"
+		secret = "s3cr3t"
+		events = ["delivered", "bounced"]
+		sender-domains = ["example.com"]
+
+		[[endpoint]]
+		url = "https://other.example.com/hooks"
+		secret = "other"
+		api-keys = ["billing"]
+`, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	// Validate configuration.
+	if !c.Enabled {
+		t.Fatalf("unexpected Enabled, want true got false")
+	} else if time.Duration(c.Timeout) != 5*time.Second {
+		t.Fatalf("unexpected timeout: %s", c.Timeout)
+	} else if c.MaxAttempts != 3 {
+		t.Fatalf("unexpected max attempts: %d", c.MaxAttempts)
+	} else if time.Duration(c.RetryDelay) != time.Second {
+		t.Fatalf("unexpected retry delay: %s", c.RetryDelay)
+	} else if len(c.Endpoints) != 2 {
+		t.Fatalf("unexpected endpoints: %+v", c.Endpoints)
+	} else if e := c.Endpoints[0]; e.URL != "https://example.com/hooks/mail" || e.Secret != "s3cr3t" || len(e.Events) != 2 || e.SenderDomains[0] != "example.com" {
+		t.Fatalf("unexpected endpoint: %+v", e)
+	} else if e := c.Endpoints[1]; e.APIKeys[0] != "billing" {
+		t.Fatalf("unexpected endpoint: %+v", e)
+	} else if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	for _, e := range []webhooks.Endpoint{
+		{URL: "ftp://example.com", Secret: "s"},
+		{URL: "https://example.com"},
+		{URL: "https://example.com", Secret: "s", Events: []string{"opened"}},
+	} {
+		c := webhooks.NewConfig()
+		c.Enabled = true
+		c.Endpoints = []webhooks.Endpoint{e}
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected an error for %+v", e)
+		}
+	}
+}
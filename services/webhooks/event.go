@@ -0,0 +1,89 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// EventType is the kind of delivery event.
+type EventType string
+
+// All delivery events sent to webhooks.
+const (
+	EventDelivered EventType = "delivered"
+	EventDeferred  EventType = "deferred"
+	EventBounced   EventType = "bounced"
+	EventFailed    EventType = "failed"
+)
+
+var validEventTypes = map[EventType]bool{
+	EventDelivered: true,
+	EventDeferred:  true,
+	EventBounced:   true,
+	EventFailed:    true,
+}
+
+// Headers sent along with every webhook call.
+const (
+	HeaderSignature = "X-Mailer-Signature"
+	HeaderEvent     = "X-Mailer-Event"
+	HeaderDelivery  = "X-Mailer-Delivery"
+)
+
+// Event is a delivery event, sent as JSON body.
+type Event struct {
+	ID         string    `json:"id"`
+	Type       EventType `json:"event"`
+	At         time.Time `json:"at"`
+	TraceID    string    `json:"trace_id,omitempty"`
+	Sender     string    `json:"sender,omitempty"`
+	Recipients []string  `json:"recipients,omitempty"`
+	Attempt    int       `json:"attempt,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Rejected   []string  `json:"rejected,omitempty"`
+
+	// APIKey is the API key the mail was accepted with, it is only used to
+	// select the endpoints.
+	APIKey string `json:"-"`
+}
+
+// SenderDomain returns the lower cased domain of the sender.
+func (e *Event) SenderDomain() string {
+	return strings.ToLower(e.Sender[strings.LastIndex(e.Sender, "@")+1:])
+}
+
+// Match returns true if the endpoint wants to receive e.
+func (ep *Endpoint) Match(e *Event) bool {
+	return contains(ep.Events, string(e.Type), false) &&
+		contains(ep.SenderDomains, e.SenderDomain(), true) &&
+		contains(ep.APIKeys, e.APIKey, false)
+}
+
+// contains returns true if list is empty or contains s.
+func contains(list []string, s string, fold bool) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		if v == s || (fold && strings.EqualFold(v, s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign returns the signature header of a request body sent at t. The HMAC
+// covers the timestamp, so receivers can reject replayed requests:
+//
+//	t=<unix timestamp>,v1=<hex encoded HMAC-SHA256 of "<timestamp>.<body>">
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := fmt.Sprintf("%d", t.Unix())
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return fmt.Sprintf("t=%s,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+}
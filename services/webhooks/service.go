@@ -0,0 +1,196 @@
+package webhooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	sentCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailer_webhook_sent",
+		Help: "Number of webhook calls answered with a 2xx status",
+	})
+	retryCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailer_webhook_retried",
+		Help: "Number of failed webhook calls tried again",
+	})
+	failedCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailer_webhook_failed",
+		Help: "Number of webhook calls given up after all attempts",
+	})
+	droppedCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailer_webhook_dropped",
+		Help: "Number of webhook calls dropped because too many were pending",
+	})
+)
+
+// call is a pending webhook call of one endpoint.
+type call struct {
+	endpoint *Endpoint
+	event    *Event
+	body     []byte
+	delivery string
+}
+
+// Service sends delivery events to the configured endpoints in the
+// background. Failed calls are retried with an exponential backoff. Pending
+// calls are kept in memory only, they are lost when the service stops.
+type Service struct {
+	Logger *logrus.Entry
+	Config *Config
+	Client *http.Client
+
+	calls   chan *call
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewService returns a new instance of Service.
+func NewService(c *Config) *Service {
+	return &Service{
+		Logger:  logrus.New().WithField("prefix", "webhooks"),
+		Config:  c,
+		Client:  &http.Client{Timeout: time.Duration(c.Timeout)},
+		calls:   make(chan *call, c.QueueSize),
+		closing: make(chan struct{}),
+	}
+}
+
+// Start starts sending webhooks.
+func (s *Service) Start() error {
+	if err := s.registerMetrics(); err != nil {
+		return err
+	}
+	for i := 0; i < s.Config.Concurrency; i++ {
+		s.wg.Add(1)
+		go s.run()
+	}
+	return nil
+}
+
+// Stop stops sending webhooks after the current calls are done.
+func (s *Service) Stop() error {
+	close(s.closing)
+	s.wg.Wait()
+	if pending := len(s.calls); pending > 0 {
+		s.Logger.Warnf("Discarding %d pending webhook calls", pending)
+	}
+	return nil
+}
+
+// Notify queues a call of every endpoint matching e. It never blocks the
+// delivery of mails, calls are dropped when too many are pending.
+func (s *Service) Notify(e *Event) {
+	var body []byte
+	for i := range s.Config.Endpoints {
+		endpoint := &s.Config.Endpoints[i]
+		if !endpoint.Match(e) {
+			continue
+		}
+		if body == nil {
+			data, err := json.Marshal(e)
+			if err != nil {
+				s.Logger.WithError(err).Errorf("Could not encode %s event of message %s", e.Type, e.ID)
+				return
+			}
+			body = data
+		}
+		c := &call{endpoint: endpoint, event: e, body: body, delivery: uuid.NewV4().String()}
+		select {
+		case <-s.closing:
+			return
+		default:
+		}
+		select {
+		case s.calls <- c:
+		default:
+			droppedCount.Inc()
+			s.Logger.Warnf("Dropping %s event of message %s for %s, too many pending webhook calls", e.Type, e.ID, endpoint.URL)
+		}
+	}
+}
+
+func (s *Service) run() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.closing:
+			return
+		case c := <-s.calls:
+			s.deliver(c)
+		}
+	}
+}
+
+// deliver calls the endpoint until it succeeds or the maximum number of
+// attempts is reached.
+func (s *Service) deliver(c *call) {
+	delay := time.Duration(s.Config.RetryDelay)
+	for attempt := 1; ; attempt++ {
+		err := s.send(c)
+		if err == nil {
+			sentCount.Inc()
+			return
+		}
+		if attempt >= s.Config.MaxAttempts {
+			failedCount.Inc()
+			s.Logger.WithError(err).Errorf("Giving up on %s event of message %s for %s after %d attempts", c.event.Type, c.event.ID, c.endpoint.URL, attempt)
+			return
+		}
+		retryCount.Inc()
+		s.Logger.WithError(err).Warnf("Calling webhook %s failed, trying again in %s", c.endpoint.URL, delay)
+		select {
+		case <-s.closing:
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (s *Service) send(c *call) error {
+	req, err := http.NewRequest("POST", c.endpoint.URL, bytes.NewReader(c.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, string(c.event.Type))
+	// the delivery ID stays the same for all attempts, so receivers can
+	// detect duplicates.
+	req.Header.Set(HeaderDelivery, c.delivery)
+	req.Header.Set(HeaderSignature, Sign(c.endpoint.Secret, time.Now(), c.body))
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *Service) registerMetrics() error {
+	for _, c := range []prometheus.Collector{sentCount, retryCount, failedCount, droppedCount} {
+		if err := prometheus.Register(c); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SetLogOutput sets the writer to which all logs are written. It must not be
+// called after Open is called.
+func (s *Service) SetLogOutput(log *logrus.Logger) {
+	s.Logger = log.WithField("prefix", "webhooks")
+}
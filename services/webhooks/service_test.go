@@ -0,0 +1,93 @@
+package webhooks_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	itoml "github.com/influxdata/influxdb/toml"
+	"github.com/nirnanaaa/cloudive-mailer/services/webhooks"
+)
+
+type received struct {
+	event     webhooks.Event
+	signature string
+	body      []byte
+}
+
+// NewTestServer returns a server failing the first n requests.
+func NewTestServer(fail int) (*httptest.Server, <-chan received) {
+	ch := make(chan received, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail > 0 {
+			fail--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var e webhooks.Event
+		json.Unmarshal(body, &e)
+		ch <- received{event: e, signature: r.Header.Get(webhooks.HeaderSignature), body: body}
+	}))
+	return server, ch
+}
+
+func NewTestService(endpoints ...webhooks.Endpoint) *webhooks.Service {
+	c := webhooks.NewConfig()
+	c.Enabled = true
+	c.RetryDelay = itoml.Duration(10 * time.Millisecond)
+	c.Endpoints = endpoints
+	return webhooks.NewService(c)
+}
+
+func TestService_Notify(t *testing.T) {
+	server, ch := NewTestServer(2)
+	defer server.Close()
+	s := NewTestService(webhooks.Endpoint{URL: server.URL, Secret: "s3cr3t"})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	s.Notify(&webhooks.Event{ID: "abc", Type: webhooks.EventDelivered, Sender: "from@example.com"})
+	select {
+	case r := <-ch:
+		if r.event.ID != "abc" || r.event.Type != webhooks.EventDelivered {
+			t.Fatalf("unexpected event: %+v", r.event)
+		}
+		ts, err := strconv.ParseInt(strings.TrimPrefix(strings.Split(r.signature, ",")[0], "t="), 10, 64)
+		if err != nil {
+			t.Fatalf("unexpected signature: %s", r.signature)
+		}
+		if expected := webhooks.Sign("s3cr3t", time.Unix(ts, 0), r.body); r.signature != expected {
+			t.Fatalf("unexpected signature %s, expected %s", r.signature, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the webhook")
+	}
+}
+
+func TestEndpoint_Match(t *testing.T) {
+	e := &webhooks.Event{Type: webhooks.EventBounced, Sender: "from@Example.com", APIKey: "billing"}
+	for _, tt := range []struct {
+		endpoint webhooks.Endpoint
+		match    bool
+	}{
+		{webhooks.Endpoint{}, true},
+		{webhooks.Endpoint{Events: []string{"bounced", "failed"}}, true},
+		{webhooks.Endpoint{Events: []string{"delivered"}}, false},
+		{webhooks.Endpoint{SenderDomains: []string{"example.com"}}, true},
+		{webhooks.Endpoint{SenderDomains: []string{"other.com"}}, false},
+		{webhooks.Endpoint{APIKeys: []string{"billing"}}, true},
+		{webhooks.Endpoint{APIKeys: []string{"marketing"}}, false},
+	} {
+		if tt.endpoint.Match(e) != tt.match {
+			t.Errorf("%+v: expected match %v", tt.endpoint, tt.match)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	itoml "github.com/influxdata/influxdb/toml"
+)
+
+const (
+	// DefaultMaxAttempts defines how often a delivery is attempted before
+	// the message is moved to the dead letter queue
+	DefaultMaxAttempts = 10
+
+	// DefaultDedupeWindow defines how long the keys of delivered messages
+	// are remembered to skip duplicates
+	DefaultDedupeWindow = 24 * time.Hour
+
+	// DefaultDedupeBackend keeps the keys of delivered messages in memory
+	DefaultDedupeBackend = "memory"
+
+	// DefaultRedisAddress defines the address of the shared Redis backend
+	DefaultRedisAddress = "127.0.0.1:6379"
+
+	// DefaultRedisKeyPrefix is prepended to all keys stored in Redis
+	DefaultRedisKeyPrefix = "cloudive-mailer:"
+)
+
+// Config represents a configuration for the worker.
+type Config struct {
+	MaxAttempts int `toml:"max-attempts"`
+	// DedupeWindow defines how long delivered messages are skipped when
+	// they are consumed again. Zero disables skipping duplicates.
+	DedupeWindow itoml.Duration `toml:"dedupe-window"`
+	// DedupeBackend keeps the keys of delivered messages in memory or in
+	// Redis, so they are shared by all workers and survive restarts.
+	DedupeBackend  string `toml:"dedupe-backend"`
+	RedisAddress   string `toml:"redis-address"`
+	RedisPassword  string `toml:"redis-password"`
+	RedisDB        int    `toml:"redis-db"`
+	RedisKeyPrefix string `toml:"redis-key-prefix"`
+}
+
+// NewConfig returns a new Config with default settings.
+func NewConfig() *Config {
+	return &Config{
+		MaxAttempts:    DefaultMaxAttempts,
+		DedupeWindow:   itoml.Duration(DefaultDedupeWindow),
+		DedupeBackend:  DefaultDedupeBackend,
+		RedisAddress:   DefaultRedisAddress,
+		RedisKeyPrefix: DefaultRedisKeyPrefix,
+	}
+}
+
+// Validate returns an error if the config is invalid.
+func (c *Config) Validate() error {
+	if c.DedupeBackend != "memory" && c.DedupeBackend != "redis" {
+		return fmt.Errorf("worker: unknown dedupe backend %q", c.DedupeBackend)
+	}
+	if c.DedupeBackend == "redis" && c.RedisAddress == "" {
+		return errors.New("worker: redis dedupe backend requires a redis-address")
+	}
+	return nil
+}
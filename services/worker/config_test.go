@@ -0,0 +1,38 @@
+package worker_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nirnanaaa/cloudive-mailer/services/worker"
+)
+
+func TestConfig_Parse(t *testing.T) {
+	// Parse configuration.
+	c := worker.NewConfig()
+	if _, err := toml.Decode(`
+		max-attempts = 3
+		dedupe-window = "1h"
+		dedupe-backend = "redis"
+		redis-address = "redis:6379"
+`, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	// Validate configuration.
+	if c.MaxAttempts != 3 {
+		t.Fatalf("unexpected max attempts: %d", c.MaxAttempts)
+	} else if time.Duration(c.DedupeWindow) != time.Hour {
+		t.Fatalf("unexpected dedupe window: %s", time.Duration(c.DedupeWindow))
+	} else if c.DedupeBackend != "redis" || c.RedisAddress != "redis:6379" || c.RedisKeyPrefix != worker.DefaultRedisKeyPrefix {
+		t.Fatalf("unexpected dedupe backend: %s %s %s", c.DedupeBackend, c.RedisAddress, c.RedisKeyPrefix)
+	} else if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.DedupeBackend = "memcached"
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected an error for an unknown dedupe backend")
+	}
+}
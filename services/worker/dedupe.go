@@ -0,0 +1,121 @@
+package worker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// deliveredKeys remembers the keys of delivered messages for a window of
+// time, so messages consumed twice are only delivered once.
+type deliveredKeys interface {
+	// add remembers key until the window is over.
+	add(key string, now time.Time) error
+	// contains returns true if key was delivered within the window.
+	contains(key string, now time.Time) (bool, error)
+	Close() error
+}
+
+// newDeliveredKeys returns the delivered keys of the configured backend.
+func newDeliveredKeys(c *Config) deliveredKeys {
+	if c.DedupeBackend == "redis" {
+		return newRedisKeys(c)
+	}
+	return newMemoryKeys(time.Duration(c.DedupeWindow))
+}
+
+// memoryKeys keeps the keys inside the running process, so they are lost on
+// restarts and not shared with other workers.
+type memoryKeys struct {
+	window time.Duration
+
+	mu    sync.Mutex
+	keys  map[string]time.Time
+	swept time.Time
+}
+
+func newMemoryKeys(window time.Duration) *memoryKeys {
+	return &memoryKeys{
+		window: window,
+		keys:   make(map[string]time.Time),
+	}
+}
+
+func (d *memoryKeys) add(key string, now time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sweep(now)
+	d.keys[key] = now.Add(d.window)
+	return nil
+}
+
+func (d *memoryKeys) contains(key string, now time.Time) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	expires, ok := d.keys[key]
+	return ok && now.Before(expires), nil
+}
+
+// sweep drops expired keys once a minute.
+func (d *memoryKeys) sweep(now time.Time) {
+	if now.Sub(d.swept) < time.Minute {
+		return
+	}
+	d.swept = now
+	for key, expires := range d.keys {
+		if !now.Before(expires) {
+			delete(d.keys, key)
+		}
+	}
+}
+
+func (d *memoryKeys) Close() error {
+	return nil
+}
+
+// redisKeys keeps the keys in Redis, so all workers share them. Redis
+// expires them after the window.
+type redisKeys struct {
+	window time.Duration
+	pool   *redis.Pool
+	prefix string
+}
+
+func newRedisKeys(c *Config) *redisKeys {
+	return &redisKeys{
+		window: time.Duration(c.DedupeWindow),
+		prefix: c.RedisKeyPrefix + "delivered:",
+		pool: &redis.Pool{
+			MaxIdle:     8,
+			IdleTimeout: 5 * time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", c.RedisAddress,
+					redis.DialPassword(c.RedisPassword),
+					redis.DialDatabase(c.RedisDB),
+					redis.DialConnectTimeout(time.Second),
+					redis.DialReadTimeout(time.Second),
+					redis.DialWriteTimeout(time.Second),
+				)
+			},
+		},
+	}
+}
+
+func (d *redisKeys) add(key string, now time.Time) error {
+	conn := d.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("SET", d.prefix+key, now.Unix(), "PX", int64(d.window/time.Millisecond))
+	return err
+}
+
+func (d *redisKeys) contains(key string, now time.Time) (bool, error) {
+	conn := d.pool.Get()
+	defer conn.Close()
+	return redis.Bool(conn.Do("EXISTS", d.prefix+key))
+}
+
+// Close closes all idle connections.
+func (d *redisKeys) Close() error {
+	return d.pool.Close()
+}
@@ -0,0 +1,36 @@
+package worker
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// The first metrics keep the names they had when the worker only consumed
+// Kafka, so existing dashboards and alerts still work.
+var (
+	totalProcessedCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kafka_filter_processed",
+		Help: "Number of processed messages",
+	})
+	processingTime = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "kafka_filter_duration",
+		Help: "Time it takes for messages to be delivered",
+	})
+	errorCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kafka_filter_error",
+		Help: "Number of unsuccessfully processed messages",
+	})
+	retryCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailer_worker_retried",
+		Help: "Number of failed messages queued for another attempt",
+	})
+	failureCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailer_worker_delivery_failed",
+		Help: "Number of failed deliveries by class of the SMTP error",
+	}, []string{"class"})
+	deadLetterCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailer_worker_dead_lettered",
+		Help: "Number of messages moved to the dead letter queue",
+	})
+	duplicateCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailer_worker_duplicates_skipped",
+		Help: "Number of messages skipped as they have been delivered already",
+	})
+)
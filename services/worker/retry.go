@@ -0,0 +1,107 @@
+package worker
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
+	"github.com/nirnanaaa/cloudive-mailer/services/smtp"
+)
+
+// Message headers keeping track of the delivery attempts.
+const (
+	HeaderAttempts     = "x-mailer-attempts"
+	HeaderFirstAttempt = "x-mailer-first-attempt"
+	HeaderLastAttempt  = "x-mailer-last-attempt"
+	HeaderLastError    = "x-mailer-last-error"
+	HeaderHistory      = "x-mailer-attempt-history"
+	// HeaderDeliveredTo lists the recipients which accepted the message in
+	// an earlier attempt, retries skip them.
+	HeaderDeliveredTo = "x-mailer-delivered-to"
+)
+
+// Attempt is a failed delivery attempt.
+type Attempt struct {
+	Attempt int       `json:"attempt"`
+	At      time.Time `json:"at"`
+	Error   string    `json:"error"`
+}
+
+// permanentError marks failures, which won't go away by trying again.
+type permanentError struct {
+	error
+}
+
+// Attempts returns the number of failed delivery attempts of msg.
+func Attempts(msg *queue.Message) int {
+	n, _ := strconv.Atoi(msg.Header(HeaderAttempts))
+	return n
+}
+
+// History returns all failed delivery attempts of msg.
+func History(msg *queue.Message) []Attempt {
+	var history []Attempt
+	if v := msg.Header(HeaderHistory); v != "" {
+		json.Unmarshal([]byte(v), &history)
+	}
+	return history
+}
+
+// recordAttempt stores a failed attempt in the headers of msg and returns
+// the number of attempts so far.
+func recordAttempt(msg *queue.Message, err error, now time.Time) int {
+	attempt := Attempts(msg) + 1
+	at := now.UTC().Format(time.RFC3339Nano)
+	if msg.Header(HeaderFirstAttempt) == "" {
+		msg.SetHeader(HeaderFirstAttempt, at)
+	}
+	msg.SetHeader(HeaderAttempts, strconv.Itoa(attempt))
+	msg.SetHeader(HeaderLastAttempt, at)
+	msg.SetHeader(HeaderLastError, err.Error())
+	history := append(History(msg), Attempt{Attempt: attempt, At: now.UTC(), Error: err.Error()})
+	if data, jerr := json.Marshal(history); jerr == nil {
+		msg.SetHeader(HeaderHistory, string(data))
+	}
+	return attempt
+}
+
+// DeliveredTo returns the recipients which accepted msg in earlier attempts.
+func DeliveredTo(msg *queue.Message) []string {
+	v := msg.Header(HeaderDeliveredTo)
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
+// recordDeliveredTo adds the recipients which accepted msg in this attempt
+// to its headers.
+func recordDeliveredTo(msg *queue.Message, report *smtp.DeliveryReport) {
+	delivered := DeliveredTo(msg)
+	for _, r := range report.Accepted() {
+		delivered = append(delivered, r.Email)
+	}
+	if len(delivered) > 0 {
+		msg.SetHeader(HeaderDeliveredTo, strings.Join(delivered, ","))
+	}
+}
+
+// pending returns the recipients of msg which haven't accepted it yet.
+func pending(msg *queue.Message, recipients []string) []string {
+	delivered := map[string]bool{}
+	for _, addr := range DeliveredTo(msg) {
+		delivered[strings.ToLower(addr)] = true
+	}
+	if len(delivered) == 0 {
+		return recipients
+	}
+	var addrs []string
+	for _, addr := range recipients {
+		if !delivered[strings.ToLower(addr)] {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
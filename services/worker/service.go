@@ -0,0 +1,263 @@
+package worker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/kafka/event"
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
+	"github.com/nirnanaaa/cloudive-mailer/services/smtp"
+	"github.com/nirnanaaa/cloudive-mailer/services/status"
+	"github.com/nirnanaaa/cloudive-mailer/services/templates"
+	"github.com/nirnanaaa/cloudive-mailer/services/webhooks"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// Service delivers mails consumed from any queue backend via SMTP. Failed
+// deliveries are re-published with an increasing delay until the maximum
+// number of attempts is reached, then they are moved to the dead letter queue.
+type Service struct {
+	Logger      *logrus.Entry
+	Config      *Config
+	SMTP        *smtp.Service
+	Retries     queue.RetryPublisher
+	DeadLetters queue.DeadLetterPublisher
+	Templates   templates.Store
+	Status      status.Reporter
+	Webhooks    *webhooks.Service
+
+	delivered deliveredKeys
+}
+
+// NewService returns a new instance of Service.
+func NewService(c *Config, smtp *smtp.Service, q queue.Backend) *Service {
+	s := &Service{
+		Logger:      logrus.New().WithField("prefix", "worker"),
+		Config:      c,
+		SMTP:        smtp,
+		Retries:     q,
+		DeadLetters: q,
+	}
+	if c.DedupeWindow > 0 {
+		s.delivered = newDeliveredKeys(c)
+	}
+	return s
+}
+
+// Start starts the service
+func (s *Service) Start() error {
+	return s.registerMetrics()
+}
+
+// Stop stops the service
+func (s *Service) Stop() error {
+	if s.delivered != nil {
+		return s.delivered.Close()
+	}
+	return nil
+}
+
+// Handle delivers a single queued mail. Mails which have been delivered
+// already are skipped.
+func (s *Service) Handle(msg *queue.Message) error {
+	if s.duplicate(msg) {
+		duplicateCount.Inc()
+		s.Logger.Infof("Skipping message %s, it has been delivered already", msg.Key)
+		return nil
+	}
+	totalProcessedCount.Inc()
+	timer := prometheus.NewTimer(processingTime)
+	defer timer.ObserveDuration()
+	s.report(msg, status.Event{State: status.StateAttempting, Attempt: Attempts(msg) + 1})
+	if err := s.process(msg); err != nil {
+		errorCount.Inc()
+		s.retry(msg, err)
+		return err
+	}
+	if s.delivered != nil {
+		if err := s.delivered.add(msg.Key, time.Now()); err != nil {
+			s.Logger.WithError(err).Warnf("Could not remember delivered message %s", msg.Key)
+		}
+	}
+	return nil
+}
+
+// duplicate returns true if the message has been delivered within the
+// dedupe window. With the memory backend, only messages delivered by this
+// process are known, unless the worker reports into a status store of the
+// same process, as in standalone mode. Workers consuming Kafka need the
+// redis backend to skip duplicates after a restart or rebalance.
+func (s *Service) duplicate(msg *queue.Message) bool {
+	if s.delivered == nil {
+		return false
+	}
+	delivered, err := s.delivered.contains(msg.Key, time.Now())
+	if err != nil {
+		// delivering twice is better than not at all
+		s.Logger.WithError(err).Warnf("Could not look up whether message %s has been delivered", msg.Key)
+	} else if delivered {
+		return true
+	}
+	store, ok := s.Status.(status.Store)
+	if !ok {
+		return false
+	}
+	st, err := store.Get(msg.Key)
+	if err != nil {
+		return false
+	}
+	return st.State == status.StateDelivered && time.Since(st.UpdatedAt) < time.Duration(s.Config.DedupeWindow)
+}
+
+// retry re-queues a failed message or moves it to the dead letter queue.
+// Permanent SMTP errors are dead-lettered right away, transient and network
+// errors are retried.
+func (s *Service) retry(msg *queue.Message, err error) {
+	attempt := recordAttempt(msg, err, time.Now())
+	_, permanent := err.(permanentError)
+	if de, ok := err.(*smtp.DeliveryError); ok {
+		failureCount.WithLabelValues(string(de.Class)).Inc()
+		s.Logger.WithFields(logrus.Fields{
+			"class":  de.Class,
+			"code":   de.Code,
+			"status": de.Status,
+		}).Warnf("Delivery of message %s failed: %s", msg.Key, de)
+		permanent = de.Permanent()
+	}
+	if !permanent && attempt < s.Config.MaxAttempts {
+		retryCount.Inc()
+		qerr := s.Retries.PublishRetry(msg, attempt)
+		if qerr == nil {
+			s.report(msg, status.Event{State: status.StateDeferred, Attempt: attempt, Error: err.Error()})
+			return
+		}
+		s.Logger.WithError(qerr).Errorf("Could not re-queue message %s", msg.Key)
+	}
+	s.Logger.Errorf("Giving up on message %s after %d attempts: %s", msg.Key, attempt, err)
+	state := status.StateDeadLettered
+	if de, ok := err.(*smtp.DeliveryError); ok && de.Permanent() {
+		state = status.StateBounced
+	}
+	s.report(msg, status.Event{State: state, Attempt: attempt, Error: err.Error()})
+	deadLetterCount.Inc()
+	if qerr := s.DeadLetters.PublishDeadLetter(msg); qerr != nil {
+		s.Logger.WithError(qerr).Errorf("Could not move message %s to the dead letter queue", msg.Key)
+	}
+}
+
+func (s *Service) process(msg *queue.Message) error {
+	decoded, err := event.DecodeIncomingEvent(msg.Value)
+	if err != nil {
+		return permanentError{err}
+	}
+	// a template which does not render won't render on the next try either,
+	// so these mails are dead-lettered right away.
+	if decoded.TemplateID != "" {
+		if s.Templates == nil {
+			return permanentError{fmt.Errorf("message %s references template %s, but templates are disabled", msg.Key, decoded.TemplateID)}
+		}
+		if err := templates.RenderEvent(s.Templates, decoded); err != nil {
+			return permanentError{fmt.Errorf("rendering template %s of message %s failed: %s", decoded.TemplateID, msg.Key, err)}
+		}
+	}
+
+	// recipients which accepted the message in an earlier attempt don't get
+	// it twice
+	recipients := pending(msg, decoded.EnvelopeRecipients())
+	if len(recipients) == 0 && len(DeliveredTo(msg)) > 0 {
+		s.report(msg, status.Event{State: status.StateDelivered, Attempt: Attempts(msg) + 1})
+		return nil
+	}
+	report, err := s.SMTP.DeliverTo(decoded, recipients)
+	if err != nil {
+		if report != nil {
+			recordDeliveredTo(msg, report)
+		}
+		return err
+	}
+	// the message is delivered to the accepted recipients, retrying would
+	// deliver it to them twice.
+	delivered := status.Event{State: status.StateDelivered, Attempt: Attempts(msg) + 1}
+	for _, rejected := range report.Rejected() {
+		failureCount.WithLabelValues(string(rejected.Class)).Inc()
+		s.Logger.WithFields(logrus.Fields{
+			"class":  rejected.Class,
+			"code":   rejected.Code,
+			"status": rejected.Status,
+		}).Warnf("Recipient %s of message %s was rejected: %s", rejected.Email, msg.Key, rejected.Error)
+		delivered.Rejected = append(delivered.Rejected, rejected.Email)
+	}
+	s.report(msg, delivered)
+	return nil
+}
+
+// webhookEvents maps the states sent to webhooks to their event types.
+var webhookEvents = map[status.State]webhooks.EventType{
+	status.StateDelivered:    webhooks.EventDelivered,
+	status.StateDeferred:     webhooks.EventDeferred,
+	status.StateBounced:      webhooks.EventBounced,
+	status.StateDeadLettered: webhooks.EventFailed,
+}
+
+// report reports a state change of msg to the status store and webhooks,
+// if they are enabled.
+func (s *Service) report(msg *queue.Message, e status.Event) {
+	e.ID = msg.Key
+	e.At = time.Now().UTC()
+	if s.Status != nil {
+		if err := s.Status.Report(&e); err != nil {
+			s.Logger.WithError(err).Warnf("Could not report state %s of message %s", e.State, msg.Key)
+		}
+	}
+	if typ, ok := webhookEvents[e.State]; ok && s.Webhooks != nil {
+		s.Webhooks.Notify(newWebhookEvent(msg, typ, &e))
+	}
+}
+
+func newWebhookEvent(msg *queue.Message, typ webhooks.EventType, e *status.Event) *webhooks.Event {
+	evt := &webhooks.Event{
+		ID:       e.ID,
+		Type:     typ,
+		At:       e.At,
+		Attempt:  e.Attempt,
+		Error:    e.Error,
+		Rejected: e.Rejected,
+		APIKey:   msg.Header(queue.HeaderAPIKey),
+	}
+	// undecodable mails are still reported, only without their addresses
+	if decoded, err := event.DecodeIncomingEvent(msg.Value); err == nil {
+		evt.TraceID = decoded.TraceID
+		evt.Sender = decoded.Sender.Email
+		evt.Recipients = decoded.EnvelopeRecipients()
+	}
+	return evt
+}
+
+func (s *Service) registerMetrics() error {
+	if err := prometheus.Register(processingTime); err != nil {
+		return err
+	}
+	if err := prometheus.Register(totalProcessedCount); err != nil {
+		return err
+	}
+	if err := prometheus.Register(retryCount); err != nil {
+		return err
+	}
+	if err := prometheus.Register(failureCount); err != nil {
+		return err
+	}
+	if err := prometheus.Register(deadLetterCount); err != nil {
+		return err
+	}
+	if err := prometheus.Register(duplicateCount); err != nil {
+		return err
+	}
+	return prometheus.Register(errorCount)
+}
+
+// SetLogOutput sets the writer to which all logs are written. It must not be
+// called after Open is called.
+func (s *Service) SetLogOutput(log *logrus.Logger) {
+	s.Logger = log.WithField("prefix", "worker")
+}
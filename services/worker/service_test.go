@@ -0,0 +1,160 @@
+package worker_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nirnanaaa/cloudive-mailer/services/queue"
+	"github.com/nirnanaaa/cloudive-mailer/services/smtp"
+	"github.com/nirnanaaa/cloudive-mailer/services/status"
+	"github.com/nirnanaaa/cloudive-mailer/services/worker"
+)
+
+type deadLetters []*queue.Message
+
+func (d *deadLetters) PublishDeadLetter(msg *queue.Message) error {
+	*d = append(*d, msg)
+	return nil
+}
+
+type states []status.State
+
+func (s *states) Report(e *status.Event) error {
+	*s = append(*s, e.State)
+	return nil
+}
+
+// NewTestService returns a worker whose deliveries always fail.
+func NewTestService(maxAttempts int) (*worker.Service, *queue.MemoryQueue, *deadLetters) {
+	c := worker.NewConfig()
+	c.MaxAttempts = maxAttempts
+	smtpConfig := smtp.NewConfig()
+	smtpConfig.Enabled = false
+	q := queue.NewMemoryQueue(queue.NewConfig())
+	s := worker.NewService(c, smtp.NewService(smtpConfig), q)
+	dl := &deadLetters{}
+	s.DeadLetters = dl
+	return s, q, dl
+}
+
+func TestService_RetryAndDeadLetter(t *testing.T) {
+	s, q, dl := NewTestService(2)
+	reported := &states{}
+	s.Status = reported
+	msg := &queue.Message{Key: "abc", Value: []byte(`{"recipient":{"email":"to@example.com"}}`)}
+
+	if err := s.Handle(msg); err == nil {
+		t.Fatal("expected delivery to fail")
+	}
+	if q.Delayed() != 1 {
+		t.Fatalf("expected message to be delayed, delayed %d", q.Delayed())
+	} else if !msg.NotBefore().After(time.Now().Add(50 * time.Second)) {
+		t.Fatalf("unexpected not before: %s", msg.NotBefore())
+	} else if worker.Attempts(msg) != 1 {
+		t.Fatalf("unexpected attempts: %d", worker.Attempts(msg))
+	}
+
+	s.Handle(msg)
+	if len(*dl) != 1 {
+		t.Fatalf("expected message to be dead-lettered, got %d", len(*dl))
+	}
+	history := worker.History((*dl)[0])
+	if len(history) != 2 || history[1].Attempt != 2 || history[1].Error == "" {
+		t.Fatalf("unexpected history: %+v", history)
+	}
+	if (*dl)[0].Header(worker.HeaderLastError) == "" || (*dl)[0].Header(worker.HeaderFirstAttempt) == "" {
+		t.Fatalf("unexpected headers: %+v", (*dl)[0].Headers)
+	}
+	expected := states{status.StateAttempting, status.StateDeferred, status.StateAttempting, status.StateDeadLettered}
+	if !reflect.DeepEqual(*reported, expected) {
+		t.Fatalf("unexpected states: %v", *reported)
+	}
+}
+
+func TestService_DeadLetterUndecodable(t *testing.T) {
+	s, q, dl := NewTestService(10)
+	s.Handle(&queue.Message{Key: "abc", Value: []byte(`{`)})
+	if q.Len() != 0 || q.Delayed() != 0 || len(*dl) != 1 {
+		t.Fatalf("expected undecodable message to be dead-lettered right away")
+	}
+}
+
+// deliveredStore is a status store in which every message is delivered.
+type deliveredStore struct {
+	states
+}
+
+func (d *deliveredStore) Get(id string) (*status.Status, error) {
+	return &status.Status{ID: id, State: status.StateDelivered, UpdatedAt: time.Now()}, nil
+}
+
+func (d *deliveredStore) List(f status.Filter) ([]*status.Status, error) {
+	return nil, nil
+}
+
+func TestService_SkipDelivered(t *testing.T) {
+	s, q, dl := NewTestService(10)
+	store := &deliveredStore{}
+	s.Status = store
+	if err := s.Handle(&queue.Message{Key: "abc", Value: []byte(`{"recipient":{"email":"to@example.com"}}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if q.Delayed() != 0 || len(*dl) != 0 || len(store.states) != 0 {
+		t.Fatalf("expected delivered message to be skipped, reported %v", store.states)
+	}
+
+	// without a dedupe window, the message is delivered again
+	c := worker.NewConfig()
+	c.DedupeWindow = 0
+	s = worker.NewService(c, s.SMTP, q)
+	s.Status = store
+	if err := s.Handle(&queue.Message{Key: "abc", Value: []byte(`{"recipient":{"email":"to@example.com"}}`)}); err == nil {
+		t.Fatal("expected delivery to be attempted")
+	}
+}
+
+func TestService_SkipDeliveredRecipients(t *testing.T) {
+	s, q, dl := NewTestService(10)
+	msg := &queue.Message{Key: "abc", Value: []byte(`{"recipient":{"email":"to@example.com"},"cc":[{"email":"cc@example.com"}]}`)}
+
+	// only some recipients accepted the message, the others are retried
+	msg.SetHeader(worker.HeaderDeliveredTo, "TO@example.com")
+	if err := s.Handle(msg); err == nil {
+		t.Fatal("expected delivery to be attempted")
+	}
+
+	msg.SetHeader(worker.HeaderDeliveredTo, "to@example.com,cc@example.com")
+	if err := s.Handle(msg); err != nil {
+		t.Fatal(err)
+	} else if q.Delayed() != 1 || len(*dl) != 0 {
+		t.Fatalf("unexpected retries: %d delayed, %d dead letters", q.Delayed(), len(*dl))
+	}
+}
+
+// TestService_SkipDeliveredWithoutStore covers workers reporting into the
+// Kafka status queue, which they can't look messages up in.
+func TestService_SkipDeliveredWithoutStore(t *testing.T) {
+	s, q, _ := NewTestService(10)
+	s.Status = &states{}
+	value := []byte(`{"recipient":{"email":"to@example.com"}}`)
+	msg := &queue.Message{Key: "abc", Value: value}
+	msg.SetHeader(worker.HeaderDeliveredTo, "to@example.com")
+	if err := s.Handle(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// the memory backend knows the messages delivered by this worker
+	if err := s.Handle(&queue.Message{Key: "abc", Value: value}); err != nil {
+		t.Fatal(err)
+	} else if q.Delayed() != 0 {
+		t.Fatal("expected delivered message to be skipped")
+	}
+
+	// but not the ones delivered before a restart
+	restarted := worker.NewService(s.Config, s.SMTP, q)
+	restarted.Status = &states{}
+	if err := restarted.Handle(&queue.Message{Key: "abc", Value: value}); err == nil {
+		t.Fatal("expected delivery to be attempted")
+	}
+}